@@ -0,0 +1,33 @@
+package smartcomplete
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ApplyCompletion inserts completion into fileContent at the cursor, which
+// uses the request's coordinates: 0-based lines split on LF and byte
+// columns. Unlike Complete, which clamps cursors, it returns an
+// ErrInvalidRequest error for a cursor outside the file or inside a
+// multibyte rune. The completion is inserted as-is; convert its line
+// endings to CompletionResponse.LineEnding first if the file uses CRLF.
+//
+// For any valid cursor, the result is prefix + completion + suffix where
+// prefix and suffix are what the cursor splits fileContent into, so
+// prefix + suffix is always the original content.
+func ApplyCompletion(fileContent string, line, col int, completion string) (string, error) {
+	lines := strings.Split(fileContent, "\n")
+	if line < 0 || line >= len(lines) {
+		return "", fmt.Errorf("%w: cursor line %d outside file with %d lines", ErrInvalidRequest, line, len(lines))
+	}
+	if col < 0 || col > len(lines[line]) {
+		return "", fmt.Errorf("%w: cursor column %d outside line %d of length %d", ErrInvalidRequest, col, line, len(lines[line]))
+	}
+	if col < len(lines[line]) && !utf8.RuneStart(lines[line][col]) {
+		return "", fmt.Errorf("%w: cursor column %d inside a multibyte character on line %d", ErrInvalidRequest, col, line)
+	}
+
+	prefix, suffix := extractPrefixSuffix(fileContent, line, col)
+	return prefix + completion + suffix, nil
+}
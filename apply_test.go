@@ -0,0 +1,63 @@
+package smartcomplete
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyCompletion(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		line, col  int
+		completion string
+		want       string
+	}{
+		{"mid line", "func main() {\n}\n", 0, 11, " int", "func main() int {\n}\n"},
+		{"multibyte before cursor", "s := \"héllo\"\n", 0, 13, " // ü", "s := \"héllo\" // ü\n"},
+		{"multiline completion", "if ok {\n}\n", 0, 7, "\n\tdone()", "if ok {\n\tdone()\n}\n"},
+		{"end of file without newline", "a\nbc", 1, 2, "d", "a\nbcd"},
+		{"end of file after newline", "a\nbc\n", 2, 0, "d()\n", "a\nbc\nd()\n"},
+		{"empty file", "", 0, 0, "package main\n", "package main\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyCompletion(tt.content, tt.line, tt.col, tt.completion)
+			if err != nil {
+				t.Fatalf("ApplyCompletion: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ApplyCompletion() = %q, want %q", got, tt.want)
+			}
+
+			// extractPrefixSuffix is its inverse around the inserted text
+			prefix, suffix := extractPrefixSuffix(tt.content, tt.line, tt.col)
+			if prefix+suffix != tt.content || got != prefix+tt.completion+suffix {
+				t.Errorf("split %q | %q does not match ApplyCompletion() = %q", prefix, suffix, got)
+			}
+			if empty, _ := ApplyCompletion(tt.content, tt.line, tt.col, ""); empty != tt.content {
+				t.Errorf("ApplyCompletion with no completion = %q, want the original", empty)
+			}
+		})
+	}
+}
+
+func TestApplyCompletionInvalidCursor(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		line, col int
+	}{
+		{"line past end of file", "a\nbc\n", 3, 0},
+		{"negative line", "a", -1, 0},
+		{"column past end of line", "abc\nd", 0, 4},
+		{"column inside a multibyte rune", "héllo", 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ApplyCompletion(tt.content, tt.line, tt.col, "x"); !errors.Is(err, ErrInvalidRequest) {
+				t.Errorf("ApplyCompletion() err = %v, want ErrInvalidRequest", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package smartcomplete
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authSet is a project's authorized files indexed for O(1) lookup
+type authSet struct {
+	baseDir   string
+	exact     map[string]struct{}
+	patterns  [][]string // glob patterns, split into path segments
+	expiresAt time.Time
+}
+
+// newAuthSet indexes authorized files by cleaned absolute path. Entries
+// containing "*" are also kept as patterns, where "*" matches within a path
+// segment and a "**" segment matches any number of directories (e.g.
+// "src/**"). No other characters are special, so names like "[id].tsx"
+// only match themselves.
+func newAuthSet(baseDir string, files []string) *authSet {
+	set := &authSet{
+		baseDir: baseDir,
+		exact:   make(map[string]struct{}, len(files)),
+	}
+	for _, f := range files {
+		cleaned := filepath.Clean(resolveFilePath(baseDir, f))
+		set.exact[cleaned] = struct{}{}
+		if strings.Contains(f, "*") {
+			set.patterns = append(set.patterns, splitPath(cleaned))
+		}
+	}
+	return set
+}
+
+// allows reports whether filePath is authorized
+func (a *authSet) allows(filePath string) bool {
+	cleaned := filepath.Clean(resolveFilePath(a.baseDir, filePath))
+	if _, ok := a.exact[cleaned]; ok {
+		return true
+	}
+	if len(a.patterns) == 0 {
+		return false
+	}
+	segments := splitPath(cleaned)
+	for _, pattern := range a.patterns {
+		if matchSegments(pattern, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPath splits a cleaned path into its segments
+func splitPath(p string) []string {
+	return strings.Split(filepath.ToSlash(p), "/")
+}
+
+// matchSegments matches path segments against pattern segments, where a
+// "**" segment matches zero or more path segments
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if !matchStar(pattern[0], segments[0]) {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// matchStar matches a path segment against a pattern in which "*" matches
+// any run of characters and everything else matches literally
+func matchStar(pattern, segment string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == segment
+	}
+	if !strings.HasPrefix(segment, parts[0]) {
+		return false
+	}
+	segment = segment[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(segment, part)
+		if i < 0 {
+			return false
+		}
+		segment = segment[i+len(part):]
+	}
+	return len(segment) >= len(last) && strings.HasSuffix(segment, last)
+}
+
+// maxAuthSets bounds how many authSets an authCache holds at once
+const maxAuthSets = 256
+
+// authKey identifies a cached authSet. Keying by getter as well as project
+// keeps services that share a project ID across getters from seeing each
+// other's authorized files.
+type authKey struct {
+	pg        ProjectGetter
+	projectID string
+}
+
+// authCache keeps each project's authSet for a TTL. A zero TTL rebuilds the
+// set on every request.
+type authCache struct {
+	sets map[authKey]*authSet
+	ttl  time.Duration
+	mu   sync.Mutex
+}
+
+// newAuthCache creates an authCache with the given TTL
+func newAuthCache(ttl time.Duration) *authCache {
+	return &authCache{
+		sets: make(map[authKey]*authSet),
+		ttl:  ttl,
+	}
+}
+
+// get returns the project's authSet, building it if missing or expired.
+// Getters whose dynamic type can't be a map key are never cached.
+func (c *authCache) get(projectID string, pg ProjectGetter) (*authSet, error) {
+	key := authKey{pg: pg, projectID: projectID}
+	cacheable := c.ttl > 0 && reflect.TypeOf(pg).Comparable()
+	if cacheable {
+		c.mu.Lock()
+		set, exists := c.sets[key]
+		c.mu.Unlock()
+		if exists && time.Now().Before(set.expiresAt) {
+			return set, nil
+		}
+	}
+
+	authorizedFiles, err := pg.GetProjectAuthorizedFiles(projectID)
+	if err != nil {
+		return nil, err
+	}
+	baseDir, _ := pg.GetProjectBaseDir(projectID)
+	set := newAuthSet(baseDir, authorizedFiles)
+
+	if cacheable {
+		set.expiresAt = time.Now().Add(c.ttl)
+		c.mu.Lock()
+		c.makeRoom(key)
+		c.sets[key] = set
+		c.mu.Unlock()
+	}
+	return set, nil
+}
+
+// makeRoom drops expired sets and, if the cache is still full, the one
+// closest to expiry, so adding key keeps it within maxAuthSets. The caller
+// holds c.mu.
+func (c *authCache) makeRoom(key authKey) {
+	if _, exists := c.sets[key]; exists || len(c.sets) < maxAuthSets {
+		return
+	}
+	now := time.Now()
+	var oldest authKey
+	var oldestExpiry time.Time
+	for k, set := range c.sets {
+		if !now.Before(set.expiresAt) {
+			delete(c.sets, k)
+			continue
+		}
+		if oldestExpiry.IsZero() || set.expiresAt.Before(oldestExpiry) {
+			oldest, oldestExpiry = k, set.expiresAt
+		}
+	}
+	if len(c.sets) >= maxAuthSets {
+		delete(c.sets, oldest)
+	}
+}
+
+// invalidate drops the cached authSets for a project under every getter
+func (c *authCache) invalidate(projectID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.sets {
+		if k.projectID == projectID {
+			delete(c.sets, k)
+		}
+	}
+}
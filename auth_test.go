@@ -0,0 +1,212 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthSetExact(t *testing.T) {
+	set := newAuthSet(testBaseDir, []string{"main.go", "pkg/util.go", testBaseDir + "/abs.go", "./dot/../clean.go"})
+	tests := []struct {
+		filePath string
+		want     bool
+	}{
+		{"main.go", true},
+		{testBaseDir + "/main.go", true},
+		{"pkg/util.go", true},
+		{"pkg/../pkg/util.go", true},
+		{"abs.go", true},
+		{"clean.go", true},
+		{"pkg/other.go", false},
+		{"../project/main.go", true},
+		{"../elsewhere/main.go", false},
+	}
+	for _, tt := range tests {
+		if got := set.allows(tt.filePath); got != tt.want {
+			t.Errorf("allows(%q) = %t, want %t", tt.filePath, got, tt.want)
+		}
+	}
+}
+
+func TestAuthCacheTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		wantAfter bool // a file authorized after the first check is allowed
+	}{
+		{"no cache", 0, true},
+		{"cached", time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{"a.go": "", "b.go": ""})
+			pg.authorized = []string{"a.go"}
+			cache := newAuthCache(tt.ttl)
+			if _, err := cache.get("p", pg); err != nil {
+				t.Fatalf("get: %v", err)
+			}
+
+			pg.authorized = []string{"a.go", "b.go"}
+			set, err := cache.get("p", pg)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if got := set.allows("b.go"); got != tt.wantAfter {
+				t.Errorf("newly authorized file allowed = %t, want %t", got, tt.wantAfter)
+			}
+
+			cache.invalidate("p")
+			if set, _ := cache.get("p", pg); !set.allows("b.go") {
+				t.Error("newly authorized file not allowed after invalidate")
+			}
+		})
+	}
+}
+
+func TestAuthCacheSeparatesGetters(t *testing.T) {
+	first := newFakeProject(map[string]string{"a.go": ""})
+	first.authorized = []string{"a.go"}
+	second := newFakeProject(map[string]string{"b.go": ""})
+	second.authorized = []string{"b.go"}
+
+	cache := newAuthCache(time.Minute)
+	if _, err := cache.get("p", first); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	set, err := cache.get("p", second)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if set.allows("a.go") || !set.allows("b.go") {
+		t.Error("second getter was served the first getter's authorized files")
+	}
+
+	cache.invalidate("p")
+	if n := len(cache.sets); n != 0 {
+		t.Errorf("invalidate left %d sets, want 0", n)
+	}
+}
+
+func TestAuthCacheBounded(t *testing.T) {
+	pg := newFakeProject(map[string]string{"a.go": ""})
+	pg.authorized = []string{"a.go"}
+	cache := newAuthCache(time.Minute)
+	for i := 0; i < maxAuthSets+10; i++ {
+		if _, err := cache.get(fmt.Sprintf("p%d", i), pg); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+	}
+	if n := len(cache.sets); n > maxAuthSets {
+		t.Errorf("cache holds %d sets, want at most %d", n, maxAuthSets)
+	}
+	if _, exists := cache.sets[authKey{pg: pg, projectID: fmt.Sprintf("p%d", maxAuthSets+9)}]; !exists {
+		t.Error("most recent set was evicted")
+	}
+}
+
+func BenchmarkAuthorization(b *testing.B) {
+	files := make([]string, 10000)
+	for i := range files {
+		files[i] = fmt.Sprintf("pkg%d/file%d.go", i%100, i)
+	}
+	target := files[len(files)-1]
+
+	b.Run("linear scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			targetPath := filepath.Clean(resolveFilePath(testBaseDir, target))
+			found := false
+			for _, f := range files {
+				if filepath.Clean(resolveFilePath(testBaseDir, f)) == targetPath {
+					found = true
+					break
+				}
+			}
+			if !found {
+				b.Fatal("not authorized")
+			}
+		}
+	})
+	b.Run("auth set", func(b *testing.B) {
+		set := newAuthSet(testBaseDir, files)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if !set.allows(target) {
+				b.Fatal("not authorized")
+			}
+		}
+	})
+}
+
+// BenchmarkValidateRequest times validation end to end, including building
+// the authSet when it isn't cached
+func BenchmarkValidateRequest(b *testing.B) {
+	pg := newFakeProject(map[string]string{"main.go": ""})
+	pg.authorized = make([]string, 10000)
+	for i := range pg.authorized {
+		pg.authorized[i] = fmt.Sprintf("pkg%d/file%d.go", i%100, i)
+	}
+	req := CompletionRequest{ProjectID: "p", FilePath: pg.authorized[len(pg.authorized)-1]}
+
+	for _, ttl := range []time.Duration{0, 30 * time.Second} {
+		b.Run(fmt.Sprintf("auth_cache_ttl=%v", ttl), func(b *testing.B) {
+			config := testConfig()
+			config.AuthCacheTTL = ttl
+			service := newTestService(b, config, &EchoGrokkerClient{})
+			for i := 0; i < b.N; i++ {
+				if err := service.validateRequest(req, pg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthSetPatterns(t *testing.T) {
+	set := newAuthSet(testBaseDir, []string{"src/**", "docs/*.md", "web/app/[id].tsx", "exact.go"})
+	tests := []struct {
+		filePath string
+		want     bool
+	}{
+		{"src/main.go", true},
+		{"src/pkg/deep/util.go", true},
+		{testBaseDir + "/src/main.go", true},
+		{"lib/main.go", false},
+		{"srcfoo/main.go", false},
+		{"docs/readme.md", true},
+		{"docs/readme.txt", false},
+		{"docs/sub/readme.md", false},
+		{"web/app/[id].tsx", true},
+		{"web/app/i.tsx", false},
+		{"exact.go", true},
+		{"src/../lib/main.go", false},
+	}
+	for _, tt := range tests {
+		if got := set.allows(tt.filePath); got != tt.want {
+			t.Errorf("allows(%q) = %t, want %t", tt.filePath, got, tt.want)
+		}
+	}
+}
+
+func TestCompleteWildcardAuthorization(t *testing.T) {
+	pg := newFakeProject(map[string]string{"src/app/main.go": "package app\n", "lib/main.go": "package lib\n"})
+	pg.authorized = []string{"src/**"}
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+
+	tests := []struct {
+		filePath string
+		wantErr  error
+	}{
+		{"src/app/main.go", nil},
+		{"lib/main.go", ErrFileNotAuthorized},
+	}
+	for _, tt := range tests {
+		req := CompletionRequest{ProjectID: "p", FilePath: tt.filePath, CursorLine: 1}
+		if _, err := service.Complete(context.Background(), req, pg); !errors.Is(err, tt.wantErr) {
+			t.Errorf("Complete(%s) err = %v, want %v", tt.filePath, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package smartcomplete
+
+import (
+	"context"
+)
+
+// BatchResult is the outcome of one request in a batch
+type BatchResult struct {
+	Index    int // position of the request in the batch
+	Response *CompletionResponse
+	Err      error
+}
+
+// CompleteBatch runs requests one at a time, e.g. to prewarm the cache for
+// likely cursor positions. A failed request is recorded in its result and
+// the batch moves on. Once ctx is done no further requests are started:
+// the results of those that finished are returned with ctx's error, and a
+// request cut short by the cancellation is left out.
+func (s *CompletionService) CompleteBatch(
+	ctx context.Context,
+	requests []CompletionRequest,
+	projectGetter ProjectGetter,
+) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(requests))
+	for i, req := range requests {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		resp, err := s.Complete(ctx, req, projectGetter)
+		if err != nil && ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		results = append(results, BatchResult{Index: i, Response: resp, Err: err})
+	}
+	return results, nil
+}
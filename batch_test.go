@@ -0,0 +1,88 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// cancellingClient is an EchoGrokkerClient that cancels a context once it
+// has served cancelAfter queries
+type cancellingClient struct {
+	EchoGrokkerClient
+	cancelAfter int
+	cancel      context.CancelFunc
+}
+
+func (c *cancellingClient) Query(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int) (string, int, error) {
+	completion, tokens, err := c.EchoGrokkerClient.Query(ctx, llm, systemMsg, userMsg, maxTokens)
+	if c.Calls() == c.cancelAfter {
+		c.cancel()
+	}
+	return completion, tokens, err
+}
+
+func TestCompleteBatch(t *testing.T) {
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	var requests []CompletionRequest
+	for line := 0; line < 5; line++ {
+		requests = append(requests, CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: line})
+	}
+	requests[1].FilePath = ""
+
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	results, err := service.CompleteBatch(context.Background(), requests, pg)
+	if err != nil {
+		t.Fatalf("CompleteBatch: %v", err)
+	}
+	if len(results) != len(requests) {
+		t.Fatalf("got %d results, want %d", len(results), len(requests))
+	}
+	for i, result := range results {
+		if result.Index != i {
+			t.Errorf("result %d has Index %d", i, result.Index)
+		}
+		if wantErr := i == 1; (result.Err != nil) != wantErr {
+			t.Errorf("result %d: err = %v, want error %t", i, result.Err, wantErr)
+		}
+	}
+}
+
+func TestCompleteBatchCancelled(t *testing.T) {
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	var requests []CompletionRequest
+	for line := 0; line < 5; line++ {
+		requests = append(requests, CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: line})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &cancellingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}, cancelAfter: 2, cancel: cancel}
+	service := newTestService(t, testConfig(), client)
+
+	results, err := service.CompleteBatch(ctx, requests, pg)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("CompleteBatch err = %v, want context.Canceled", err)
+	}
+	if client.Calls() != 2 {
+		t.Errorf("client called %d times, want 2", client.Calls())
+	}
+	if got := fmt.Sprint(batchIndexes(results)); got != "[0 1]" {
+		t.Errorf("completed requests %s, want [0 1]", got)
+	}
+	for _, result := range results {
+		if result.Err != nil || result.Response.Completion != "x" {
+			t.Errorf("result %d = %+v, %v; want completion x", result.Index, result.Response, result.Err)
+		}
+	}
+}
+
+// batchIndexes returns the Index of each result
+func batchIndexes(results []BatchResult) []int {
+	indexes := make([]int, len(results))
+	for i, result := range results {
+		indexes[i] = result.Index
+	}
+	return indexes
+}
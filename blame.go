@@ -0,0 +1,71 @@
+package smartcomplete
+
+import "fmt"
+
+// BlameGetter is an optional extension to ProjectGetter. When implemented
+// and IncludeBlame is set, who wrote the code around the cursor is sent as
+// a hint.
+type BlameGetter interface {
+	// GetBlame returns the author of each line of filePath (relative to
+	// the project) from startLine to endLine, 0-based and inclusive. It may
+	// return fewer lines at the end of the file.
+	GetBlame(projectID, filePath string, startLine, endLine int) ([]string, error)
+}
+
+// BlameSectionName heads the prompt section of the blame hint, which is
+// trimmed like a ContextProvider's, as "provider:authorship"
+const BlameSectionName = "authorship"
+
+// blameRadius is how many lines either side of the cursor are blamed
+const blameRadius = 20
+
+// gatherBlame returns a hint naming the main author of the lines around
+// the cursor, if the project getter can blame them
+func (g *ContextGatherer) gatherBlame(req CompletionRequest, projectGetter ProjectGetter) (string, error) {
+	blameGetter, ok := projectGetter.(BlameGetter)
+	if !ok {
+		return "", nil
+	}
+	start := max(req.CursorLine-blameRadius, 0)
+	authors, err := blameGetter.GetBlame(req.ProjectID, req.FilePath, start, req.CursorLine+blameRadius)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", WrapContextError("failed to get blame", err)
+	}
+	return blameHint(authors, g.authorConventions), nil
+}
+
+// blameHint names the author of most of lines, with their conventions
+// from conventions if listed. Ties go to the author seen first.
+func blameHint(authors []string, conventions map[string]string) string {
+	counts := make(map[string]int)
+	var order []string
+	total := 0
+	for _, author := range authors {
+		if author == "" {
+			continue
+		}
+		total++
+		if counts[author] == 0 {
+			order = append(order, author)
+		}
+		counts[author]++
+	}
+	var top string
+	for _, author := range order {
+		if top == "" || counts[author] > counts[top] {
+			top = author
+		}
+	}
+	if top == "" {
+		return ""
+	}
+
+	hint := fmt.Sprintf("The surrounding code is mostly by %s (%d of %d lines); match their style.", top, counts[top], total)
+	if convention := conventions[top]; convention != "" {
+		hint += fmt.Sprintf(" %s's conventions: %s", top, convention)
+	}
+	return hint
+}
@@ -0,0 +1,56 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// blameProject is a fakeProject that is also a BlameGetter
+type blameProject struct {
+	*fakeProject
+	authors []string // by line
+}
+
+func (p *blameProject) GetBlame(projectID, filePath string, startLine, endLine int) ([]string, error) {
+	endLine = min(endLine, len(p.authors)-1)
+	return p.authors[startLine : endLine+1], nil
+}
+
+func TestBlameHint(t *testing.T) {
+	tests := []struct {
+		name    string
+		include bool
+		authors []string
+		want    string
+	}{
+		{"included", true, []string{"alice", "bob", "alice", "bob", "alice"}, "AUTHORSHIP:\nThe surrounding code is mostly by alice (3 of 5 lines); match their style. alice's conventions: early returns\n"},
+		{"tie goes to first seen", true, []string{"alice", "bob", "bob", "alice"}, "AUTHORSHIP:\nThe surrounding code is mostly by alice (2 of 4 lines); match their style."},
+		{"off", false, []string{"alice", "bob", "alice", "bob", "alice"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.IncludeBlame = tt.include
+			config.AuthorConventions = map[string]string{"alice": "early returns"}
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, config, client)
+
+			pg := &blameProject{
+				fakeProject: newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"}),
+				authors:     tt.authors,
+			}
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			prompt := client.lastPrompt()
+			if tt.want != "" && !strings.Contains(prompt, tt.want) {
+				t.Errorf("prompt does not contain %q:\n%s", tt.want, prompt)
+			}
+			if tt.want == "" && strings.Contains(prompt, "AUTHORSHIP:") {
+				t.Errorf("prompt contains the blame hint with include_blame off:\n%s", prompt)
+			}
+		})
+	}
+}
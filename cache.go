@@ -3,6 +3,7 @@ package smartcomplete
 import (
 	"crypto/sha256"
 	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -14,35 +15,148 @@ type Cache struct {
 	ttl      time.Duration
 	maxSize  int
 	enabled  bool
+	jitter   float64
+	hashes   map[string]statHashEntry
+	hashSeq  uint64
+	policy   string
+
+	// pinned holds the positionKeys of entries eviction skips
+	pinned map[string]bool
+
+	// namespace prefixes every key, so changing it (e.g. on a model
+	// upgrade) leaves existing entries unreachable
+	namespace string
+
+	// contentAddressed includes the file hash in the key itself, alongside
+	// the project and path
+	contentAddressed bool
+
+	// writes queues Puts for the background writer; nil when Put stores
+	// directly. writerMu guards the channel itself, not the entries.
+	writerMu   sync.RWMutex
+	writes     chan cacheWrite
+	writerDone chan struct{}
+}
+
+// cacheWrite is a Put queued for the background writer. A write with
+// flushed set is a marker, closed once everything queued before it is
+// stored.
+type cacheWrite struct {
+	req      CompletionRequest
+	fileHash string
+	resp     CompletionResponse
+	flushed  chan struct{}
 }
 
 // CacheEntry represents a cached completion
 type CacheEntry struct {
 	Response  *CompletionResponse
 	CreatedAt time.Time
+	ExpiresAt time.Time
 	FileHash  string
+
+	// Access tracking for LRU/LFU eviction
+	LastAccess time.Time
+	Hits       int
+
+	position string // positionKey, for pinning
 }
 
+// Cache eviction policies. FIFO is used when none is set.
+const (
+	EvictFIFO = "fifo"
+	EvictLRU  = "lru"
+	EvictLFU  = "lfu"
+)
+
+// fileStat is the size and modification time of a file
+type fileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+// statHashEntry remembers the content hash of a file at a given stat
+type statHashEntry struct {
+	stat     fileStat
+	hash     string
+	recorded uint64
+}
+
+// maxStatHashes bounds how many paths the cache remembers hashes for; the
+// least recently recorded path is forgotten first
+const maxStatHashes = 1000
+
 // NewCache creates a new cache
 func NewCache(ttl time.Duration, maxSize int, enabled bool) *Cache {
 	return &Cache{
 		entries: make(map[string]*CacheEntry),
+		hashes:  make(map[string]statHashEntry),
+		pinned:  make(map[string]bool),
 		ttl:     ttl,
 		maxSize: maxSize,
 		enabled: enabled,
+		policy:  EvictFIFO,
 	}
 }
 
-// Get retrieves a cached completion if valid
-func (c *Cache) Get(req CompletionRequest, fileContent string) (*CompletionResponse, bool) {
+// SetTTL sets the TTL for entries stored from now on
+func (c *Cache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// SetEnabled turns caching on or off. Existing entries are kept.
+func (c *Cache) SetEnabled(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = enabled
+}
+
+// SetEvictionPolicy selects which entry is evicted when the cache is full.
+// An empty or unknown policy evicts FIFO.
+func (c *Cache) SetEvictionPolicy(policy string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = policy
+}
+
+// SetTTLJitter sets the fraction (0-1) by which each entry's TTL is randomly
+// spread, so entries created in a burst don't all expire together
+func (c *Cache) SetTTLJitter(jitter float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jitter = jitter
+}
+
+// SetContentAddressed makes cache keys include the file content hash, so
+// identical inputs for the same file always map to the same entry
+func (c *Cache) SetContentAddressed(contentAddressed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.contentAddressed = contentAddressed
+}
+
+// SetNamespace sets the namespace folded into cache keys. Entries stored
+// under another namespace are no longer returned; they expire or are
+// evicted as usual.
+func (c *Cache) SetNamespace(namespace string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.namespace = namespace
+}
+
+// Get retrieves a cached completion if valid. fileHash is the hashContent of
+// the file's current content.
+func (c *Cache) Get(req CompletionRequest, fileHash string) (*CompletionResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if !c.enabled {
 		return nil, false
 	}
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	key := c.cacheKey(req)
+	key := c.cacheKey(req, fileHash)
 	entry, exists := c.entries[key]
 
 	if !exists {
@@ -50,61 +164,327 @@ func (c *Cache) Get(req CompletionRequest, fileContent string) (*CompletionRespo
 	}
 
 	// Check if expired
-	if time.Since(entry.CreatedAt) > c.ttl {
+	if time.Now().After(entry.ExpiresAt) {
 		return nil, false
 	}
 
 	// Check if file changed (invalidate cache)
-	currentHash := hashContent(fileContent)
-	if entry.FileHash != currentHash {
+	if entry.FileHash != fileHash {
 		return nil, false
 	}
 
+	entry.LastAccess = time.Now()
+	entry.Hits++
 	return entry.Response, true
 }
 
-// Put stores a completion in cache
-func (c *Cache) Put(req CompletionRequest, fileContent string, resp *CompletionResponse) {
-	if !c.enabled {
+// SetAsyncWrites makes Put queue up to buffer writes for a single
+// background goroutine, which stores them in batches, instead of taking the
+// write lock itself. Put stores directly while the queue is full. A buffer
+// of 0 flushes the queue and stops the goroutine.
+func (c *Cache) SetAsyncWrites(buffer int) {
+	c.writerMu.Lock()
+	defer c.writerMu.Unlock()
+	if c.writes != nil && cap(c.writes) == buffer {
 		return
 	}
+	c.stopWriter()
+	if buffer > 0 {
+		c.writes = make(chan cacheWrite, buffer)
+		c.writerDone = make(chan struct{})
+		go c.runWriter(c.writes, c.writerDone)
+	}
+}
 
+// Flush waits until every write queued so far is stored
+func (c *Cache) Flush() {
+	flushed := make(chan struct{})
+	c.writerMu.RLock()
+	if c.writes == nil {
+		c.writerMu.RUnlock()
+		return
+	}
+	c.writes <- cacheWrite{flushed: flushed}
+	c.writerMu.RUnlock()
+	<-flushed
+}
+
+// Close stores any queued writes and stops the background writer; later
+// Puts store directly
+func (c *Cache) Close() {
+	c.writerMu.Lock()
+	defer c.writerMu.Unlock()
+	c.stopWriter()
+}
+
+// stopWriter closes the write queue and waits for the writer to drain it.
+// Callers must hold writerMu.
+func (c *Cache) stopWriter() {
+	if c.writes == nil {
+		return
+	}
+	close(c.writes)
+	<-c.writerDone
+	c.writes, c.writerDone = nil, nil
+}
+
+// runWriter stores queued writes until writes is closed, taking the lock
+// once for everything queued at the time
+func (c *Cache) runWriter(writes <-chan cacheWrite, done chan<- struct{}) {
+	defer close(done)
+	for w := range writes {
+		batch := []cacheWrite{w}
+		for n := len(writes); n > 0; n-- {
+			batch = append(batch, <-writes)
+		}
+
+		c.mu.Lock()
+		for _, w := range batch {
+			if w.flushed == nil {
+				c.store(w.req, w.fileHash, w.resp)
+			}
+		}
+		c.mu.Unlock()
+
+		for _, w := range batch {
+			if w.flushed != nil {
+				close(w.flushed)
+			}
+		}
+	}
+}
+
+// enqueue hands w to the background writer, reporting false if there is
+// none or its queue is full
+func (c *Cache) enqueue(w cacheWrite) bool {
+	c.writerMu.RLock()
+	defer c.writerMu.RUnlock()
+	if c.writes == nil {
+		return false
+	}
+	select {
+	case c.writes <- w:
+		return true
+	default:
+		return false
+	}
+}
+
+// Put stores a copy of a completion in cache, so the caller's later
+// changes to resp don't reach cache hits. With async writes on, the copy
+// is queued and may not be visible to Get immediately.
+func (c *Cache) Put(req CompletionRequest, fileHash string, resp *CompletionResponse) {
+	if c.enqueue(cacheWrite{req: req, fileHash: fileHash, resp: *resp}) {
+		return
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.store(req, fileHash, *resp)
+}
 
-	// Simple eviction: if too many entries, remove oldest
+// store adds an entry. Callers must hold the write lock.
+func (c *Cache) store(req CompletionRequest, fileHash string, stored CompletionResponse) {
+	if !c.enabled {
+		return
+	}
+
+	// Simple eviction: if too many entries, remove one per the policy
 	if len(c.entries) > 1000 {
-		var oldestKey string
-		var oldestTime time.Time
-		for key, entry := range c.entries {
-			if oldestKey == "" || entry.CreatedAt.Before(oldestTime) {
-				oldestKey = key
-				oldestTime = entry.CreatedAt
+		c.evictOne()
+	}
+
+	now := time.Now()
+	key := c.cacheKey(req, fileHash)
+	c.entries[key] = &CacheEntry{
+		Response:   &stored,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(c.entryTTL()),
+		FileHash:   fileHash,
+		LastAccess: now,
+		position:   c.positionKey(req),
+	}
+}
+
+// Pin exempts completions at req's position from eviction, whatever the
+// file's content, including ones stored later. Pinned entries still
+// expire. req needs the effective LLM and MaxTokens, as for Put.
+func (c *Cache) Pin(req CompletionRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinned[c.positionKey(req)] = true
+}
+
+// Unpin makes completions at req's position evictable again
+func (c *Cache) Unpin(req CompletionRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pinned, c.positionKey(req))
+}
+
+// Clear drops all entries and remembered file hashes, queued writes
+// included. Pins are kept.
+func (c *Cache) Clear() {
+	c.Flush()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	clear(c.hashes)
+}
+
+// evictOne removes a single entry chosen by the eviction policy, skipping
+// unexpired pinned entries. If every entry is pinned, the policy's pick
+// among them goes, so pins can't grow the cache past its limit. Callers
+// must hold the write lock.
+func (c *Cache) evictOne() {
+	now := time.Now()
+	var victimKey, pinnedKey string
+	var victim, pinnedVictim *CacheEntry
+	for key, entry := range c.entries {
+		if c.pinned[entry.position] && now.Before(entry.ExpiresAt) {
+			if pinnedVictim == nil || c.evictsBefore(entry, pinnedVictim) {
+				pinnedKey = key
+				pinnedVictim = entry
 			}
+			continue
 		}
-		if oldestKey != "" {
-			delete(c.entries, oldestKey)
+		if victim == nil || c.evictsBefore(entry, victim) {
+			victimKey = key
+			victim = entry
 		}
 	}
+	switch {
+	case victim != nil:
+		delete(c.entries, victimKey)
+	case pinnedVictim != nil:
+		delete(c.entries, pinnedKey)
+	}
+}
 
-	key := c.cacheKey(req)
-	c.entries[key] = &CacheEntry{
-		Response:  resp,
-		CreatedAt: time.Now(),
-		FileHash:  hashContent(fileContent),
+// evictsBefore reports whether a should be evicted ahead of b
+func (c *Cache) evictsBefore(a, b *CacheEntry) bool {
+	switch c.policy {
+	case EvictLRU:
+		return a.LastAccess.Before(b.LastAccess)
+	case EvictLFU:
+		if a.Hits != b.Hits {
+			return a.Hits < b.Hits
+		}
+		return a.LastAccess.Before(b.LastAccess)
+	default:
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+}
+
+// entryTTL returns the TTL for a new entry, spread by up to ±jitter
+func (c *Cache) entryTTL() time.Duration {
+	if c.jitter <= 0 {
+		return c.ttl
+	}
+	factor := 1 + c.jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(c.ttl) * factor)
+}
+
+// statHash returns the previously recorded content hash for path if its size
+// and modification time are unchanged
+func (c *Cache) statHash(path string, stat fileStat) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, exists := c.hashes[path]
+	if !exists || entry.stat.size != stat.size || !entry.stat.modTime.Equal(stat.modTime) {
+		return "", false
+	}
+	return entry.hash, true
+}
+
+// recordStatHash remembers the content hash of path at the given stat,
+// forgetting the least recently recorded path once maxStatHashes are held
+func (c *Cache) recordStatHash(path string, stat fileStat, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.hashes[path]; !exists && len(c.hashes) >= maxStatHashes {
+		var oldestPath string
+		var oldest uint64
+		for p, entry := range c.hashes {
+			if oldestPath == "" || entry.recorded < oldest {
+				oldestPath = p
+				oldest = entry.recorded
+			}
+		}
+		delete(c.hashes, oldestPath)
+	}
+	c.hashSeq++
+	c.hashes[path] = statHashEntry{stat: stat, hash: hash, recorded: c.hashSeq}
+}
+
+// cacheKey identifies a completion. The service passes requests with LLM
+// and MaxTokens already resolved to their effective values.
+func (c *Cache) cacheKey(req CompletionRequest, fileHash string) string {
+	if !c.contentAddressed {
+		fileHash = ""
 	}
+	return c.key(req, fileHash)
+}
+
+// positionKey identifies the completions at a request's position and
+// options, whatever the file's content
+func (c *Cache) positionKey(req CompletionRequest) string {
+	return c.key(req, "")
 }
 
-func (c *Cache) cacheKey(req CompletionRequest) string {
-	return fmt.Sprintf("%s:%s:%d:%d:%s",
-		req.ProjectID,
-		req.FilePath,
+// key builds a cache key, including fileHash unless it is ""
+func (c *Cache) key(req CompletionRequest, fileHash string) string {
+	source := fmt.Sprintf("%q:", c.namespace) + req.ProjectID + ":" + req.FilePath
+	if fileHash != "" {
+		source += ":" + fileHash
+	}
+	return fmt.Sprintf("%s:%d:%d:%s:%d:%t:%t:%+v:%s:%t:%t:%d:%q:%q:%s:%s:%s",
+		source,
 		req.CursorLine,
 		req.CursorColumn,
 		req.LLM,
+		req.MaxTokens,
+		req.SkipAgentsInstructions,
+		req.SkipDiscussion,
+		req.ExcludeSections,
+		req.Mode,
+		req.SingleLine,
+		req.Explain,
+		req.Candidates,
+		req.Instruction,
+		req.ContinueFrom,
+		virtualFilesHash(req.VirtualFiles),
+		pathsHash(req.OpenFiles),
+		pathsHash(req.ContextFiles),
 	)
 }
 
+// pathsHash hashes a list of context file paths in order, since order
+// decides what budget trimming drops. It is "" for none.
+func pathsHash(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(hash, "%q\n", p)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// virtualFilesHash hashes the paths and content of virtual files, so an
+// edited unsaved buffer changes the cache key. It is "" for none.
+func virtualFilesHash(files []FileContext) string {
+	if len(files) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(hash, "%q:%q\n", f.Path, f.Content)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
 func hashContent(content string) string {
 	hash := sha256.Sum256([]byte(content))
 	return fmt.Sprintf("%x", hash)
@@ -0,0 +1,484 @@
+package smartcomplete
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheTTLJitter(t *testing.T) {
+	const ttl = time.Minute
+	tests := []struct {
+		name   string
+		jitter float64
+		spread bool
+	}{
+		{"no jitter", 0, false},
+		{"jitter", 0.2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewCache(ttl, 0, true)
+			cache.SetTTLJitter(tt.jitter)
+			for line := 0; line < 20; line++ {
+				req := CompletionRequest{ProjectID: "p", FilePath: "a.go", CursorLine: line}
+				cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+			}
+
+			ttls := make(map[time.Duration]bool)
+			for _, entry := range cache.entries {
+				entryTTL := entry.ExpiresAt.Sub(entry.CreatedAt)
+				low := time.Duration(float64(ttl) * (1 - tt.jitter))
+				high := time.Duration(float64(ttl) * (1 + tt.jitter))
+				if entryTTL < low || entryTTL > high {
+					t.Errorf("entry TTL %v outside [%v, %v]", entryTTL, low, high)
+				}
+				ttls[entryTTL] = true
+			}
+			if spread := len(ttls) > 1; spread != tt.spread {
+				t.Errorf("got %d distinct TTLs for 20 entries, want spread %t", len(ttls), tt.spread)
+			}
+		})
+	}
+}
+
+func BenchmarkFileHash(b *testing.B) {
+	content := strings.Repeat("func f() int { return 42 }\n", 40000) // ~1MB
+	stat := fileStat{size: int64(len(content)), modTime: time.Unix(1700000000, 0)}
+
+	b.Run("rehash", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = hashContent(content)
+		}
+	})
+	b.Run("unchanged stat", func(b *testing.B) {
+		cache := NewCache(time.Minute, 0, true)
+		cache.recordStatHash("/project/big.go", stat, hashContent(content))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := cache.statHash("/project/big.go", stat); !ok {
+				b.Fatal("stat hash missed")
+			}
+		}
+	})
+}
+
+func TestCacheEvictionPolicy(t *testing.T) {
+	base := time.Now()
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+	// a is the oldest, b the least recently used, c the least frequently used
+	entries := map[string]struct {
+		created, accessed time.Time
+		hits              int
+	}{
+		"a": {at(0), at(5), 1},
+		"b": {at(1), at(2), 5},
+		"c": {at(2), at(4), 0},
+	}
+
+	tests := []struct {
+		policy  string
+		evicted string
+	}{
+		{"", "a"},
+		{EvictFIFO, "a"},
+		{EvictLRU, "b"},
+		{EvictLFU, "c"},
+	}
+	for _, tt := range tests {
+		t.Run("policy "+tt.policy, func(t *testing.T) {
+			cache := NewCache(time.Hour, 0, true)
+			cache.SetEvictionPolicy(tt.policy)
+			reqs := make(map[string]CompletionRequest)
+			for name, e := range entries {
+				req := CompletionRequest{ProjectID: "p", FilePath: name + ".go"}
+				reqs[name] = req
+				cache.Put(req, "hash", &CompletionResponse{Completion: name})
+				entry := cache.entries[cache.cacheKey(req, "hash")]
+				entry.CreatedAt, entry.LastAccess, entry.Hits = e.created, e.accessed, e.hits
+			}
+
+			cache.mu.Lock()
+			cache.evictOne()
+			cache.mu.Unlock()
+
+			for name, req := range reqs {
+				_, present := cache.entries[cache.cacheKey(req, "hash")]
+				if present == (name == tt.evicted) {
+					t.Errorf("entry %s present = %t after eviction, want %s evicted", name, present, tt.evicted)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheGetTracksAccess(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+	req := CompletionRequest{ProjectID: "p", FilePath: "a.go"}
+	cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+	entry := cache.entries[cache.cacheKey(req, "hash")]
+	stored := entry.LastAccess
+
+	for i := 0; i < 3; i++ {
+		if _, ok := cache.Get(req, "hash"); !ok {
+			t.Fatal("Get missed a live entry")
+		}
+	}
+	if entry.Hits != 3 {
+		t.Errorf("Hits = %d, want 3", entry.Hits)
+	}
+	if entry.LastAccess.Before(stored) {
+		t.Errorf("LastAccess %v moved before the store time %v", entry.LastAccess, stored)
+	}
+}
+
+func TestCacheKeyIncludesVirtualFiles(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	client := &EchoGrokkerClient{Completion: "x"}
+	service := newTestService(t, config, client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n", "types.go": "type A struct{}\n"})
+
+	for _, content := range []string{"type B struct{}\n", "type C struct{}\n", "type C struct{}\n"} {
+		req := CompletionRequest{
+			ProjectID:    "p",
+			FilePath:     "main.go",
+			CursorLine:   1,
+			VirtualFiles: []FileContext{{Path: "types.go", Content: content}},
+		}
+		if _, err := service.Complete(context.Background(), req, pg); err != nil {
+			t.Fatalf("Complete: %v", err)
+		}
+	}
+	// Changed buffer content misses the cache; the same content hits it
+	if client.Calls() != 2 {
+		t.Errorf("client called %d times, want 2", client.Calls())
+	}
+}
+
+func TestCacheKeyIncludesContextFiles(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	client := &EchoGrokkerClient{Completion: "x"}
+	service := newTestService(t, config, client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n", "a.go": "package main\n", "b.go": "package main\n"})
+
+	requests := []CompletionRequest{
+		{ContextFiles: []string{"a.go"}},
+		{ContextFiles: []string{"b.go"}},
+		{ContextFiles: []string{"b.go"}},
+		{OpenFiles: []string{"b.go"}},
+		{OpenFiles: []string{"b.go"}},
+	}
+	for _, req := range requests {
+		req.ProjectID, req.FilePath, req.CursorLine = "p", "main.go", 1
+		if _, err := service.Complete(context.Background(), req, pg); err != nil {
+			t.Fatalf("Complete: %v", err)
+		}
+	}
+	// Different files miss the cache; the same files hit it
+	if client.Calls() != 3 {
+		t.Errorf("client called %d times, want 3", client.Calls())
+	}
+}
+
+func TestCacheNamespace(t *testing.T) {
+	cache := NewCache(time.Minute, 0, true)
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+
+	cache.SetNamespace("model-v1")
+	cache.Put(req, "hash", &CompletionResponse{Completion: "v1"})
+
+	cache.SetNamespace("model-v2")
+	if resp, ok := cache.Get(req, "hash"); ok {
+		t.Fatalf("Get in a new namespace = %q, want a miss", resp.Completion)
+	}
+	cache.Put(req, "hash", &CompletionResponse{Completion: "v2"})
+
+	for namespace, want := range map[string]string{"model-v1": "v1", "model-v2": "v2"} {
+		cache.SetNamespace(namespace)
+		if resp, ok := cache.Get(req, "hash"); !ok || resp.Completion != want {
+			t.Errorf("Get in %s = %v, %t; want %q", namespace, resp, ok, want)
+		}
+	}
+}
+
+func TestCacheKeyUsesEffectiveModel(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	client := &EchoGrokkerClient{Completion: "x"}
+	service := newTestService(t, config, client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+
+	requests := []CompletionRequest{
+		{ProjectID: "p", FilePath: "main.go", CursorLine: 1},
+		{ProjectID: "p", FilePath: "main.go", CursorLine: 1, LLM: config.DefaultLLM, MaxTokens: config.MaxTokens},
+		{ProjectID: "p", FilePath: "main.go", CursorLine: 1, LLM: config.DefaultLLM},
+	}
+	for i, req := range requests {
+		resp, err := service.Complete(context.Background(), req, pg)
+		if err != nil {
+			t.Fatalf("Complete %d: %v", i, err)
+		}
+		if i > 0 && !resp.CachedResult {
+			t.Errorf("request %d (%+v) missed the cache", i, req)
+		}
+	}
+
+	// A different effective max tokens is a different completion
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, MaxTokens: config.MaxTokens / 2}
+	if resp, err := service.Complete(context.Background(), req, pg); err != nil || resp.CachedResult {
+		t.Errorf("Complete with other max tokens = %+v, %v; want a fresh completion", resp, err)
+	}
+	if client.Calls() != 2 {
+		t.Errorf("client called %d times, want 2", client.Calls())
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	client := &EchoGrokkerClient{Completion: "x"}
+	service := newTestService(t, config, client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+
+	steps := []struct {
+		noCache    bool
+		wantCached bool
+		wantCalls  int
+	}{
+		{false, false, 1}, // fills the cache
+		{true, false, 2},  // bypasses the matching entry
+		{false, true, 2},  // the refreshed entry is still served
+	}
+	for i, step := range steps {
+		req.NoCache = step.noCache
+		resp, err := service.Complete(context.Background(), req, pg)
+		if err != nil {
+			t.Fatalf("step %d: Complete: %v", i, err)
+		}
+		if resp.CachedResult != step.wantCached {
+			t.Errorf("step %d: CachedResult = %t, want %t", i, resp.CachedResult, step.wantCached)
+		}
+		if client.Calls() != step.wantCalls {
+			t.Errorf("step %d: client called %d times, want %d", i, client.Calls(), step.wantCalls)
+		}
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+
+	var reqs []CompletionRequest
+	for i := 0; i < 10; i++ {
+		req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: i}
+		reqs = append(reqs, req)
+		cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+	}
+	cache.recordStatHash("/project/main.go", fileStat{size: 1}, "hash")
+
+	cache.Clear()
+
+	for _, req := range reqs {
+		if _, ok := cache.Get(req, "hash"); ok {
+			t.Errorf("line %d: Get hit after Clear", req.CursorLine)
+		}
+	}
+	if _, ok := cache.statHash("/project/main.go", fileStat{size: 1}); ok {
+		t.Error("statHash hit after Clear")
+	}
+
+	cache.Put(reqs[0], "hash", &CompletionResponse{Completion: "y"})
+	if resp, ok := cache.Get(reqs[0], "hash"); !ok || resp.Completion != "y" {
+		t.Errorf("Get after Clear and Put = %v, %t, want y", resp, ok)
+	}
+}
+
+func TestCacheStatHashesBounded(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+	stat := fileStat{size: 1}
+	for i := 0; i < maxStatHashes+10; i++ {
+		cache.recordStatHash(fmt.Sprintf("/project/f%d.go", i), stat, "hash")
+	}
+
+	if n := len(cache.hashes); n != maxStatHashes {
+		t.Errorf("remembered %d hashes, want %d", n, maxStatHashes)
+	}
+	if _, ok := cache.statHash("/project/f0.go", stat); ok {
+		t.Error("oldest path still remembered")
+	}
+	last := fmt.Sprintf("/project/f%d.go", maxStatHashes+9)
+	if _, ok := cache.statHash(last, stat); !ok {
+		t.Error("newest path forgotten")
+	}
+}
+
+func TestCacheClearConcurrent(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: w*1000 + i}
+				cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+				cache.Get(req, "hash")
+			}
+		}(w)
+	}
+	for i := 0; i < 20; i++ {
+		cache.Clear()
+	}
+	wg.Wait()
+}
+
+func TestServiceClearCache(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	client := &EchoGrokkerClient{Completion: "x"}
+	service := newTestService(t, config, client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+
+	steps := []struct {
+		clear      bool
+		wantCached bool
+	}{
+		{false, false},
+		{false, true},
+		{true, false},
+		{false, true},
+	}
+	for i, step := range steps {
+		if step.clear {
+			service.ClearCache()
+		}
+		resp, err := service.Complete(context.Background(), req, pg)
+		if err != nil {
+			t.Fatalf("step %d: Complete: %v", i, err)
+		}
+		if resp.CachedResult != step.wantCached {
+			t.Errorf("step %d: CachedResult = %t, want %t", i, resp.CachedResult, step.wantCached)
+		}
+	}
+}
+
+func TestCacheAsyncWrites(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+	cache.SetAsyncWrites(8)
+
+	const workers, perWorker = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: w*1000 + i}
+				cache.Put(req, "hash", &CompletionResponse{Completion: fmt.Sprint(w, i)})
+				cache.Get(req, "hash")
+			}
+		}(w)
+	}
+	wg.Wait()
+	cache.Close()
+
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWorker; i++ {
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: w*1000 + i}
+			resp, ok := cache.Get(req, "hash")
+			if !ok {
+				t.Fatalf("entry %d/%d missing after Close", w, i)
+			}
+			if want := fmt.Sprint(w, i); resp.Completion != want {
+				t.Fatalf("entry %d/%d = %q, want %q", w, i, resp.Completion, want)
+			}
+		}
+	}
+
+	// Writes after Close are stored directly
+	req := CompletionRequest{ProjectID: "p", FilePath: "late.go"}
+	cache.Put(req, "hash", &CompletionResponse{Completion: "late"})
+	if _, ok := cache.Get(req, "hash"); !ok {
+		t.Error("Put after Close was not stored")
+	}
+}
+
+func TestCacheAsyncClear(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+	cache.SetAsyncWrites(64)
+	defer cache.Close()
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go"}
+	cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+	cache.Clear()
+	cache.Flush()
+	if _, ok := cache.Get(req, "hash"); ok {
+		t.Error("write queued before Clear survived it")
+	}
+}
+
+func TestCachePin(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+	pinned := CompletionRequest{ProjectID: "p", FilePath: "hot.go"}
+	cache.Pin(pinned)
+	cache.Put(pinned, "hash", &CompletionResponse{Completion: "hot"})
+	unpinned := CompletionRequest{ProjectID: "p", FilePath: "cold.go"}
+	cache.Put(unpinned, "hash", &CompletionResponse{Completion: "cold"})
+
+	for line := 0; line < 1100; line++ {
+		req := CompletionRequest{ProjectID: "p", FilePath: "fill.go", CursorLine: line}
+		cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+	}
+
+	if resp, ok := cache.Get(pinned, "hash"); !ok || resp.Completion != "hot" {
+		t.Errorf("pinned entry was evicted")
+	}
+	if _, ok := cache.Get(unpinned, "hash"); ok {
+		t.Errorf("oldest unpinned entry survived eviction")
+	}
+
+	cache.Unpin(pinned)
+	for line := 1100; line < 1200; line++ {
+		req := CompletionRequest{ProjectID: "p", FilePath: "fill.go", CursorLine: line}
+		cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+	}
+	if _, ok := cache.Get(pinned, "hash"); ok {
+		t.Errorf("unpinned entry survived eviction")
+	}
+}
+
+func TestCacheAllPinnedStaysBounded(t *testing.T) {
+	cache := NewCache(time.Hour, 0, true)
+	first := CompletionRequest{ProjectID: "p", FilePath: "hot.go"}
+	for line := 0; line < 1100; line++ {
+		req := CompletionRequest{ProjectID: "p", FilePath: "hot.go", CursorLine: line}
+		cache.Pin(req)
+		cache.Put(req, "hash", &CompletionResponse{Completion: "x"})
+	}
+
+	if n := len(cache.entries); n > 1001 {
+		t.Errorf("cache holds %d entries with every one pinned, want at most 1001", n)
+	}
+	if _, ok := cache.Get(first, "hash"); ok {
+		t.Errorf("oldest pinned entry survived eviction")
+	}
+}
+
+func TestCachePinnedEntryExpires(t *testing.T) {
+	cache := NewCache(time.Millisecond, 0, true)
+	req := CompletionRequest{ProjectID: "p", FilePath: "hot.go"}
+	cache.Pin(req)
+	cache.Put(req, "hash", &CompletionResponse{Completion: "hot"})
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := cache.Get(req, "hash"); ok {
+		t.Errorf("pinned entry served after its TTL")
+	}
+}
@@ -0,0 +1,83 @@
+package smartcomplete
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxCandidates caps CompletionRequest.Candidates
+const maxCandidates = 5
+
+// Alternative is a further completion returned for a request that asked
+// for Candidates
+type Alternative struct {
+	Completion string  `json:"completion"`
+	Score      float64 `json:"score"`
+}
+
+// candidate is one post-processed completion and its score
+type candidate struct {
+	text        string
+	explanation string
+	raw         string // the provider's text before any processing
+	truncated   bool
+	score       float64
+}
+
+// newCandidate post-processes a query result into a candidate, scoring it
+// heuristically when the provider didn't
+func newCandidate(result queryResult, req CompletionRequest, config *Config, maxTokens int, ctx *CompletionContext) candidate {
+	c := candidate{text: result.text, raw: result.text}
+	if req.Explain {
+		c.text, c.explanation = splitExplanation(c.text)
+	}
+
+	// Some providers ignore maxTokens; cut to roughly that much text
+	if config.TruncateToMaxTokens && utf8.RuneCountInString(c.text) > maxTokens*4 {
+		c.text = truncateHead(c.text, maxTokens*4)
+		c.truncated = true
+	}
+
+	c.text = postProcessCompletion(c.text, ctx)
+	c.score = result.score
+	if !result.scored {
+		c.score = heuristicScore(c.text, ctx)
+	}
+	return c
+}
+
+// rankCandidates orders candidates best score first, keeping query order
+// among equal scores
+func rankCandidates(candidates []candidate) []candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	return candidates
+}
+
+// dedupCandidates drops candidates equivalent to an earlier one once
+// whitespace is normalized, keeping the first of each
+func dedupCandidates(candidates []candidate) []candidate {
+	seen := make(map[string]bool, len(candidates))
+	var unique []candidate
+	for _, c := range candidates {
+		key := normalizeCandidate(c.text)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, c)
+	}
+	return unique
+}
+
+// normalizeCandidate collapses each line's whitespace, indentation
+// included, and drops trailing blank lines
+func normalizeCandidate(candidate string) string {
+	lines := strings.Split(candidate, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
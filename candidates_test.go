@@ -0,0 +1,77 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDedupCandidates(t *testing.T) {
+	candidates := []string{
+		"if x {\n\treturn y\n}",
+		"if x {\n    return y\n}\n",
+		"if x {\n\treturn y\n}\n\n",
+		"if  x {\n\treturn y\n}",
+		"if x {\n\treturn z\n}",
+	}
+	var in []candidate
+	for _, text := range candidates {
+		in = append(in, candidate{text: text})
+	}
+	want := []candidate{{text: candidates[0]}, {text: candidates[4]}}
+	if got := dedupCandidates(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupCandidates = %+v, want %+v", got, want)
+	}
+}
+
+func TestCandidatesAlternatives(t *testing.T) {
+	client := &scoringClient{
+		completions: []string{"return a + b", "    return a + b\n", "return a + b\n\n", "return b + a"},
+		scores:      []float64{0, 0, 0, 0},
+	}
+	service := newTestService(t, testConfig(), client)
+	pg := newFakeProject(map[string]string{"add.go": "package main\n\nfunc Add(a, b int) int {\n\t\n}\n"})
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "add.go", CursorLine: 3, CursorColumn: 1, Candidates: 4}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Completion != "return a + b" || !reflect.DeepEqual(resp.Alternatives, []Alternative{{"return b + a", 0}}) {
+		t.Errorf("Completion = %q, Alternatives = %+v; want one alternative, return b + a", resp.Completion, resp.Alternatives)
+	}
+	if client.calls != 4 {
+		t.Errorf("client queried %d times, want 4", client.calls)
+	}
+}
+
+func TestCandidatesLimit(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", Candidates: maxCandidates + 1}
+	if _, err := service.Complete(context.Background(), req, pg); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("err = %v, want ErrInvalidRequest", err)
+	}
+}
+
+func TestCandidatesAlternativesScored(t *testing.T) {
+	client := &scoringClient{
+		completions: []string{"a()", "  a()\n", "b()", "c()"},
+		scores:      []float64{-3, -0.5, -1, -2},
+	}
+	service := newTestService(t, testConfig(), client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"})
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1, Candidates: 4}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	// The duplicate's better score doesn't carry over to the first a()
+	want := []Alternative{{"c()", -2}, {"a()", -3}}
+	if resp.Completion != "b()" || resp.Score != -1 || !reflect.DeepEqual(resp.Alternatives, want) {
+		t.Errorf("Completion = %q (score %v), Alternatives = %+v; want b() (-1) then %+v", resp.Completion, resp.Score, resp.Alternatives, want)
+	}
+}
@@ -2,10 +2,15 @@ package smartcomplete
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // CompletionRequest contains all information needed for a completion
@@ -17,20 +22,128 @@ type CompletionRequest struct {
 	LLM          string   `json:"llm,omitempty"`
 	MaxTokens    int      `json:"maxTokens,omitempty"`
 	ContextFiles []string `json:"contextFiles,omitempty"`
+	OpenFiles    []string `json:"openFiles,omitempty"` // other files open in the editor
 	Temperature  float64  `json:"temperature,omitempty"`
+	Mode         string   `json:"mode,omitempty"` // line, block or function
+	Instruction  string   `json:"instruction,omitempty"`
+
+	// SingleLine asks for only the rest of the current line, for inline
+	// ghost text; it implies line mode
+	SingleLine bool `json:"singleLine,omitempty"`
+
+	// FileContent, when set, is the target file's current (possibly unsaved)
+	// content and is used instead of reading the file
+	FileContent *string `json:"fileContent,omitempty"`
+
+	// VirtualFiles supply file content inline (e.g. unsaved buffers),
+	// shadowing the on-disk version of the same path
+	VirtualFiles []FileContext `json:"virtualFiles,omitempty"`
+
+	// ContinueFrom is completion text the user already accepted at the
+	// cursor (e.g. a completion cut at maxTokens); it is appended to the
+	// prefix so the model continues from it
+	ContinueFrom string `json:"continueFrom,omitempty"`
+
+	// PrefixTokens and SuffixTokens are the known token counts of the text
+	// before and after the cursor, used for budgeting instead of estimates
+	// when set (e.g. by a host that already tokenizes the file)
+	PrefixTokens int `json:"prefixTokens,omitempty"`
+	SuffixTokens int `json:"suffixTokens,omitempty"`
+
+	// Candidates asks for up to this many distinct completions (at most
+	// 5); the best scoring is the Completion and the rest are returned as
+	// Alternatives. Each costs a query; at temperature 0 they are likely
+	// all the same.
+	Candidates int `json:"candidates,omitempty"`
+
+	// Explain asks the model for a short rationale, returned as
+	// CompletionResponse.Explanation. It costs extra output tokens.
+	Explain bool `json:"explain,omitempty"`
+
+	// NoCache forces a fresh completion; the result is still cached
+	NoCache bool `json:"noCache,omitempty"`
+
+	// IdempotencyKey lets a retried request replay the original response
+	// without calling the LLM or counting against the rate limit
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Per-request overrides of the IncludeAgentsFile/IncludeDiscussion config
+	SkipAgentsInstructions bool `json:"skipAgentsInstructions,omitempty"`
+	SkipDiscussion         bool `json:"skipDiscussion,omitempty"`
+
+	// ExcludeSections leaves other context sections out of this request
+	ExcludeSections ExcludeSections `json:"excludeSections"`
+}
+
+// ExcludeSections selects context sections to leave out of one request's
+// prompt, e.g. the suffix when completing at the end of a file
+type ExcludeSections struct {
+	AdditionalFiles bool `json:"additionalFiles,omitempty"` // context, always-include, virtual and provider files
+	OpenFiles       bool `json:"openFiles,omitempty"`
+	RecentChanges   bool `json:"recentChanges,omitempty"`
+	Providers       bool `json:"providers,omitempty"` // ContextProvider sections and files, tags and blame
+	Suffix          bool `json:"suffix,omitempty"`
 }
 
 // CompletionResponse contains the generated completion
 type CompletionResponse struct {
-	Completion   string    `json:"completion"`
-	LatencyMs    int64     `json:"latencyMs"`
-	Model        string    `json:"model"`
-	TokensUsed   int       `json:"tokensUsed"`
-	CachedResult bool      `json:"cachedResult"`
-	Timestamp    time.Time `json:"timestamp"`
+	Completion    string      `json:"completion"`
+	LatencyMs     int64       `json:"latencyMs"`
+	Model         string      `json:"model"`
+	TokensUsed    int         `json:"tokensUsed"`
+	CachedResult  bool        `json:"cachedResult"`
+	Timestamp     time.Time   `json:"timestamp"`
+	TrimReport    *TrimReport `json:"trimReport,omitempty"`
+	LineEnding    string      `json:"lineEnding,omitempty"` // target file's original line ending
+	EstimatedCost float64     `json:"estimatedCost,omitempty"`
+	Truncated     bool        `json:"truncated,omitempty"` // cut to MaxTokens
+	Client        string      `json:"client,omitempty"`    // which LLM client served it
+
+	// IncludedFiles are the context files that survived trimming and were
+	// sent in the prompt, in full or as repo map outlines
+	IncludedFiles []string `json:"includedFiles,omitempty"`
+
+	// Insertion is where Completion goes: the cursor, clamped to the file
+	// and moved past ContinueFrom, which the completion follows
+	Insertion Position `json:"insertion"`
+
+	// Warnings list context files that were asked for but left out
+	Warnings []ContextWarning `json:"warnings,omitempty"`
+
+	// RawCompletion is the provider's output before post-processing, set
+	// only when IncludeRawCompletion is enabled
+	RawCompletion string `json:"rawCompletion,omitempty"`
+
+	// Alternatives are further completions with their scores when the
+	// request asked for Candidates, best score first, without any that
+	// differ from an earlier one only in whitespace
+	Alternatives []Alternative `json:"alternatives,omitempty"`
+
+	// Explanation is the model's rationale for the completion, when the
+	// request set Explain and the model gave one
+	Explanation string `json:"explanation,omitempty"`
+
+	// TokenUsage compares the estimated prompt tokens with the provider's,
+	// set only when IncludeTokenUsage is enabled
+	TokenUsage *TokenUsageReport `json:"tokenUsage,omitempty"`
+
+	// SyntaxValid reports whether the file still parses with the completion
+	// inserted; nil when CheckSyntax is off or the language isn't supported
+	SyntaxValid *bool `json:"syntaxValid,omitempty"`
+
+	// Skipped is set when the cursor is in a comment or string and
+	// SkipCommentsStrings is on, or the CompletionPolicy declined to
+	// complete; Completion is then empty
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Score rates the completion, higher is better: the provider's score
+	// (see ScoringClient) or a heuristic in (0, 1] when it has none.
+	// Candidates are ranked by it.
+	Score float64 `json:"score,omitempty"`
 }
 
-// ProjectGetter provides access to project data
+// ProjectGetter provides access to project data. ReadFile may be called
+// concurrently.
 type ProjectGetter interface {
 	GetProjectBaseDir(projectID string) (string, error)
 	GetProjectAuthorizedFiles(projectID string) ([]string, error)
@@ -38,17 +151,69 @@ type ProjectGetter interface {
 	ReadFile(absolutePath string) ([]byte, error)
 }
 
+// FileStater is an optional extension to ProjectGetter. When implemented, the
+// cache uses file size and modification time to skip reading unchanged files.
+type FileStater interface {
+	Stat(absolutePath string) (size int64, modTime time.Time, err error)
+}
+
+// RecentChangesGetter is an optional extension to ProjectGetter. When
+// implemented, recent changes (e.g. a git diff) are sent as context.
+type RecentChangesGetter interface {
+	GetRecentChanges(projectID string) (string, error)
+}
+
+// ProjectConfigGetter is an optional extension to ProjectGetter. When
+// implemented, a project's overrides are applied over the service config
+// for its requests. Overrides use the config file's YAML format; omitted
+// keys inherit the service's values. Cache settings, the idempotency window
+// and the auth cache TTL can't be overridden per project.
+type ProjectConfigGetter interface {
+	GetProjectConfigOverrides(projectID string) ([]byte, error)
+}
+
 // GrokkerClient interface for LLM calls
 type GrokkerClient interface {
 	Query(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int) (string, int, error)
 }
 
+// TemperatureClient is an optional extension to GrokkerClient. When
+// implemented, the request (or config) temperature is passed to the LLM.
+type TemperatureClient interface {
+	QueryWithTemperature(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64) (string, int, error)
+}
+
+// StopSequenceClient is an optional extension to GrokkerClient. When
+// implemented, requests with stop sequences ("\n" for SingleLine, or the
+// next line of code after the cursor with StopAtSuffix) are sent through it
+// so the provider stops generating at them.
+type StopSequenceClient interface {
+	QueryWithStop(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64, stop []string) (string, int, error)
+}
+
 // CompletionService is the main service
 type CompletionService struct {
 	config      *Config
+	configMu    sync.RWMutex
 	cache       *Cache
 	rateLimiter *RateLimiter
 	grokker     GrokkerClient
+	formatters  *FormatterRegistry
+	idempotency *idempotencyStore
+	fallbacks   []FallbackClient
+	auth        *authCache
+	metrics     *Metrics
+	observer    Observer
+	providers   []namedProvider
+	policy      CompletionPolicy
+}
+
+// FallbackClient is an LLM client tried, in order, when earlier clients fail
+// with a transient error (see RetryableError)
+type FallbackClient struct {
+	Name   string
+	Client GrokkerClient
+	LLM    string // model to use with this client; the request's model if empty
 }
 
 // NewCompletionService creates a new service
@@ -59,18 +224,176 @@ func NewCompletionService(config *Config) (*CompletionService, error) {
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
+	cache := NewCache(config.CacheTTL, config.MaxCacheSize, config.EnableCache)
+	configureCache(cache, config)
+	rateLimiter := NewRateLimiter()
+	rateLimiter.SetRetryJitter(config.RateLimitJitter)
+	formatters := NewFormatterRegistry()
+	formatters.setConfigFallback(fallbackFormatter(config))
 	return &CompletionService{
 		config:      config,
-		cache:       NewCache(config.CacheTTL, config.MaxCacheSize, config.EnableCache),
-		rateLimiter: NewRateLimiter(),
+		cache:       cache,
+		rateLimiter: rateLimiter,
+		formatters:  formatters,
+		idempotency: newIdempotencyStore(config.IdempotencyWindow),
+		auth:        newAuthCache(config.AuthCacheTTL),
 	}, nil
 }
 
+// configureCache applies the cache settings from config
+func configureCache(cache *Cache, config *Config) {
+	cache.SetTTL(config.CacheTTL)
+	cache.SetEnabled(config.EnableCache)
+	cache.SetEvictionPolicy(config.CacheEvictionPolicy)
+	cache.SetContentAddressed(config.Deterministic)
+	cache.SetNamespace(config.CacheNamespace)
+	cache.SetAsyncWrites(config.CacheWriteBuffer)
+	if config.Deterministic {
+		cache.SetTTLJitter(0)
+	} else {
+		cache.SetTTLJitter(config.CacheTTLJitter)
+	}
+}
+
+// fallbackFormatter returns the formatter used for models without a
+// registered formatter
+func fallbackFormatter(config *Config) PromptFormatter {
+	if config.PromptFormat == PromptFormatCursorMarker {
+		return &CursorMarkerFormatter{
+			FileHeaders:          config.FileHeaderStyle,
+			LanguageInstructions: config.LanguageInstructions,
+		}
+	}
+	return &FIMFormatter{
+		SuffixFirst:          config.SuffixFirst,
+		FileHeaders:          config.FileHeaderStyle,
+		LanguageInstructions: config.LanguageInstructions,
+	}
+}
+
+// ReloadConfig re-reads and validates the config at path and swaps it in.
+// Cached completions and rate-limit counters are kept; new limits, cache
+// settings and defaults apply to requests that start afterwards, and the
+// fallback formatter is rebuilt from the new config. The idempotency window
+// and auth cache TTL keep their original values. Unlike LoadConfig, a
+// missing file is an error, and the current config stays in effect.
+func (s *CompletionService) ReloadConfig(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	configureCache(s.cache, config)
+	s.rateLimiter.SetRetryJitter(config.RateLimitJitter)
+	s.formatters.setConfigFallback(fallbackFormatter(config))
+	s.config = config
+	return nil
+}
+
+// currentConfig returns the active config. Callers should take it once per
+// request so a concurrent reload can't mix old and new settings.
+func (s *CompletionService) currentConfig() *Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config
+}
+
 // SetGrokkerClient sets the LLM client
 func (s *CompletionService) SetGrokkerClient(client GrokkerClient) {
 	s.grokker = client
 }
 
+// SetFallbackClients sets the clients tried after the primary client fails
+// with a transient error
+func (s *CompletionService) SetFallbackClients(clients ...FallbackClient) {
+	s.fallbacks = clients
+}
+
+// SetMetrics sets the collector that records every Complete call; nil
+// stops recording
+func (s *CompletionService) SetMetrics(metrics *Metrics) {
+	s.metrics = metrics
+}
+
+// SetObserver sets the observer notified of non-fatal events, such as
+// optional context sections dropped after an error
+func (s *CompletionService) SetObserver(observer Observer) {
+	s.observer = observer
+}
+
+// SetCompletionPolicy sets the policy consulted before each LLM query;
+// nil completes everywhere
+func (s *CompletionService) SetCompletionPolicy(policy CompletionPolicy) {
+	s.policy = policy
+}
+
+// PinCompletion exempts cached completions at req's position from cache
+// eviction; see Cache.Pin. req is resolved against the service config, not
+// project overrides.
+func (s *CompletionService) PinCompletion(req CompletionRequest) {
+	s.cache.Pin(resolveRequest(req, s.currentConfig()))
+}
+
+// UnpinCompletion undoes PinCompletion
+func (s *CompletionService) UnpinCompletion(req CompletionRequest) {
+	s.cache.Unpin(resolveRequest(req, s.currentConfig()))
+}
+
+// ClearCache drops all cached completions, e.g. after a model change that
+// invalidates them
+func (s *CompletionService) ClearCache() {
+	s.cache.Clear()
+}
+
+// Close stores any cache writes still queued and stops the cache's
+// background writer. The service remains usable; cache writes are then
+// stored directly until a config reload sets cache_write_buffer again.
+func (s *CompletionService) Close() {
+	s.cache.Close()
+}
+
+// InvalidateAuthorization forgets a project's cached authorized files, for
+// use when they change within AuthCacheTTL
+func (s *CompletionService) InvalidateAuthorization(projectID string) {
+	s.auth.invalidate(projectID)
+}
+
+// Ping checks that the LLM client and default model are reachable by
+// issuing a minimal query. It doesn't count against rate limits.
+func (s *CompletionService) Ping(ctx context.Context) error {
+	if s.grokker == nil {
+		return fmt.Errorf("grokker client not set")
+	}
+
+	config := s.currentConfig()
+	if config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.RequestTimeout)
+		defer cancel()
+	}
+
+	if _, _, err := s.grokker.Query(ctx, config.DefaultLLM, "Reply with OK.", "ping", 1); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return WrapTimeoutError("health check timed out", ErrLLMTimeout)
+		}
+		return WrapLLMError("health check failed", err)
+	}
+	return nil
+}
+
+// Formatters returns the registry used to pick a prompt formatter per model
+func (s *CompletionService) Formatters() *FormatterRegistry {
+	return s.formatters
+}
+
 // Complete generates a code completion
 func (s *CompletionService) Complete(
 	ctx context.Context,
@@ -78,45 +401,120 @@ func (s *CompletionService) Complete(
 	projectGetter ProjectGetter,
 ) (*CompletionResponse, error) {
 	startTime := time.Now()
+	response, err := s.complete(ctx, req, projectGetter, startTime)
+	if s.metrics != nil {
+		s.metrics.observe(response, err, time.Since(startTime))
+	}
+	return response, err
+}
+
+// complete implements Complete; startTime is when the request arrived
+func (s *CompletionService) complete(
+	ctx context.Context,
+	req CompletionRequest,
+	projectGetter ProjectGetter,
+	startTime time.Time,
+) (*CompletionResponse, error) {
 
 	if err := s.validateRequest(req, projectGetter); err != nil {
 		return nil, err
 	}
+	config, err := projectConfig(s.currentConfig(), req.ProjectID, projectGetter)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := requestDeadline(ctx, config)
+	defer cancel()
+
+	// Resolve defaults up front, so requests that leave them out share cache
+	// entries with ones that name them
+	req = resolveRequest(req, config)
+	llm, maxTokens := req.LLM, req.MaxTokens
 
-	if err := s.rateLimiter.CheckLimit(req.ProjectID, s.config.MaxRequestsPerMinute, s.config.MaxRequestsPerHour); err != nil {
+	var idempotencyKey string
+	if req.IdempotencyKey != "" {
+		idempotencyKey = req.ProjectID + ":" + req.IdempotencyKey
+		if stored, ok := s.idempotency.get(idempotencyKey); ok {
+			return stored, nil
+		}
+	}
+
+	if err := s.checkRateLimit(req.ProjectID, config); err != nil {
 		return nil, err
 	}
 
 	baseDir, _ := projectGetter.GetProjectBaseDir(req.ProjectID)
-	targetPath := resolveFilePath(baseDir, req.FilePath)
-	fileContent, err := projectGetter.ReadFile(targetPath)
+	target := resolveTarget(req, baseDir)
+
+	// If the file is unchanged since we last hashed it, check the cache
+	// before reading it at all
+	var stat fileStat
+	var hasStat bool
+	if !target.virtual {
+		stat, hasStat = statFile(projectGetter, target.path)
+	}
+	var fileHash string
+	if config.EnableCache && hasStat {
+		if hash, ok := s.cache.statHash(target.path, stat); ok {
+			fileHash = hash
+			if cached, ok := s.cachedResponse(req, fileHash); ok {
+				return cached, nil
+			}
+		}
+	}
+
+	fileContent, err := loadTarget(req, config, projectGetter, target)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return nil, err
 	}
 
-	if s.config.EnableCache {
-		if cached, ok := s.cache.Get(req, string(fileContent)); ok {
-			cached.CachedResult = true
+	// Hash once and reuse for both cache lookup and store
+	if config.EnableCache && fileHash == "" {
+		fileHash = hashContent(string(fileContent))
+		if hasStat {
+			s.cache.recordStatHash(target.path, stat, fileHash)
+		}
+		if cached, ok := s.cachedResponse(req, fileHash); ok {
 			return cached, nil
 		}
 	}
 
-	gatherer := &ContextGatherer{maxTokens: s.config.MaxContextTokens}
-	completionCtx, err := gatherer.GatherContext(req, string(fileContent), projectGetter)
+	budget, err := contextBudget(config, llm, maxTokens)
+	if err != nil {
+		return nil, err
+	}
+	gatherer := s.requestGatherer(config, budget)
+	gatherCtx, cancelGather := gatherContextDeadline(ctx, config)
+	defer cancelGather()
+	completionCtx, err := gatherer.GatherContext(gatherCtx, req, string(fileContent), projectGetter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to gather context: %w", err)
 	}
 
-	formatter := &FIMFormatter{}
-	prompt := formatter.FormatPrompt(completionCtx)
-
-	llm := req.LLM
-	if llm == "" {
-		llm = s.config.DefaultLLM
+	declined := s.policy != nil && !s.policy.ShouldComplete(completionCtx)
+	if declined || config.SkipCommentsStrings && completionCtx.Intent.inText() {
+		response := &CompletionResponse{
+			LatencyMs:  time.Since(startTime).Milliseconds(),
+			Timestamp:  time.Now(),
+			LineEnding: completionCtx.LineEnding,
+			Skipped:    true,
+		}
+		if config.Deterministic {
+			response.LatencyMs = 0
+			response.Timestamp = time.Time{}
+		}
+		return response, nil
 	}
-	maxTokens := req.MaxTokens
-	if maxTokens == 0 {
-		maxTokens = s.config.MaxTokens
+
+	formatter := s.formatters.lookupFor(llm, fallbackFormatter(config))
+	prompt := formatter.FormatPrompt(completionCtx)
+	if config.MaxPromptTokens > 0 {
+		if promptTokens := estimateTokens(prompt); promptTokens > config.MaxPromptTokens {
+			return nil, WrapContextError(
+				fmt.Sprintf("prompt is ~%d tokens, over max_prompt_tokens %d", promptTokens, config.MaxPromptTokens),
+				ErrContextTooLarge,
+			)
+		}
 	}
 
 	if s.grokker == nil {
@@ -124,45 +522,483 @@ func (s *CompletionService) Complete(
 	}
 
 	systemMsg := "You are an expert code completion assistant. Complete the code at the cursor position. Output ONLY the completion text."
-	completion, tokensUsed, err := s.grokker.Query(ctx, llm, systemMsg, prompt, maxTokens)
+	var stop []string
+	switch {
+	case req.Explain:
+		// The explanation follows the completion; stopping would cut it
+		systemMsg += explainInstruction
+	case req.SingleLine:
+		stop = []string{"\n"}
+	case config.StopAtSuffix:
+		if line := suffixStop(completionCtx.Suffix); line != "" {
+			// Stop before running into code that already follows the cursor
+			stop = []string{line}
+		}
+	}
+	result, err := s.query(ctx, llm, systemMsg, prompt, maxTokens, temperature(req, config), stop)
 	if err != nil {
-		return nil, fmt.Errorf("LLM call failed: %w", err)
+		return nil, queryError(ctx, err)
+	}
+	// Each candidate query sends the whole prompt again, so prompt tokens
+	// are counted per query for the cost estimate
+	estimatedPromptTokens := estimateTokens(systemMsg) + estimateTokens(prompt)
+	queryPromptTokens := func(r queryResult) int {
+		if r.prompt > 0 {
+			return r.prompt
+		}
+		return estimatedPromptTokens
+	}
+	tokensUsed, promptTokens := result.tokens, queryPromptTokens(result)
+	candidates := []candidate{newCandidate(result, req, config, maxTokens, completionCtx)}
+
+	// Alternatives are best effort; a failed query ends them
+	for len(candidates) < req.Candidates {
+		alt, err := s.query(ctx, llm, systemMsg, prompt, maxTokens, temperature(req, config), stop)
+		if err != nil {
+			break
+		}
+		tokensUsed += alt.tokens
+		promptTokens += queryPromptTokens(alt)
+		candidates = append(candidates, newCandidate(alt, req, config, maxTokens, completionCtx))
+	}
+	candidates = rankCandidates(dedupCandidates(candidates))
+	best := candidates[0]
+	completion := best.text
+	var alternatives []Alternative
+	for _, alt := range candidates[1:] {
+		alternatives = append(alternatives, Alternative{Completion: alt.text, Score: alt.score})
 	}
 
 	response := &CompletionResponse{
-		Completion:   completion,
-		LatencyMs:    time.Since(startTime).Milliseconds(),
-		Model:        llm,
-		TokensUsed:   tokensUsed,
-		CachedResult: false,
-		Timestamp:    time.Now(),
+		Completion:    completion,
+		LatencyMs:     time.Since(startTime).Milliseconds(),
+		Model:         result.model,
+		Client:        result.client,
+		TokensUsed:    tokensUsed,
+		CachedResult:  false,
+		Timestamp:     time.Now(),
+		TrimReport:    completionCtx.Trim,
+		IncludedFiles: completionCtx.includedFiles(),
+		Insertion:     completionCtx.Insertion,
+		Warnings:      completionCtx.Warnings,
+		LineEnding:    completionCtx.LineEnding,
+		Truncated:     best.truncated,
+		Score:         best.score,
+		Alternatives:  alternatives,
+		Explanation:   best.explanation,
+	}
+
+	if config.IncludeRawCompletion {
+		response.RawCompletion = best.raw
+	}
+
+	if config.IncludeTokenUsage {
+		response.TokenUsage = tokenUsageReport(estimatedPromptTokens, result.prompt)
+	}
+
+	if config.CheckSyntax {
+		if valid, ok := checkSyntax(req.FilePath, string(fileContent), req.CursorLine, req.CursorColumn, req.ContinueFrom, completion, config.NormalizeLineEndings); ok {
+			response.SyntaxValid = &valid
+		}
+	}
+
+	if price, ok := config.ModelPricing[result.model]; ok {
+		response.EstimatedCost = estimateCost(price, promptTokens, tokensUsed)
+	}
+
+	// Wall-clock fields would make otherwise identical responses differ
+	if config.Deterministic {
+		response.LatencyMs = 0
+		response.Timestamp = time.Time{}
 	}
 
-	if s.config.EnableCache {
-		s.cache.Put(req, string(fileContent), response)
+	if config.EnableCache {
+		s.cache.Put(req, fileHash, response)
+	}
+	if idempotencyKey != "" {
+		s.idempotency.put(idempotencyKey, response)
 	}
 
 	return response, nil
 }
 
+// checkRateLimit counts a request against the project's limits when rate
+// limiting is enabled
+func (s *CompletionService) checkRateLimit(projectID string, config *Config) error {
+	if !config.RateLimitEnabled {
+		return nil
+	}
+	return s.rateLimiter.CheckLimit(projectID, config.MaxRequestsPerMinute, config.MaxRequestsPerHour)
+}
+
+// cachedResponse looks up a cached completion unless the request asks to
+// bypass the cache
+func (s *CompletionService) cachedResponse(req CompletionRequest, fileHash string) (*CompletionResponse, bool) {
+	if req.NoCache {
+		return nil, false
+	}
+	cached, ok := s.cache.Get(req, fileHash)
+	if !ok {
+		return nil, false
+	}
+	// The entry is shared with other readers, so mark a copy
+	response := *cached
+	response.CachedResult = true
+	return &response, true
+}
+
+// resolveRequest applies config defaults to req: single-line mode, and the
+// effective LLM and MaxTokens
+func resolveRequest(req CompletionRequest, config *Config) CompletionRequest {
+	if req.SingleLine || config.SingleLine {
+		req.SingleLine = true
+		req.Mode = ModeLine
+	}
+	if req.LLM == "" {
+		req.LLM = config.DefaultLLM
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = config.MaxTokens
+		if modeTokens, ok := modeMaxTokens[req.Mode]; ok && modeTokens < req.MaxTokens {
+			req.MaxTokens = modeTokens
+		}
+	}
+	return req
+}
+
+// requestGatherer creates the gatherer for one request, with the service's
+// observer and context providers
+func (s *CompletionService) requestGatherer(config *Config, budget int) *ContextGatherer {
+	gatherer := newGatherer(config)
+	gatherer.maxTokens = budget
+	gatherer.observer = s.observer
+	gatherer.providers = s.providers
+	return gatherer
+}
+
+// newGatherer creates a context gatherer from the service config
+func newGatherer(config *Config) *ContextGatherer {
+	return &ContextGatherer{
+		maxTokens:           config.MaxContextTokens,
+		includeAgents:       config.IncludeAgentsFile,
+		includeDiscussion:   config.IncludeDiscussion,
+		agentsFileNames:     config.AgentsFileNames,
+		maxAgentsDepth:      config.MaxAgentsDepth,
+		useRepoMap:          config.UseRepoMap,
+		preamble:            config.GlobalPreamble,
+		rankFiles:           config.RankContextFiles,
+		fileTrimPolicy:      config.FileTrimPolicy,
+		tagsFile:            config.TagsFile,
+		includeBlame:        config.IncludeBlame,
+		authorConventions:   config.AuthorConventions,
+		normalizeEOL:        config.NormalizeLineEndings,
+		alwaysInclude:       config.AlwaysIncludeFiles,
+		includeChanges:      config.IncludeRecentChanges,
+		prefixRatio:         config.PrefixRatio,
+		partialOnTimeout:    config.PartialContextOnTimeout,
+		maxDiscussionChars:  config.MaxDiscussionChars,
+		discussionFormat:    config.DiscussionFormat,
+		maxDiscussionRounds: config.MaxDiscussionRounds,
+		roundPolicy:         config.DiscussionRetention,
+		fastPathMaxBytes:    config.FastPathMaxBytes,
+		keepImports:         config.KeepImports,
+		keepPackage:         config.KeepPackage,
+		trimOrder:           config.TrimOrder,
+		maxContextFiles:     config.MaxContextFiles,
+	}
+}
+
+// contextBudget returns the context token budget for llm: MaxContextTokens,
+// reduced if needed so the context and completion fit its ModelWindows entry
+func contextBudget(config *Config, llm string, maxTokens int) (int, error) {
+	budget := config.MaxContextTokens
+	window, ok := config.ModelWindows[llm]
+	if !ok {
+		return budget, nil
+	}
+	if window-maxTokens <= 0 {
+		return 0, WrapContextError(
+			fmt.Sprintf("max tokens %d leaves no room for context in %s's %d-token window", maxTokens, llm, window),
+			ErrContextTooLarge,
+		)
+	}
+	if window-maxTokens < budget {
+		budget = window - maxTokens
+	}
+	return budget, nil
+}
+
+// requestDeadline bounds a whole request, context gathering and LLM calls
+// included, by RequestTimeout
+func requestDeadline(ctx context.Context, config *Config) (context.Context, context.CancelFunc) {
+	if config.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, config.RequestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// queryError wraps an LLM call failure, as a timeout if ctx's deadline
+// passed during it
+func queryError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return WrapTimeoutError("LLM request timed out", ErrLLMTimeout)
+	}
+	return fmt.Errorf("LLM call failed: %w", err)
+}
+
+// gatherContextDeadline bounds context gathering by ContextGatherTimeout,
+// within the request's deadline
+func gatherContextDeadline(ctx context.Context, config *Config) (context.Context, context.CancelFunc) {
+	if config.ContextGatherTimeout > 0 {
+		return context.WithTimeout(ctx, config.ContextGatherTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// temperature returns the sampling temperature for a request. Deterministic
+// mode always uses 0.
+func temperature(req CompletionRequest, config *Config) float64 {
+	if config.Deterministic {
+		return 0
+	}
+	if req.Temperature != 0 {
+		return req.Temperature
+	}
+	return config.Temperature
+}
+
+// queryResult is the output of a query and which client produced it
+type queryResult struct {
+	text   string
+	tokens int
+	prompt int // provider's prompt tokens; 0 if not reported
+	model  string
+	client string
+	score  float64
+	scored bool // score came from the provider
+}
+
+// query calls the LLM, trying fallback clients in order when a client
+// fails with anything other than the request's own cancellation or deadline
+func (s *CompletionService) query(
+	ctx context.Context,
+	llm, systemMsg, userMsg string,
+	maxTokens int,
+	temperature float64,
+	stop []string,
+) (queryResult, error) {
+	clients := append([]FallbackClient{{Name: "primary", Client: s.grokker}}, s.fallbacks...)
+
+	var lastErr error
+	for _, fc := range clients {
+		model := llm
+		if fc.LLM != "" {
+			model = fc.LLM
+		}
+
+		result, err := queryClient(ctx, fc.Client, model, systemMsg, userMsg, maxTokens, temperature, stop)
+		if err == nil && result.text == "" && result.tokens == 0 {
+			// Silent provider failure; a real empty completion still uses tokens
+			err = WrapLLMError(fmt.Sprintf("client %s returned no text and no tokens", fc.Name), ErrEmptyResponse)
+		}
+		if err == nil {
+			result.model = model
+			result.client = fc.Name
+			return result, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || !isRetryable(err) {
+			break
+		}
+	}
+	return queryResult{}, lastErr
+}
+
+// queryClient calls one client through the richest interface it has,
+// passing temperature and stop sequences and collecting token usage and a
+// score when it supports them
+func queryClient(
+	ctx context.Context,
+	client GrokkerClient,
+	llm, systemMsg, userMsg string,
+	maxTokens int,
+	temperature float64,
+	stop []string,
+) (queryResult, error) {
+	var result queryResult
+	var err error
+	if c, ok := client.(UsageClient); ok {
+		var out UsageResult
+		out, err = c.QueryWithUsage(ctx, llm, systemMsg, userMsg, maxTokens, temperature, stop)
+		result.text = out.Text
+		result.tokens, result.prompt = out.Usage.PromptTokens+out.Usage.CompletionTokens, out.Usage.PromptTokens
+		if out.Score != nil {
+			result.score, result.scored = *out.Score, true
+		}
+		return result, err
+	}
+	if c, ok := client.(ScoringClient); ok {
+		result.text, result.tokens, result.score, err = c.QueryWithScore(ctx, llm, systemMsg, userMsg, maxTokens, temperature, stop)
+		result.scored = true
+		return result, err
+	}
+	if c, ok := client.(StopSequenceClient); ok && len(stop) > 0 {
+		result.text, result.tokens, err = c.QueryWithStop(ctx, llm, systemMsg, userMsg, maxTokens, temperature, stop)
+		return result, err
+	}
+	if c, ok := client.(TemperatureClient); ok {
+		result.text, result.tokens, err = c.QueryWithTemperature(ctx, llm, systemMsg, userMsg, maxTokens, temperature)
+		return result, err
+	}
+	result.text, result.tokens, err = client.Query(ctx, llm, systemMsg, userMsg, maxTokens)
+	return result, err
+}
+
+// ResolveAgentsChain returns the AGENTS.md (or configured) files that apply to filePath,
+// nearest first, with each file's path and content kept separate
+func (s *CompletionService) ResolveAgentsChain(
+	projectID, filePath string,
+	projectGetter ProjectGetter,
+) ([]FileContext, error) {
+	req := CompletionRequest{ProjectID: projectID, FilePath: filePath}
+	if err := s.validateRequest(req, projectGetter); err != nil {
+		return nil, err
+	}
+
+	baseDir, err := projectGetter.GetProjectBaseDir(projectID)
+	if err != nil {
+		return nil, err
+	}
+	config := s.currentConfig()
+	return agentsChain(baseDir, filePath, config.AgentsFileNames, config.MaxAgentsDepth, projectGetter), nil
+}
+
 func (s *CompletionService) validateRequest(req CompletionRequest, pg ProjectGetter) error {
 	if req.ProjectID == "" || req.FilePath == "" {
 		return ErrInvalidRequest
 	}
-	authorizedFiles, err := pg.GetProjectAuthorizedFiles(req.ProjectID)
+	if !validMode(req.Mode) {
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidRequest, req.Mode)
+	}
+	if req.Candidates < 0 || req.Candidates > maxCandidates {
+		return fmt.Errorf("%w: candidates must be between 0 and %d", ErrInvalidRequest, maxCandidates)
+	}
+	authorized, err := s.auth.get(req.ProjectID, pg)
 	if err != nil {
 		return err
 	}
-	baseDir, _ := pg.GetProjectBaseDir(req.ProjectID)
-	targetPath := resolveFilePath(baseDir, req.FilePath)
-	for _, authFile := range authorizedFiles {
-		if filepath.Clean(resolveFilePath(baseDir, authFile)) == filepath.Clean(targetPath) {
-			return nil
-		}
+	if authorized.allows(req.FilePath) {
+		return nil
 	}
 	return fmt.Errorf("%w: %s", ErrFileNotAuthorized, req.FilePath)
 }
 
+// projectConfig returns base with the project's overrides applied, if the
+// ProjectGetter supplies any
+func projectConfig(base *Config, projectID string, pg ProjectGetter) (*Config, error) {
+	getter, ok := pg.(ProjectConfigGetter)
+	if !ok {
+		return base, nil
+	}
+	overrides, err := getter.GetProjectConfigOverrides(projectID)
+	if err != nil {
+		return nil, WrapProjectAccessError("failed to load project config", err)
+	}
+	if len(overrides) == 0 {
+		return base, nil
+	}
+
+	config := base.clone()
+	if err := yaml.Unmarshal(overrides, config); err != nil {
+		return nil, WrapValidationError("failed to parse project config", fmt.Errorf("%w: %v", ErrInvalidConfig, err))
+	}
+	if err := config.Validate(); err != nil {
+		return nil, WrapValidationError("invalid project config", fmt.Errorf("%w: %v", ErrInvalidConfig, err))
+	}
+	return config, nil
+}
+
+// readFileError distinguishes a missing target file from other read failures
+func readFileError(filePath string, err error) error {
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, filePath)
+	}
+	return WrapFileAccessError("failed to read file "+filePath, err)
+}
+
+// targetFile is a request's target file and, when the request supplies it
+// through FileContent or VirtualFiles, its content
+type targetFile struct {
+	path    string // absolute
+	virtual bool
+	content string
+}
+
+// resolveTarget locates req's target file under baseDir
+func resolveTarget(req CompletionRequest, baseDir string) targetFile {
+	target := targetFile{path: resolveFilePath(baseDir, req.FilePath)}
+	if f, ok := virtualFileMap(req.VirtualFiles, baseDir)[filepath.Clean(target.path)]; ok {
+		target.virtual, target.content = true, f.Content
+	}
+	if req.FileContent != nil {
+		target.virtual, target.content = true, *req.FileContent
+	}
+	return target
+}
+
+// loadTarget returns the target file's content, reading it unless the
+// request supplied it, and checks that it is text and, with
+// StrictCursorValidation, that the cursor is within it
+func loadTarget(req CompletionRequest, config *Config, projectGetter ProjectGetter, target targetFile) ([]byte, error) {
+	fileContent := []byte(target.content)
+	if !target.virtual {
+		var err error
+		fileContent, err = projectGetter.ReadFile(target.path)
+		if err != nil {
+			return nil, readFileError(req.FilePath, err)
+		}
+	}
+	if err := checkTextFile(req.FilePath, fileContent); err != nil {
+		return nil, err
+	}
+	if config.StrictCursorValidation {
+		if err := checkCursorBounds(string(fileContent), req.CursorLine, req.CursorColumn); err != nil {
+			return nil, err
+		}
+	}
+	return fileContent, nil
+}
+
+// checkTextFile rejects a target file whose content isn't text
+func checkTextFile(filePath string, content []byte) error {
+	if isBinary(content) {
+		return WrapValidationError("cannot complete in "+filePath, fmt.Errorf("%w: binary or non-UTF-8 content", ErrBinaryFile))
+	}
+	return nil
+}
+
+// statFile stats path if the ProjectGetter supports it
+func statFile(pg ProjectGetter, path string) (fileStat, bool) {
+	stater, ok := pg.(FileStater)
+	if !ok {
+		return fileStat{}, false
+	}
+	size, modTime, err := stater.Stat(path)
+	if err != nil {
+		return fileStat{}, false
+	}
+	return fileStat{size: size, modTime: modTime}, true
+}
+
+// virtualFileMap indexes virtual files by cleaned absolute path
+func virtualFileMap(files []FileContext, baseDir string) map[string]FileContext {
+	virtual := make(map[string]FileContext, len(files))
+	for _, f := range files {
+		virtual[filepath.Clean(resolveFilePath(baseDir, f.Path))] = f
+	}
+	return virtual
+}
+
 func resolveFilePath(baseDir, filePath string) string {
 	if filepath.IsAbs(filePath) {
 		return filePath
@@ -0,0 +1,948 @@
+package smartcomplete
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCompleteStatShortCircuitsRead(t *testing.T) {
+	before := time.Unix(1700000000, 0)
+	after := before.Add(time.Second)
+	tests := []struct {
+		name      string
+		stat      bool
+		modTime   time.Time
+		wantReads int
+	}{
+		{"unchanged mtime", true, before, 1},
+		{"changed mtime", true, after, 2},
+		{"no Stat", false, before, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n"})
+			stat := &statProject{fakeProject: fake, modTimes: map[string]time.Time{"main.go": before}}
+			var pg ProjectGetter = fake
+			if tt.stat {
+				pg = stat
+			}
+
+			config := testConfig()
+			config.EnableCache = true
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: "\tprintln()"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, CursorColumn: 13}
+
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("first Complete: %v", err)
+			}
+			stat.modTimes["main.go"] = tt.modTime
+			resp, err := service.Complete(context.Background(), req, pg)
+			if err != nil {
+				t.Fatalf("second Complete: %v", err)
+			}
+			if !resp.CachedResult {
+				t.Error("second Complete was not served from the cache")
+			}
+			if got := fake.readCount("main.go"); got != tt.wantReads {
+				t.Errorf("main.go read %d times, want %d", got, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestResolveAgentsChain(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"AGENTS.md":           "root",
+		"pkg/AGENTS.md":       "pkg",
+		"pkg/sub/AGENTS.md":   "sub",
+		"pkg/sub/file.go":     "package sub\n",
+		"other/AGENTS.md":     "other",
+		"pkg/nested/plain.go": "package nested\n",
+	})
+	tests := []struct {
+		name      string
+		filePath  string
+		wantPaths []string
+	}{
+		{"nested", "pkg/sub/file.go", []string{"pkg/sub/AGENTS.md", "pkg/AGENTS.md", "AGENTS.md"}},
+		{"directory without its own", "pkg/nested/plain.go", []string{"pkg/AGENTS.md", "AGENTS.md"}},
+	}
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := service.ResolveAgentsChain("p", tt.filePath, pg)
+			if err != nil {
+				t.Fatalf("ResolveAgentsChain: %v", err)
+			}
+			var paths []string
+			for _, f := range chain {
+				paths = append(paths, strings.TrimPrefix(f.Path, testBaseDir+"/"))
+				if want := pg.files[paths[len(paths)-1]]; f.Content != want {
+					t.Errorf("%s content = %q, want %q", f.Path, f.Content, want)
+				}
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.wantPaths, ",") {
+				t.Errorf("chain = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+
+	if _, err := service.ResolveAgentsChain("p", "", pg); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("empty file path: err = %v, want ErrInvalidRequest", err)
+	}
+}
+
+// temperatureClient is an EchoGrokkerClient that records the temperature
+// it is asked for
+type temperatureClient struct {
+	EchoGrokkerClient
+	temperatures []float64
+}
+
+func (c *temperatureClient) QueryWithTemperature(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64) (string, int, error) {
+	c.temperatures = append(c.temperatures, temperature)
+	return c.EchoGrokkerClient.Query(ctx, llm, systemMsg, userMsg, maxTokens)
+}
+
+func TestDeterministicMode(t *testing.T) {
+	tests := []struct {
+		name            string
+		deterministic   bool
+		wantTemperature float64
+	}{
+		{"deterministic", true, 0},
+		{"not deterministic", false, 0.7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, CursorColumn: 13, Temperature: 0.7}
+
+			var responses [][]byte
+			for run := 0; run < 2; run++ {
+				config := testConfig()
+				config.Deterministic = tt.deterministic
+				config.CacheTTLJitter = 0.2
+				client := &temperatureClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "\tprintln()", Latency: time.Millisecond}}
+				service := newTestService(t, config, client)
+
+				resp, err := service.Complete(context.Background(), req, pg)
+				if err != nil {
+					t.Fatalf("Complete: %v", err)
+				}
+				if len(client.temperatures) != 1 || client.temperatures[0] != tt.wantTemperature {
+					t.Errorf("temperatures = %v, want [%v]", client.temperatures, tt.wantTemperature)
+				}
+				data, err := json.Marshal(resp)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				responses = append(responses, data)
+			}
+			if tt.deterministic && !bytes.Equal(responses[0], responses[1]) {
+				t.Errorf("responses differ:\n%s\n%s", responses[0], responses[1])
+			}
+		})
+	}
+}
+
+func TestDeterministicCacheHasNoJitter(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	config.Deterministic = true
+	config.CacheTTLJitter = 0.5
+	service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+
+	for line := 0; line < 10; line++ {
+		service.cache.Put(CompletionRequest{ProjectID: "p", FilePath: "a.go", CursorLine: line}, "hash", &CompletionResponse{})
+	}
+	for _, entry := range service.cache.entries {
+		if ttl := entry.ExpiresAt.Sub(entry.CreatedAt); ttl != config.CacheTTL {
+			t.Errorf("entry TTL = %v, want exactly %v", ttl, config.CacheTTL)
+		}
+	}
+}
+
+func TestMaxPromptTokens(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxPromptTokens int
+		wantErr         bool
+	}{
+		{"no cap", 0, false},
+		{"generous cap", 100000, false},
+		{"low cap", 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.MaxPromptTokens = tt.maxPromptTokens
+			client := &EchoGrokkerClient{Completion: "x"}
+			service := newTestService(t, config, client)
+
+			pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n}\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2}
+			_, err := service.Complete(context.Background(), req, pg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrContextTooLarge) {
+					t.Errorf("err = %v, want ErrContextTooLarge", err)
+				}
+				if client.Calls() != 0 {
+					t.Errorf("client called %d times for an oversized prompt", client.Calls())
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Complete: %v", err)
+			}
+		})
+	}
+}
+
+func TestCachedResponseIsACopy(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+
+	first, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("first Complete: %v", err)
+	}
+	second, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("second Complete: %v", err)
+	}
+	if !second.CachedResult {
+		t.Error("second response is not marked as cached")
+	}
+	if first.CachedResult {
+		t.Error("marking the cached response changed the original")
+	}
+}
+
+func TestTargetContentFromRequest(t *testing.T) {
+	const onDisk = "package main\n\nfunc saved() {\n}\n"
+	const buffer = "package main\n\nfunc unsaved() {\n}\n"
+	bufferPtr := func(s string) *string { return &s }
+	tests := []struct {
+		name        string
+		fileContent *string
+		virtual     []FileContext
+		authorized  []string
+		wantFunc    string
+		wantReads   int
+		wantErr     error
+	}{
+		{"disk", nil, nil, nil, "saved", 1, nil},
+		{"FileContent", bufferPtr(buffer), nil, nil, "unsaved", 0, nil},
+		{"virtual target", nil, []FileContext{{Path: "main.go", Content: buffer}}, nil, "unsaved", 0, nil},
+		{"FileContent still authorized", bufferPtr(buffer), nil, []string{"other.go"}, "", 0, ErrFileNotAuthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{"main.go": onDisk})
+			pg.authorized = tt.authorized
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, testConfig(), client)
+
+			req := CompletionRequest{
+				ProjectID:    "p",
+				FilePath:     "main.go",
+				CursorLine:   2,
+				CursorColumn: 5,
+				FileContent:  tt.fileContent,
+				VirtualFiles: tt.virtual,
+			}
+			_, err := service.Complete(context.Background(), req, pg)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if want := "CODE AFTER CURSOR:\n" + tt.wantFunc + "() {"; !strings.Contains(client.lastPrompt(), want) {
+				t.Errorf("prompt does not contain %q:\n%s", want, client.lastPrompt())
+			}
+			if got := pg.readCount("main.go"); got != tt.wantReads {
+				t.Errorf("main.go read %d times, want %d", got, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestTruncateToMaxTokens(t *testing.T) {
+	long := strings.Repeat("é", 1000) // far more than 10 tokens' worth
+	tests := []struct {
+		name          string
+		truncate      bool
+		wantTruncated bool
+		wantRunes     int
+	}{
+		{"off", false, false, 1000},
+		{"on", true, true, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.TruncateToMaxTokens = tt.truncate
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: long})
+
+			pg := newFakeProject(map[string]string{"main.go": "package main\n\nvar s = \"\"\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, CursorColumn: 9, MaxTokens: 10}
+			resp, err := service.Complete(context.Background(), req, pg)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if resp.Truncated != tt.wantTruncated {
+				t.Errorf("Truncated = %t, want %t", resp.Truncated, tt.wantTruncated)
+			}
+			if got := utf8.RuneCountInString(resp.Completion); got != tt.wantRunes {
+				t.Errorf("completion is %d runes, want %d", got, tt.wantRunes)
+			}
+			if !utf8.ValidString(resp.Completion) {
+				t.Error("truncated completion is not valid UTF-8")
+			}
+		})
+	}
+}
+
+func TestPing(t *testing.T) {
+	errDown := errors.New("provider unreachable")
+	tests := []struct {
+		name    string
+		client  *EchoGrokkerClient
+		timeout time.Duration
+		wantErr error
+	}{
+		{"reachable", &EchoGrokkerClient{}, 0, nil},
+		{"query fails", &EchoGrokkerClient{Err: errDown}, 0, errDown},
+		{"times out", &EchoGrokkerClient{Latency: time.Second}, 10 * time.Millisecond, ErrLLMTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A one-request limit shows Ping doesn't use it up
+			config := testConfig()
+			config.RateLimitEnabled = true
+			config.MaxRequestsPerMinute = 1
+			config.RequestTimeout = tt.timeout
+			service := newTestService(t, config, tt.client)
+
+			err := service.Ping(context.Background())
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("Ping: %v", err)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Ping err = %v, want %v", err, tt.wantErr)
+			}
+
+			if err := service.checkRateLimit("p", config); err != nil {
+				t.Errorf("rate limit after Ping: %v", err)
+			}
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency time.Duration
+		timeout time.Duration
+		wantErr error
+	}{
+		{"in time", 0, time.Minute, nil},
+		{"no timeout", 10 * time.Millisecond, 0, nil},
+		{"LLM call too slow", time.Minute, 20 * time.Millisecond, ErrLLMTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.RequestTimeout = tt.timeout
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: "x", Latency: tt.latency})
+			pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+
+			_, err := service.Complete(context.Background(), req, pg)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("Complete: %v", err)
+				}
+				return
+			}
+			var completionErr *CompletionError
+			if !errors.Is(err, tt.wantErr) || !errors.As(err, &completionErr) || completionErr.Code != CodeTimeout {
+				t.Errorf("Complete err = %v, want a timeout CompletionError for %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// statusError is an LLM client error carrying an HTTP status
+type statusError int
+
+func (e statusError) Error() string   { return fmt.Sprintf("status %d", int(e)) }
+func (e statusError) Retryable() bool { return e == 429 || e >= 500 }
+
+func TestFallbackClients(t *testing.T) {
+	errDown := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	errNoModel := errors.New("model not found")
+	tests := []struct {
+		name          string
+		primary       *EchoGrokkerClient
+		fallback      *EchoGrokkerClient
+		wantClient    string
+		wantModel     string
+		wantErr       error
+		wantFallbacks int
+	}{
+		{"primary serves", &EchoGrokkerClient{Completion: "a"}, &EchoGrokkerClient{Completion: "b"}, "primary", "model-a", nil, 0},
+		{"primary fails", &EchoGrokkerClient{Err: errDown}, &EchoGrokkerClient{Completion: "b"}, "backup", "model-b", nil, 1},
+		{"primary overloaded", &EchoGrokkerClient{Err: statusError(503)}, &EchoGrokkerClient{Completion: "b"}, "backup", "model-b", nil, 1},
+		{"all fail", &EchoGrokkerClient{Err: errDown}, &EchoGrokkerClient{Err: errDown}, "", "", errDown, 1},
+		{"auth failure", &EchoGrokkerClient{Err: statusError(401)}, &EchoGrokkerClient{Completion: "b"}, "", "", statusError(401), 0},
+		{"prompt too large", &EchoGrokkerClient{Err: ErrContextTooLarge}, &EchoGrokkerClient{Completion: "b"}, "", "", ErrContextTooLarge, 0},
+		{"unknown error", &EchoGrokkerClient{Err: errNoModel}, &EchoGrokkerClient{Completion: "b"}, "", "", errNoModel, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, testConfig(), tt.primary)
+			service.SetFallbackClients(FallbackClient{Name: "backup", Client: tt.fallback, LLM: "model-b"})
+
+			pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, LLM: "model-a"}
+			resp, err := service.Complete(context.Background(), req, pg)
+			if calls := tt.fallback.Calls(); calls != tt.wantFallbacks {
+				t.Errorf("fallback called %d times, want %d", calls, tt.wantFallbacks)
+			}
+			if tt.wantClient == "" {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if resp.Client != tt.wantClient || resp.Model != tt.wantModel {
+				t.Errorf("served by %s/%s, want %s/%s", resp.Client, resp.Model, tt.wantClient, tt.wantModel)
+			}
+		})
+	}
+}
+
+func TestFallbackStopsAtDeadline(t *testing.T) {
+	primary := &EchoGrokkerClient{Latency: time.Second}
+	fallback := &EchoGrokkerClient{Completion: "b"}
+	service := newTestService(t, testConfig(), primary)
+	service.SetFallbackClients(FallbackClient{Name: "backup", Client: fallback})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	if _, err := service.Complete(ctx, CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}, pg); err == nil {
+		t.Error("Complete succeeded after the request deadline")
+	}
+	if fallback.Calls() != 0 {
+		t.Errorf("fallback called %d times after the deadline passed", fallback.Calls())
+	}
+}
+
+// fixedClient returns the same text and token count for every query
+type fixedClient struct {
+	text   string
+	tokens int
+	calls  int
+}
+
+func (c *fixedClient) Query(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int) (string, int, error) {
+	c.calls++
+	return c.text, c.tokens, nil
+}
+
+func TestEmptyResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  int
+		wantErr bool
+	}{
+		{"no text and no tokens", 0, true},
+		{"no text but tokens used", 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.EnableCache = true
+			client := &fixedClient{tokens: tt.tokens}
+			service := newTestService(t, config, client)
+			pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+
+			for i := 0; i < 2; i++ {
+				resp, err := service.Complete(context.Background(), req, pg)
+				if tt.wantErr {
+					var completionErr *CompletionError
+					if !errors.Is(err, ErrEmptyResponse) || !errors.As(err, &completionErr) || completionErr.Code != CodeLLMError {
+						t.Fatalf("err = %v, want an LLM error wrapping ErrEmptyResponse", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Complete: %v", err)
+				}
+				if resp.Completion != "" {
+					t.Errorf("Completion = %q, want empty", resp.Completion)
+				}
+			}
+
+			// Failures are never cached; legitimate empty completions are
+			wantCalls := 1
+			if tt.wantErr {
+				wantCalls = 2
+			}
+			if client.calls != wantCalls {
+				t.Errorf("client called %d times, want %d", client.calls, wantCalls)
+			}
+		})
+	}
+}
+
+func TestCompleteReadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		readErr  error
+		wantErr  error
+		wantCode string
+	}{
+		{"missing file", fs.ErrNotExist, ErrFileNotFound, ""},
+		{"wrapped missing file", fmt.Errorf("open: %w", fs.ErrNotExist), ErrFileNotFound, ""},
+		{"permission denied", fs.ErrPermission, fs.ErrPermission, CodeFileAccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+			pg.readErrs = map[string]error{"main.go": tt.readErr}
+			service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+			_, err := service.Complete(context.Background(), req, pg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrFileNotAuthorized) {
+				t.Errorf("err = %v reports the authorized file as unauthorized", err)
+			}
+			if tt.wantCode != "" {
+				var completionErr *CompletionError
+				if !errors.As(err, &completionErr) || completionErr.Code != tt.wantCode {
+					t.Errorf("err = %v, want code %s", err, tt.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictCursorValidation(t *testing.T) {
+	const content = "package main\n\nfunc main() {\n}" // 4 lines; line 2 is 13 bytes
+	tests := []struct {
+		name       string
+		line, col  int
+		wantStrict bool // strict mode rejects the cursor
+	}{
+		{"inside", 2, 5, false},
+		{"end of line", 2, 13, false},
+		{"end of file", 3, 1, false},
+		{"column past end of line", 2, 14, true},
+		{"line past end of file", 4, 0, true},
+		{"negative column", 1, -1, true},
+	}
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s strict=%t", tt.name, strict), func(t *testing.T) {
+				config := testConfig()
+				config.StrictCursorValidation = strict
+				service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+				pg := newFakeProject(map[string]string{"main.go": content})
+				req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: tt.line, CursorColumn: tt.col}
+
+				wantErr := strict && tt.wantStrict
+				_, err := service.Complete(context.Background(), req, pg)
+				if wantErr && !errors.Is(err, ErrInvalidRequest) {
+					t.Errorf("err = %v, want ErrInvalidRequest", err)
+				}
+				if !wantErr && err != nil {
+					t.Errorf("Complete: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := writeConfigFile(t, "default_llm: old-model\nenable_cache: false\nmax_requests_per_minute: 100\nmax_requests_per_hour: 100\n")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+	fake := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, CursorColumn: 0}
+
+	resp, err := service.Complete(context.Background(), req, fake)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Model != "old-model" {
+		t.Fatalf("Model = %q, want old-model", resp.Model)
+	}
+
+	if err := os.WriteFile(path, []byte("default_llm: new-model\nenable_cache: false\nmax_requests_per_minute: 2\nmax_requests_per_hour: 100\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.ReloadConfig(path); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	resp, err = service.Complete(context.Background(), req, fake)
+	if err != nil {
+		t.Fatalf("Complete after reload: %v", err)
+	}
+	if resp.Model != "new-model" {
+		t.Errorf("Model = %q, want new-model after reload", resp.Model)
+	}
+
+	// The rate limiter is kept, so both earlier requests count toward the
+	// new limit of 2 per minute
+	if _, err := service.Complete(context.Background(), req, fake); !errors.Is(err, ErrRateLimitExceeded) {
+		t.Errorf("third Complete = %v, want ErrRateLimitExceeded", err)
+	}
+}
+
+func TestReloadConfigInvalid(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	path := writeConfigFile(t, "max_tokens: -1\n")
+	if err := service.ReloadConfig(path); err == nil {
+		t.Fatal("ReloadConfig with invalid config succeeded, want error")
+	}
+	if got := service.currentConfig().MaxTokens; got != DefaultConfig().MaxTokens {
+		t.Errorf("MaxTokens = %d after failed reload, want the old config kept", got)
+	}
+}
+
+func TestReloadConfigMissingFile(t *testing.T) {
+	config := testConfig()
+	config.DefaultLLM = "custom"
+	service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+	err := service.ReloadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("ReloadConfig with missing file = %v, want fs.ErrNotExist", err)
+	}
+	if got := service.currentConfig().DefaultLLM; got != "custom" {
+		t.Errorf("DefaultLLM = %q after failed reload, want the old config kept", got)
+	}
+}
+
+func TestReloadConfigConcurrent(t *testing.T) {
+	path := writeConfigFile(t, "default_llm: reloaded\nmax_requests_per_minute: 1000\nmax_requests_per_hour: 1000\n")
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	fake := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, CursorColumn: 0}
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := service.ReloadConfig(path); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := service.Complete(context.Background(), req, fake); err != nil {
+			t.Errorf("Complete during reload: %v", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+}
+
+func TestRateLimitEnabled(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		wantErr error
+	}{
+		{"enabled", true, ErrRateLimitExceeded},
+		{"disabled", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.RateLimitEnabled = tt.enabled
+			config.MaxRequestsPerMinute = 3
+			config.MaxRequestsPerHour = 3
+			if !tt.enabled {
+				config.MaxRequestsPerMinute = 0
+				config.MaxRequestsPerHour = 0
+			}
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+			fake := newFakeProject(map[string]string{"main.go": "package main\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, CursorColumn: 0}
+
+			var err error
+			for i := 0; i < 20 && err == nil; i++ {
+				_, err = service.Complete(context.Background(), req, fake)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("after 20 requests err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestContinueFrom(t *testing.T) {
+	file := "package main\n\nfunc main() {\n\t\n}\n"
+	tests := []struct {
+		name         string
+		continueFrom string
+		wantPrefix   string
+	}{
+		{"none", "", "func main() {\n\t"},
+		{"same line", "x := compute(", "func main() {\n\tx := compute("},
+		{"multiple lines", "if ok {\n\t\tx++", "\tif ok {\n\t\tx++"},
+		{"CRLF", "if ok {\r\n\t\tx++", "\tif ok {\n\t\tx++"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "y"}}
+			service := newTestService(t, testConfig(), client)
+			fake := newFakeProject(map[string]string{"main.go": file})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1, ContinueFrom: tt.continueFrom}
+
+			_, err := service.Complete(context.Background(), req, fake)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			prompt := client.lastPrompt()
+			before, _, found := strings.Cut(prompt, "CODE AFTER CURSOR:")
+			if !found {
+				t.Fatalf("prompt has no suffix section:\n%s", prompt)
+			}
+			if !strings.HasSuffix(strings.TrimRight(before, "\n"), tt.wantPrefix) {
+				t.Errorf("prefix section does not end with %q:\n%s", tt.wantPrefix, before)
+			}
+		})
+	}
+}
+
+func TestInsertionPosition(t *testing.T) {
+	file := "package main\n\nfunc main() {\n\tname := \"é\"; fmt.\n}\n"
+	col := len("\tname := \"é\"; fmt.")
+	tests := []struct {
+		name           string
+		cursorColumn   int
+		continueFrom   string
+		completion     string
+		wantCompletion string
+		want           Position
+	}{
+		{"at the cursor", col, "", "Println(name)", "Println(name)", Position{3, col, col - 1}},
+		{"clamped to the line end", col + 10, "", "Println(name)", "Println(name)", Position{3, col, col - 1}},
+		{
+			"echo of accepted text stripped",
+			col, "Println(", "name := \"é\"; fmt.Println(name)", "name)",
+			Position{3, col + len("Println("), col - 1 + len("Println(")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: tt.completion})
+			fake := newFakeProject(map[string]string{"main.go": file})
+			req := CompletionRequest{
+				ProjectID:    "p",
+				FilePath:     "main.go",
+				CursorLine:   3,
+				CursorColumn: tt.cursorColumn,
+				ContinueFrom: tt.continueFrom,
+			}
+
+			resp, err := service.Complete(context.Background(), req, fake)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if resp.Completion != tt.wantCompletion {
+				t.Errorf("Completion = %q, want %q", resp.Completion, tt.wantCompletion)
+			}
+			if resp.Insertion != tt.want {
+				t.Errorf("Insertion = %+v, want %+v", resp.Insertion, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelWindowBudget(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"main.go":    "package main\n\nfunc main() {\n\t\n}\n",
+		"helpers.go": strings.Repeat("// helper line\n", 1000), // ~3750 tokens
+	})
+	tests := []struct {
+		name       string
+		llm        string
+		wantBudget int // 0 if the context shouldn't be trimmed
+		wantErr    error
+	}{
+		{"unlisted model", "big", 0, nil},
+		{"large window", "large", 0, nil},
+		{"small window", "small", 1500, nil},
+		{"window smaller than completion", "tiny", 0, ErrContextTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.MaxContextTokens = 10000
+			config.MaxTokens = 500
+			config.ModelWindows = map[string]int{"large": 100000, "small": 2000, "tiny": 400}
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1, LLM: tt.llm, ContextFiles: []string{"helpers.go"}}
+
+			resp, err := service.Complete(context.Background(), req, pg)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Complete = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			var budget int
+			if resp.TrimReport != nil {
+				budget = resp.TrimReport.BudgetTokens
+			}
+			if budget != tt.wantBudget {
+				t.Errorf("trim budget = %d, want %d", budget, tt.wantBudget)
+			}
+		})
+	}
+}
+
+// configProject is a fakeProject that is also a ProjectConfigGetter,
+// returning YAML overrides per project
+type configProject struct {
+	*fakeProject
+	overrides map[string]string
+	err       error
+}
+
+func (p *configProject) GetProjectConfigOverrides(projectID string) ([]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return []byte(p.overrides[projectID]), nil
+}
+
+func TestProjectConfigOverrides(t *testing.T) {
+	pg := &configProject{
+		fakeProject: newFakeProject(map[string]string{"main.go": "package main\n"}),
+		overrides: map[string]string{
+			"a":         "default_llm: model-a\n",
+			"malformed": "default_llm: [\n",
+			"invalid":   "max_tokens: -1\n",
+		},
+	}
+	tests := []struct {
+		project   string
+		wantModel string
+		wantErr   error
+	}{
+		{"a", "model-a", nil},
+		{"b", "base-model", nil},
+		{"malformed", "", ErrInvalidConfig},
+		{"invalid", "", ErrInvalidConfig},
+	}
+	config := testConfig()
+	config.DefaultLLM = "base-model"
+	service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+	for _, tt := range tests {
+		t.Run(tt.project, func(t *testing.T) {
+			req := CompletionRequest{ProjectID: tt.project, FilePath: "main.go", CursorLine: 1}
+			resp, err := service.Complete(context.Background(), req, pg)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Complete = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if resp.Model != tt.wantModel {
+				t.Errorf("Model = %q, want %q", resp.Model, tt.wantModel)
+			}
+		})
+	}
+	if got := service.currentConfig().DefaultLLM; got != "base-model" {
+		t.Errorf("service DefaultLLM = %q after overrides, want base-model", got)
+	}
+}
+
+func TestProjectConfigOverridesError(t *testing.T) {
+	pg := &configProject{
+		fakeProject: newFakeProject(map[string]string{"main.go": "package main\n"}),
+		err:         errors.New("config store unavailable"),
+	}
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+	if _, err := service.Complete(context.Background(), req, pg); !errors.Is(err, pg.err) {
+		t.Errorf("Complete = %v, want the getter's error", err)
+	}
+}
+
+func TestIncludedFiles(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"main.go":  "package main\n",
+		"small.go": "package main\n\nfunc small() {}\n",
+		"big.go":   strings.Repeat("// big helper line\n", 200),
+	})
+	tests := []struct {
+		name      string
+		maxTokens int
+		want      []string
+	}{
+		{"ample budget", 10000, []string{"small.go", "big.go"}},
+		{"tight budget", 100, []string{"small.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.MaxContextTokens = tt.maxTokens
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, ContextFiles: []string{"small.go", "big.go"}}
+
+			resp, err := service.Complete(context.Background(), req, pg)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if strings.Join(resp.IncludedFiles, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("IncludedFiles = %v, want %v", resp.IncludedFiles, tt.want)
+			}
+		})
+	}
+}
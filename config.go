@@ -3,6 +3,9 @@ package smartcomplete
 import (
 	"fmt"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -12,17 +15,88 @@ import (
 type Config struct {
 	DefaultLLM           string        `yaml:"default_llm"`
 	MaxTokens            int           `yaml:"max_tokens"`
+	TruncateToMaxTokens  bool          `yaml:"truncate_to_max_tokens"`
+	StopAtSuffix         bool          `yaml:"stop_at_suffix"`
+	CheckSyntax          bool          `yaml:"check_syntax"`
+	IncludeRawCompletion bool          `yaml:"include_raw_completion"`
+	IncludeTokenUsage    bool          `yaml:"include_token_usage"`
+	SingleLine           bool          `yaml:"single_line"`
+	SkipCommentsStrings  bool          `yaml:"skip_comments_strings"`
 	Temperature          float64       `yaml:"temperature"`
+	Deterministic        bool          `yaml:"deterministic"`
 	RequestTimeout       time.Duration `yaml:"request_timeout"`
 	MaxContextTokens     int           `yaml:"max_context_tokens"`
+	ContextGatherTimeout time.Duration `yaml:"context_gather_timeout"`
+	NormalizeLineEndings bool          `yaml:"normalize_line_endings"`
+	MaxPromptTokens      int           `yaml:"max_prompt_tokens"`
+	PrefixRatio          float64       `yaml:"prefix_ratio"`
+	KeepImports          bool          `yaml:"keep_imports"`
+	KeepPackage          bool          `yaml:"keep_package"`
+	TrimOrder            []string      `yaml:"trim_order"`
+	GlobalPreamble       string        `yaml:"global_preamble"`
+	PromptFormat         string        `yaml:"prompt_format"`
+	SuffixFirst          bool          `yaml:"suffix_first"`
+	FileHeaderStyle      string        `yaml:"file_header_style"`
 	IncludeAgentsFile    bool          `yaml:"include_agents_file"`
+	AgentsFileNames      []string      `yaml:"agents_file_names"`
+	MaxAgentsDepth       int           `yaml:"max_agents_depth"`
 	IncludeDiscussion    bool          `yaml:"include_discussion"`
 	MaxDiscussionRounds  int           `yaml:"max_discussion_rounds"`
+	DiscussionFormat     string        `yaml:"discussion_format"`
+	DiscussionRetention  string        `yaml:"discussion_retention"`
+	MaxDiscussionChars   int           `yaml:"max_discussion_chars"`
+	IncludeRecentChanges bool          `yaml:"include_recent_changes"`
+	AlwaysIncludeFiles   []string      `yaml:"always_include_files"`
+	MaxContextFiles      int           `yaml:"max_context_files"`
+	UseRepoMap           bool          `yaml:"use_repo_map"`
+	RankContextFiles     bool          `yaml:"rank_context_files"`
+	FileTrimPolicy       string        `yaml:"file_trim_policy"`
+	TagsFile             string        `yaml:"tags_file"`
+	IncludeBlame         bool          `yaml:"include_blame"`
 	EnableCache          bool          `yaml:"enable_cache"`
 	CacheTTL             time.Duration `yaml:"cache_ttl"`
+	CacheTTLJitter       float64       `yaml:"cache_ttl_jitter"`
 	MaxCacheSize         int           `yaml:"max_cache_size"`
+	CacheEvictionPolicy  string        `yaml:"cache_eviction_policy"`
+	CacheNamespace       string        `yaml:"cache_namespace"`
+	CacheWriteBuffer     int           `yaml:"cache_write_buffer"`
+	RateLimitEnabled     bool          `yaml:"rate_limit_enabled"`
 	MaxRequestsPerMinute int           `yaml:"max_requests_per_minute"`
 	MaxRequestsPerHour   int           `yaml:"max_requests_per_hour"`
+	RateLimitJitter      time.Duration `yaml:"rate_limit_jitter"`
+	IdempotencyWindow    time.Duration `yaml:"idempotency_window"`
+	AuthCacheTTL         time.Duration `yaml:"auth_cache_ttl"`
+
+	// PartialContextOnTimeout sends whatever context was gathered before
+	// ContextGatherTimeout instead of failing the request
+	PartialContextOnTimeout bool `yaml:"partial_context_on_timeout"`
+
+	// FastPathMaxBytes sends only prefix/suffix and agents instructions for
+	// target files smaller than this when the request names no context
+	// files. Discussion, recent changes, always-include files, context
+	// providers, tags and the blame hint are all skipped. 0 disables the
+	// fast path
+	FastPathMaxBytes int `yaml:"fast_path_max_bytes"`
+
+	// StrictCursorValidation rejects cursors outside the file instead of
+	// clamping them
+	StrictCursorValidation bool `yaml:"strict_cursor_validation"`
+
+	// ModelPricing maps model names to prices for EstimatedCost
+	ModelPricing map[string]ModelPrice `yaml:"model_pricing"`
+
+	// ModelWindows maps model names to context windows in tokens. The
+	// context budget for a listed model is capped at its window minus the
+	// completion's max tokens.
+	ModelWindows map[string]int `yaml:"model_windows"`
+
+	// LanguageInstructions maps language names (Go, Python, ...) to extra
+	// instructions appended for files in that language
+	LanguageInstructions map[string]string `yaml:"language_instructions"`
+
+	// AuthorConventions maps authors, as blamed, to a note on their style
+	// for the IncludeBlame hint
+	AuthorConventions map[string]string `yaml:"author_conventions"`
 }
 
 // DefaultConfig returns default configuration
@@ -31,41 +105,171 @@ func DefaultConfig() *Config {
 		DefaultLLM:           "sonar-deep-research",
 		MaxTokens:            500,
 		Temperature:          0.2,
+		Deterministic:        false,
 		RequestTimeout:       30 * time.Second,
 		MaxContextTokens:     10000,
+		ContextGatherTimeout: 0, // gathering is bounded only by RequestTimeout
+		NormalizeLineEndings: true,
+		MaxPromptTokens:      0, // no hard cap
+		PrefixRatio:          defaultPrefixRatio,
+		PromptFormat:         PromptFormatFIM,
+		FileHeaderStyle:      FileHeaderPath,
 		IncludeAgentsFile:    true,
+		AgentsFileNames:      []string{"AGENTS.md"},
 		IncludeDiscussion:    true,
 		MaxDiscussionRounds:  3,
+		DiscussionFormat:     DiscussionPlain,
+		DiscussionRetention:  RoundsTail,
+		MaxDiscussionChars:   defaultMaxDiscussionChars,
+		IncludeRecentChanges: false,
+		UseRepoMap:           false,
+		RankContextFiles:     false,
 		EnableCache:          true,
 		CacheTTL:             5 * time.Minute,
+		CacheTTLJitter:       0,                 // entries expire exactly at CacheTTL
 		MaxCacheSize:         100 * 1024 * 1024, // 100MB
+		CacheEvictionPolicy:  EvictFIFO,
+		RateLimitEnabled:     true,
 		MaxRequestsPerMinute: 10,
 		MaxRequestsPerHour:   50,
+		RateLimitJitter:      2 * time.Second,
+		IdempotencyWindow:    2 * time.Minute,
 	}
 }
 
 // LoadConfig loads configuration from file or uses defaults
 func LoadConfig(path string) (*Config, error) {
-	if path == "" {
-		return DefaultConfig(), nil
-	}
+	config := DefaultConfig()
 
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return DefaultConfig(), nil
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		default:
+			if err := yaml.Unmarshal(data, config); err != nil {
+				return nil, fmt.Errorf("failed to parse config: %w", err)
+			}
 		}
-		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	config := DefaultConfig()
-	if err := yaml.Unmarshal(data, config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+	if err := config.applyEnvOverrides(); err != nil {
+		return nil, err
 	}
 
 	return config, nil
 }
 
+// EnvPrefix prefixes environment variables that override config values.
+// Each field's variable is EnvPrefix plus its upper-cased yaml key, e.g.
+// SMARTCOMPLETE_DEFAULT_LLM. Precedence is env > file > default.
+const EnvPrefix = "SMARTCOMPLETE_"
+
+// applyEnvOverrides sets fields from their environment variables. Lists are
+// comma-separated; map fields can't be overridden.
+func (c *Config) applyEnvOverrides() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		envName := EnvPrefix + strings.ToUpper(key)
+		raw, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(v.Field(i), raw); err != nil {
+			return fmt.Errorf("invalid %s: %w", envName, err)
+		}
+	}
+	return nil
+}
+
+// setFromEnv parses raw into field according to its type
+func setFromEnv(field reflect.Value, raw string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// clone returns a copy of c that shares no slices or maps with it
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.AgentsFileNames = append([]string(nil), c.AgentsFileNames...)
+	clone.AlwaysIncludeFiles = append([]string(nil), c.AlwaysIncludeFiles...)
+	clone.TrimOrder = append([]string(nil), c.TrimOrder...)
+	if c.ModelPricing != nil {
+		clone.ModelPricing = make(map[string]ModelPrice, len(c.ModelPricing))
+		for model, price := range c.ModelPricing {
+			clone.ModelPricing[model] = price
+		}
+	}
+	if c.ModelWindows != nil {
+		clone.ModelWindows = make(map[string]int, len(c.ModelWindows))
+		for model, window := range c.ModelWindows {
+			clone.ModelWindows[model] = window
+		}
+	}
+	if c.LanguageInstructions != nil {
+		clone.LanguageInstructions = make(map[string]string, len(c.LanguageInstructions))
+		for language, instruction := range c.LanguageInstructions {
+			clone.LanguageInstructions[language] = instruction
+		}
+	}
+	if c.AuthorConventions != nil {
+		clone.AuthorConventions = make(map[string]string, len(c.AuthorConventions))
+		for author, convention := range c.AuthorConventions {
+			clone.AuthorConventions[author] = convention
+		}
+	}
+	return &clone
+}
+
 // Validate checks if configuration is valid
 func (c *Config) Validate() error {
 	if c.DefaultLLM == "" {
@@ -80,11 +284,98 @@ func (c *Config) Validate() error {
 	if c.MaxContextTokens <= 0 {
 		return fmt.Errorf("max_context_tokens must be positive")
 	}
-	if c.MaxRequestsPerMinute <= 0 {
-		return fmt.Errorf("max_requests_per_minute must be positive")
+	switch c.DiscussionFormat {
+	case "", DiscussionPlain, DiscussionMarkdown, DiscussionJSONL:
+	default:
+		return fmt.Errorf("discussion_format must be one of plain, markdown, jsonl")
+	}
+	switch c.DiscussionRetention {
+	case "", RoundsTail, RoundsFirstAndRecent:
+	default:
+		return fmt.Errorf("discussion_retention must be tail or first_and_recent")
+	}
+	if c.MaxDiscussionChars < NoDiscussionCap {
+		return fmt.Errorf("max_discussion_chars must be -1 (no cap), 0 (the default) or positive")
+	}
+	if c.PrefixRatio < 0 || c.PrefixRatio > 1 {
+		return fmt.Errorf("prefix_ratio must be between 0 and 1")
+	}
+	if c.FastPathMaxBytes < 0 {
+		return fmt.Errorf("fast_path_max_bytes cannot be negative")
+	}
+	if c.MaxContextFiles < 0 {
+		return fmt.Errorf("max_context_files cannot be negative")
+	}
+	if c.MaxAgentsDepth < 0 {
+		return fmt.Errorf("max_agents_depth cannot be negative")
+	}
+	if c.CacheWriteBuffer < 0 {
+		return fmt.Errorf("cache_write_buffer cannot be negative")
+	}
+	for _, section := range c.TrimOrder {
+		if !validTrimSection(section) {
+			return fmt.Errorf("trim_order: unknown section %q", section)
+		}
+	}
+	if c.MaxPromptTokens < 0 {
+		return fmt.Errorf("max_prompt_tokens cannot be negative")
+	}
+	switch c.PromptFormat {
+	case "", PromptFormatFIM, PromptFormatCursorMarker:
+	default:
+		return fmt.Errorf("prompt_format must be %q or %q", PromptFormatFIM, PromptFormatCursorMarker)
+	}
+	switch c.FileHeaderStyle {
+	case "", FileHeaderNone, FileHeaderPath, FileHeaderVerbose:
+	default:
+		return fmt.Errorf("file_header_style must be one of none, path, verbose")
+	}
+	if c.CacheTTLJitter < 0 || c.CacheTTLJitter >= 1 {
+		return fmt.Errorf("cache_ttl_jitter must be between 0 and 1")
+	}
+	switch c.FileTrimPolicy {
+	case "", FileTrimRequestOrder, FileTrimMtime:
+	default:
+		return fmt.Errorf("file_trim_policy must be one of request_order, mtime")
+	}
+	switch c.CacheEvictionPolicy {
+	case "", EvictFIFO, EvictLRU, EvictLFU:
+	default:
+		return fmt.Errorf("cache_eviction_policy must be one of fifo, lru, lfu")
+	}
+	if c.RateLimitEnabled {
+		if c.MaxRequestsPerMinute <= 0 {
+			return fmt.Errorf("max_requests_per_minute must be positive")
+		}
+		if c.MaxRequestsPerHour <= 0 {
+			return fmt.Errorf("max_requests_per_hour must be positive")
+		}
+	}
+	for model, window := range c.ModelWindows {
+		if window <= 0 {
+			return fmt.Errorf("model_windows[%s] must be positive", model)
+		}
+	}
+	if c.RateLimitJitter < 0 {
+		return fmt.Errorf("rate_limit_jitter cannot be negative")
+	}
+	return nil
+}
+
+// ValidateForModel checks the configuration and that the context budget
+// plus the completion fit within a model's context window
+func (c *Config) ValidateForModel(modelWindow int) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if modelWindow <= 0 {
+		return fmt.Errorf("model window must be positive")
 	}
-	if c.MaxRequestsPerHour <= 0 {
-		return fmt.Errorf("max_requests_per_hour must be positive")
+	if c.MaxContextTokens+c.MaxTokens > modelWindow {
+		return fmt.Errorf(
+			"max_context_tokens (%d) + max_tokens (%d) exceeds model window of %d tokens",
+			c.MaxContextTokens, c.MaxTokens, modelWindow,
+		)
 	}
 	return nil
 }
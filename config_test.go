@@ -0,0 +1,283 @@
+package smartcomplete
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigValidatePrefixRatio(t *testing.T) {
+	tests := []struct {
+		ratio   float64
+		wantErr bool
+	}{
+		{0, false}, // unset: the default ratio is used
+		{0.3, false},
+		{1, false},
+		{-0.1, true},
+		{1.5, true},
+	}
+	for _, tt := range tests {
+		config := DefaultConfig()
+		config.PrefixRatio = tt.ratio
+		if err := config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with prefix_ratio %v = %v, want error %t", tt.ratio, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConfigValidateMaxDiscussionChars(t *testing.T) {
+	tests := []struct {
+		maxChars int
+		wantErr  bool
+	}{
+		{0, false}, // unset: the default cap is used
+		{NoDiscussionCap, false},
+		{500, false},
+		{-2, true},
+	}
+	for _, tt := range tests {
+		config := DefaultConfig()
+		config.MaxDiscussionChars = tt.maxChars
+		if err := config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with max_discussion_chars %d = %v, want error %t", tt.maxChars, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConfigValidateForModel(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxContextTokens int
+		maxTokens        int
+		window           int
+		wantErr          bool
+	}{
+		{"fits", 10000, 500, 16000, false},
+		{"exactly fills", 7500, 500, 8000, false},
+		{"context too large", 10000, 500, 8000, true},
+		{"completion pushes over", 7800, 500, 8000, true},
+		{"no window", 10000, 500, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.MaxContextTokens = tt.maxContextTokens
+			config.MaxTokens = tt.maxTokens
+			if err := config.ValidateForModel(tt.window); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateForModel(%d) = %v, want error %t", tt.window, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestContextBudget(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxContextTokens = 10000
+	config.ModelWindows = map[string]int{"small": 4000, "tiny": 400}
+	tests := []struct {
+		llm        string
+		maxTokens  int
+		wantBudget int
+		wantErr    bool
+	}{
+		{"unlisted", 500, 10000, false},
+		{"small", 500, 3500, false},
+		{"tiny", 500, 0, true},
+	}
+	for _, tt := range tests {
+		budget, err := contextBudget(config, tt.llm, tt.maxTokens)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("contextBudget(%s) err = %v, want error %t", tt.llm, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && budget != tt.wantBudget {
+			t.Errorf("contextBudget(%s) = %d, want %d", tt.llm, budget, tt.wantBudget)
+		}
+	}
+}
+
+// writeConfigFile writes a YAML config to a temp dir and returns its path
+func writeConfigFile(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, "default_llm: file-model\nmax_tokens: 300\ncache_ttl: 1m\n")
+
+	t.Setenv(EnvPrefix+"DEFAULT_LLM", "env-model")
+	t.Setenv(EnvPrefix+"CACHE_TTL", "90s")
+	t.Setenv(EnvPrefix+"TEMPERATURE", "0.7")
+	t.Setenv(EnvPrefix+"DETERMINISTIC", "true")
+	t.Setenv(EnvPrefix+"AGENTS_FILE_NAMES", "A.md, B.md,")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.DefaultLLM != "env-model" {
+		t.Errorf("DefaultLLM = %q, want env to override the file", config.DefaultLLM)
+	}
+	if config.MaxTokens != 300 {
+		t.Errorf("MaxTokens = %d, want 300 from the file", config.MaxTokens)
+	}
+	if config.CacheTTL != 90*time.Second {
+		t.Errorf("CacheTTL = %v, want 90s", config.CacheTTL)
+	}
+	if config.Temperature != 0.7 {
+		t.Errorf("Temperature = %v, want 0.7", config.Temperature)
+	}
+	if !config.Deterministic {
+		t.Error("Deterministic = false, want true")
+	}
+	if want := []string{"A.md", "B.md"}; !reflect.DeepEqual(config.AgentsFileNames, want) {
+		t.Errorf("AgentsFileNames = %q, want %q", config.AgentsFileNames, want)
+	}
+	if config.MaxContextTokens != DefaultConfig().MaxContextTokens {
+		t.Errorf("MaxContextTokens = %d, want the default", config.MaxContextTokens)
+	}
+}
+
+func TestLoadConfigEnvRateLimitEnabled(t *testing.T) {
+	path := writeConfigFile(t, "max_requests_per_minute: 0\nmax_requests_per_hour: 0\n")
+	t.Setenv(EnvPrefix+"RATE_LIMIT_ENABLED", "false")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.RateLimitEnabled {
+		t.Error("RateLimitEnabled = true, want false")
+	}
+}
+
+func TestLoadConfigEnvWithoutFile(t *testing.T) {
+	t.Setenv(EnvPrefix+"MAX_TOKENS", "42")
+	config, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.MaxTokens != 42 {
+		t.Errorf("MaxTokens = %d, want 42", config.MaxTokens)
+	}
+}
+
+func TestLoadConfigMalformedEnv(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+	}{
+		{"MAX_TOKENS", "many"},
+		{"CACHE_TTL", "5"},
+		{"TEMPERATURE", "warm"},
+		{"DETERMINISTIC", "maybe"},
+		{"RATE_LIMIT_ENABLED", "maybe"},
+		{"MODEL_PRICING", "gpt-4=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(EnvPrefix+tt.env, tt.value)
+			if _, err := LoadConfig(""); err == nil {
+				t.Errorf("LoadConfig with %s=%q succeeded, want error", tt.env, tt.value)
+			}
+		})
+	}
+}
+
+func TestConfigValidateRateLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		perMinute int
+		perHour   int
+		wantErr   bool
+	}{
+		{"enabled", true, 10, 50, false},
+		{"enabled without per-minute limit", true, 0, 50, true},
+		{"enabled without per-hour limit", true, 10, 0, true},
+		{"disabled without limits", false, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.RateLimitEnabled = tt.enabled
+			config.MaxRequestsPerMinute = tt.perMinute
+			config.MaxRequestsPerHour = tt.perHour
+			if err := config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigValidateRateLimitJitter(t *testing.T) {
+	config := DefaultConfig()
+	config.RateLimitJitter = -time.Second
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() with negative rate_limit_jitter succeeded, want error")
+	}
+}
+
+func TestConfigValidateTrimOrder(t *testing.T) {
+	config := DefaultConfig()
+	config.TrimOrder = []string{TrimAgents, "comments"}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() with an unknown trim_order section succeeded, want error")
+	}
+}
+
+func TestConfigValidateModelWindows(t *testing.T) {
+	tests := []struct {
+		windows map[string]int
+		wantErr bool
+	}{
+		{nil, false},
+		{map[string]int{"small": 4000}, false},
+		{map[string]int{"small": 0}, true},
+		{map[string]int{"small": -1}, true},
+	}
+	for _, tt := range tests {
+		config := DefaultConfig()
+		config.ModelWindows = tt.windows
+		if err := config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with model_windows %v = %v, want error %t", tt.windows, err, tt.wantErr)
+		}
+	}
+}
+
+// TestReadmeConfigLiteral keeps the README's Config literal, which leaves
+// every newer option at its zero value, usable as documented
+func TestReadmeConfigLiteral(t *testing.T) {
+	config := &Config{
+		DefaultLLM:           "sonar-deep-research",
+		MaxTokens:            500,
+		Temperature:          0.2,
+		RequestTimeout:       30 * time.Second,
+		MaxContextTokens:     10000,
+		IncludeAgentsFile:    true,
+		IncludeDiscussion:    true,
+		MaxDiscussionRounds:  3,
+		EnableCache:          true,
+		CacheTTL:             5 * time.Minute,
+		MaxCacheSize:         100 * 1024 * 1024, // 100MB
+		RateLimitEnabled:     true,
+		MaxRequestsPerMinute: 10,
+		MaxRequestsPerHour:   50,
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if _, err := NewCompletionService(config); err != nil {
+		t.Fatalf("NewCompletionService: %v", err)
+	}
+	if !config.RateLimitEnabled {
+		t.Error("the README config has rate limiting disabled")
+	}
+}
@@ -1,33 +1,110 @@
 package smartcomplete
 
 import (
+	"context"
+	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 // CompletionContext contains all context for a completion
 type CompletionContext struct {
+	Preamble           string
 	Prefix             string
 	Suffix             string
+	PrefixTokens       int // known token count of Prefix; 0 means estimate
+	SuffixTokens       int // known token count of Suffix; 0 means estimate
 	AgentsInstructions string
 	DiscussionContext  string
+	RecentChanges      string
+	OpenFiles          []FileContext // open in the editor; trimmed after AdditionalFiles
 	AdditionalFiles    []FileContext
+	ProviderSections   []ContextSection // from ContextProviders, in order
+	RepoMap            string           // outline of context files when UseRepoMap is set
 	Language           string
+	Mode               string
+	SingleLine         bool // completion is shown inline on the cursor's line
+	SuffixExcluded     bool // the request left out the suffix; so do formatters
+	Intent             CursorIntent
+	Instruction        string
+	LineEnding         string      // original line ending of the target file
+	Partial            bool        // gathering stopped early at its deadline
+	Trim               *TrimReport // nil if nothing was trimmed
+	Insertion          Position    // where the completion goes in the file
+	Warnings           []ContextWarning
+
+	// discussionHead is the first round retained by first_and_recent, which
+	// truncation keeps in place of the discussion's oldest remaining text
+	discussionHead string
 }
 
 // FileContext represents content from an additional file
 type FileContext struct {
-	Path    string
-	Content string
+	Path    string `json:"path"`
+	Content string `json:"content"`
+
+	// Tokens is the content's known token count; 0 means estimate it
+	Tokens int `json:"tokens,omitempty"`
+}
+
+// tokens returns the file's known token count, or an estimate without one
+func (f FileContext) tokens() int {
+	return knownOrEstimated(f.Content, f.Tokens)
 }
 
+// maxConcurrentReads bounds parallel context file reads
+const maxConcurrentReads = 8
+
+// Context files with at least duplicateMinLines significant lines, of which
+// duplicateThreshold or more also appear in the target file, are skipped
+const (
+	duplicateMinLines  = 3
+	duplicateThreshold = 0.8
+)
+
+// maxInstructionRunes caps the length of a request's Instruction
+const maxInstructionRunes = 500
+
 // ContextGatherer collects relevant context for completions
 type ContextGatherer struct {
-	maxTokens int
+	maxTokens           int
+	includeAgents       bool
+	includeDiscussion   bool
+	agentsFileNames     []string
+	maxAgentsDepth      int
+	useRepoMap          bool
+	preamble            string
+	rankFiles           bool
+	fileTrimPolicy      string
+	tagsFile            string
+	includeBlame        bool
+	authorConventions   map[string]string
+	normalizeEOL        bool
+	alwaysInclude       []string
+	includeChanges      bool
+	prefixRatio         float64
+	partialOnTimeout    bool
+	maxDiscussionChars  int
+	discussionFormat    string
+	maxDiscussionRounds int
+	roundPolicy         string
+	fastPathMaxBytes    int
+	keepImports         bool
+	keepPackage         bool
+	trimOrder           []string
+	maxContextFiles     int
+	providers           []namedProvider
+	observer            Observer
 }
 
-// GatherContext collects all relevant context for the completion
+// GatherContext collects all relevant context for the completion. Once ctx
+// is done, optional sections stop being gathered: the partial context is
+// returned if the gatherer allows it, otherwise a timeout error.
 func (g *ContextGatherer) GatherContext(
+	ctx context.Context,
 	req CompletionRequest,
 	fileContent string,
 	projectGetter ProjectGetter,
@@ -37,173 +114,956 @@ func (g *ContextGatherer) GatherContext(
 		return nil, err
 	}
 
+	partial := false
+	checkDeadline := func() error {
+		if ctx.Err() == nil || partial {
+			return nil
+		}
+		if g.partialOnTimeout {
+			partial = true
+			return nil
+		}
+		return WrapTimeoutError("context gathering timed out", ctx.Err())
+	}
+
+	// Normalize CRLF/CR so stray \r doesn't skew columns or leak into the prompt
+	fileContent, lineEnding := cursorContent(fileContent, g.normalizeEOL)
+
 	// Extract prefix/suffix at cursor position
 	prefix, suffix := extractPrefixSuffix(fileContent, req.CursorLine, req.CursorColumn)
 
+	prefixTokens, suffixTokens := req.PrefixTokens, req.SuffixTokens
+	exclude := req.ExcludeSections
+	if exclude.Suffix {
+		suffix, suffixTokens = "", 0
+	}
+
+	// Continuations pick up after the previously accepted text
+	if req.ContinueFrom != "" {
+		continueFrom, _ := cursorContent(req.ContinueFrom, g.normalizeEOL)
+		prefix += continueFrom
+		if prefixTokens > 0 {
+			prefixTokens += estimateTokens(continueFrom)
+		}
+	}
+
+	// Tiny files with no explicit context files get just prefix/suffix and
+	// agents instructions, skipping the slower sections: discussion, recent
+	// changes, always-include files, providers, tags and blame
+	fastPath := g.fastPathMaxBytes > 0 && len(fileContent) < g.fastPathMaxBytes &&
+		len(req.ContextFiles) == 0 && len(req.OpenFiles) == 0 && len(req.VirtualFiles) == 0
+
 	// Gather AGENTS.md instructions
-	agentsInstructions := g.gatherAgentsInstructions(baseDir, req.FilePath, projectGetter)
+	// Optional sections that fail are dropped rather than failing the request
+	var agentsInstructions string
+	if g.includeAgents && !req.SkipAgentsInstructions {
+		agentsInstructions = g.gatherOptional(req.ProjectID, SectionAgents, func() (string, error) {
+			instructions := g.gatherAgentsInstructions(baseDir, req.FilePath, projectGetter)
+			return expandAgentsVariables(instructions, req), nil
+		})
+	}
+	if err := checkDeadline(); err != nil {
+		return nil, err
+	}
 
 	// Gather recent discussion context
-	discussionContext := g.gatherDiscussionContext(req.ProjectID, projectGetter)
+	var discussionContext, discussionHead string
+	if g.includeDiscussion && !req.SkipDiscussion && !partial && !fastPath {
+		discussionContext = g.gatherOptional(req.ProjectID, SectionDiscussion, func() (string, error) {
+			discussion, head, err := g.gatherDiscussionContext(req.ProjectID, projectGetter)
+			discussionHead = head
+			return discussion, err
+		})
+	}
+	if err := checkDeadline(); err != nil {
+		return nil, err
+	}
 
-	// Gather additional context files
-	additionalContext := g.gatherAdditionalFiles(req, baseDir, projectGetter)
+	// Gather recent changes, if the project getter can supply them
+	var recentChanges string
+	if g.includeChanges && !exclude.RecentChanges && !partial && !fastPath {
+		recentChanges = g.gatherOptional(req.ProjectID, SectionChanges, func() (string, error) {
+			return g.gatherRecentChanges(req.ProjectID, projectGetter)
+		})
+	}
+	if err := checkDeadline(); err != nil {
+		return nil, err
+	}
 
-	ctx := &CompletionContext{
+	// Gather additional context files, condensed to an outline if configured.
+	// Files open in the editor are gathered first and kept in their own
+	// section, so listing them in ContextFiles too doesn't repeat them.
+	// Always-include files come next so budget trimming drops them last.
+	// Virtual files shadow disk content; any not already listed are appended.
+	// The target file is already in prefix/suffix, so it's never repeated,
+	// nor are files that are mostly copies of it.
+	virtual := virtualFileMap(req.VirtualFiles, baseDir)
+	seen := map[string]bool{
+		filepath.Clean(resolveFilePath(baseDir, req.FilePath)): true,
+	}
+	var openContext, alwaysContext, requestContext []FileContext
+	var providerSections []ContextSection
+	var warnings, fileWarnings []ContextWarning
+	requestPaths := append([]string(nil), req.ContextFiles...)
+	for _, f := range req.VirtualFiles {
+		requestPaths = append(requestPaths, f.Path)
+	}
+	if exclude.OpenFiles {
+		req.OpenFiles = nil
+	}
+	if exclude.AdditionalFiles {
+		requestPaths = nil
+	}
+	if partial {
+		for _, paths := range [][]string{req.OpenFiles, requestPaths} {
+			for _, path := range paths {
+				warnings = append(warnings, ContextWarning{Path: path, Kind: WarningSkipped, Message: deadlineSkipMessage})
+			}
+		}
+	}
+	if !partial && !fastPath {
+		openContext, fileWarnings = g.gatherAdditionalFiles(ctx, req.ProjectID, req.OpenFiles, baseDir, projectGetter, virtual, seen)
+		warnings = append(warnings, fileWarnings...)
+		if !exclude.AdditionalFiles {
+			alwaysContext, fileWarnings = g.gatherAdditionalFiles(ctx, req.ProjectID, g.alwaysInclude, baseDir, projectGetter, virtual, seen)
+			warnings = append(warnings, fileWarnings...)
+		}
+		if g.maxContextFiles > 0 && len(requestPaths) > g.maxContextFiles {
+			for _, path := range requestPaths[g.maxContextFiles:] {
+				warnings = append(warnings, ContextWarning{
+					Path:    path,
+					Kind:    WarningSkipped,
+					Message: fmt.Sprintf("over max_context_files (%d)", g.maxContextFiles),
+				})
+			}
+			requestPaths = requestPaths[:g.maxContextFiles]
+		}
+		requestContext, fileWarnings = g.gatherAdditionalFiles(ctx, req.ProjectID, requestPaths, baseDir, projectGetter, virtual, seen)
+		warnings = append(warnings, fileWarnings...)
+
+		var providerFiles []FileContext
+		if !exclude.Providers {
+			providerFiles, providerSections = g.gatherProviders(req)
+		}
+		if exclude.AdditionalFiles {
+			providerFiles = nil
+		}
+		if g.tagsFile != "" && !exclude.Providers {
+			symbols := g.gatherOptional(req.ProjectID, SectionTags, func() (string, error) {
+				return g.gatherTags(baseDir, req.FilePath, prefix, projectGetter)
+			})
+			if symbols != "" {
+				providerSections = append(providerSections, ContextSection{Name: TagsSectionName, Content: symbols})
+			}
+		}
+		if g.includeBlame && !exclude.Providers {
+			hint := g.gatherOptional(req.ProjectID, SectionBlame, func() (string, error) {
+				return g.gatherBlame(req, projectGetter)
+			})
+			if hint != "" {
+				providerSections = append(providerSections, ContextSection{Name: BlameSectionName, Content: hint})
+			}
+		}
+		for _, f := range providerFiles {
+			absPath := filepath.Clean(resolveFilePath(baseDir, f.Path))
+			if !seen[absPath] {
+				seen[absPath] = true
+				requestContext = append(requestContext, f)
+			}
+		}
+	}
+	if err := checkDeadline(); err != nil {
+		return nil, err
+	}
+	// Always-include and virtual files were asked for explicitly, so they
+	// are kept even if they repeat the target
+	isVirtual := func(f FileContext) bool {
+		_, ok := virtual[filepath.Clean(resolveFilePath(baseDir, f.Path))]
+		return ok
+	}
+	openContext, fileWarnings = dropDuplicateFiles(openContext, fileContent, isVirtual)
+	warnings = append(warnings, fileWarnings...)
+	requestContext, fileWarnings = dropDuplicateFiles(requestContext, fileContent, isVirtual)
+	warnings = append(warnings, fileWarnings...)
+	if g.rankFiles {
+		// Most relevant first, so budget trimming drops the least relevant
+		rankByRelevance(prefix, requestContext)
+	}
+	if g.fileTrimPolicy == FileTrimMtime {
+		rankByModTime(requestContext, baseDir, projectGetter, virtual)
+	}
+	additionalContext := append(alwaysContext, requestContext...)
+	var repoMap string
+	if g.useRepoMap {
+		repoMap = buildRepoMap(additionalContext)
+		additionalContext = nil
+	}
+
+	// Classified before trimming, which can cut into comments and strings
+	language := detectLanguage(req.FilePath)
+	completionCtx := &CompletionContext{
+		Preamble:           g.preamble,
 		Prefix:             prefix,
 		Suffix:             suffix,
+		PrefixTokens:       prefixTokens,
+		SuffixTokens:       suffixTokens,
 		AgentsInstructions: agentsInstructions,
 		DiscussionContext:  discussionContext,
+		discussionHead:     discussionHead,
+		RecentChanges:      recentChanges,
+		OpenFiles:          openContext,
 		AdditionalFiles:    additionalContext,
-		Language:           detectLanguage(req.FilePath),
+		ProviderSections:   providerSections,
+		RepoMap:            repoMap,
+		Language:           language,
+		Mode:               req.Mode,
+		SingleLine:         req.SingleLine,
+		SuffixExcluded:     exclude.Suffix,
+		Intent:             classifyCursor(prefix, language),
+		LineEnding:         lineEnding,
+		Instruction:        truncateHead(strings.TrimSpace(req.Instruction), maxInstructionRunes),
+		Partial:            partial,
 	}
 
+	completionCtx.Insertion = endPosition(prefix)
+
 	// Trim to fit within token budget
-	g.trimToTokenBudget(ctx)
+	g.trimToTokenBudget(completionCtx)
+	completionCtx.Warnings = append(warnings, trimWarnings(completionCtx.Trim)...)
+
+	return completionCtx, nil
+}
+
+// includedFiles returns the paths of the context files left after
+// trimming, whether sent in full or outlined in the repo map
+func (c *CompletionContext) includedFiles() []string {
+	var paths []string
+	for _, f := range c.OpenFiles {
+		paths = append(paths, f.Path)
+	}
+	for _, f := range c.AdditionalFiles {
+		paths = append(paths, f.Path)
+	}
+	return append(paths, repoMapPaths(c.RepoMap)...)
+}
+
+// normalizeLineEndings converts CRLF and lone CR line endings to LF and
+// returns the dominant original line ending
+func normalizeLineEndings(content string) (normalized, lineEnding string) {
+	crlf := strings.Count(content, "\r\n")
+	cr := strings.Count(content, "\r") - crlf
+	lf := strings.Count(content, "\n") - crlf
+	if crlf == 0 && cr == 0 {
+		return content, "\n"
+	}
+
+	lineEnding = "\n"
+	switch {
+	case crlf >= cr && crlf >= lf:
+		lineEnding = "\r\n"
+	case cr > lf:
+		lineEnding = "\r"
+	}
 
-	return ctx, nil
+	normalized = strings.ReplaceAll(content, "\r\n", "\n")
+	normalized = strings.ReplaceAll(normalized, "\r", "\n")
+	return normalized, lineEnding
 }
 
-// extractPrefixSuffix splits file content at cursor position
+// checkCursorBounds returns ErrInvalidRequest if the cursor falls outside
+// content, rather than letting extractPrefixSuffix clamp it
+func checkCursorBounds(content string, line, col int) error {
+	content, _ = normalizeLineEndings(content)
+	lines := strings.Split(content, "\n")
+	if line < 0 || line >= len(lines) {
+		return fmt.Errorf("%w: cursor line %d outside file with %d lines", ErrInvalidRequest, line, len(lines))
+	}
+	if col < 0 || col > len(lines[line]) {
+		return fmt.Errorf("%w: cursor column %d outside line %d of length %d", ErrInvalidRequest, col, line, len(lines[line]))
+	}
+	return nil
+}
+
+// cursorContent returns content as cursor lines and columns count it, with
+// its original line ending. With normalize, CRLF and lone CR endings become
+// LF; otherwise lines are split on LF alone and keep any CR. Every split at
+// the cursor uses it, so NormalizeLineEndings applies to all of them alike.
+func cursorContent(content string, normalize bool) (string, string) {
+	if !normalize {
+		return content, "\n"
+	}
+	return normalizeLineEndings(content)
+}
+
+// extractPrefixSuffix splits file content at cursor position. Columns are
+// byte offsets within the line. A cursor past the end of a line is clamped
+// to the end of that line, and a cursor past the last line is treated as
+// end-of-file, so the whole file becomes the prefix. Negative positions
+// clamp to the start, and a column inside a multibyte rune moves back to
+// the rune's start.
+//
+// It never panics, and prefix+suffix is always exactly content.
 func extractPrefixSuffix(content string, line, col int) (prefix, suffix string) {
 	lines := strings.Split(content, "\n")
 
 	if line < 0 {
 		line = 0
 	}
+	if col < 0 {
+		col = 0
+	}
 	if line >= len(lines) {
 		line = len(lines) - 1
+		col = len(lines[line])
 	}
-	if col < 0 {
-		col = 0
+	if col > len(lines[line]) {
+		col = len(lines[line])
+	}
+	for col > 0 && col < len(lines[line]) && !utf8.RuneStart(lines[line][col]) {
+		col--
 	}
 
 	// Prefix: everything before cursor
-	prefixLines := lines[:line]
-	if line < len(lines) && col < len(lines[line]) {
-		prefixLines = append(prefixLines, lines[line][:col])
-	}
+	prefixLines := append(lines[:line:line], lines[line][:col])
 	prefix = strings.Join(prefixLines, "\n")
 
 	// Suffix: everything after cursor
-	var suffixLines []string
-	if line < len(lines) && col < len(lines[line]) {
-		suffixLines = append(suffixLines, lines[line][col:])
-	}
-	if line+1 < len(lines) {
-		suffixLines = append(suffixLines, lines[line+1:]...)
-	}
+	suffixLines := append([]string{lines[line][col:]}, lines[line+1:]...)
 	suffix = strings.Join(suffixLines, "\n")
 
 	return prefix, suffix
 }
 
-// gatherAgentsInstructions finds and reads AGENTS.md files
+// Position is a point in a file: a 0-based line, and a column both as a
+// byte offset within the line, as in CompletionRequest, and in runes
+type Position struct {
+	Line       int `json:"line"`
+	Column     int `json:"column"`
+	RuneColumn int `json:"runeColumn"`
+}
+
+// endPosition returns the position just past the end of text
+func endPosition(text string) Position {
+	lastLine := text[strings.LastIndexByte(text, '\n')+1:]
+	return Position{
+		Line:       strings.Count(text, "\n"),
+		Column:     len(lastLine),
+		RuneColumn: utf8.RuneCountInString(lastLine),
+	}
+}
+
+// gatherAgentsInstructions finds and reads AGENTS.md (or configured) files
 func (g *ContextGatherer) gatherAgentsInstructions(
 	baseDir, targetFile string,
 	projectGetter ProjectGetter,
 ) string {
-	dir := filepath.Dir(filepath.Join(baseDir, targetFile))
-	var instructions []string
+	chain := agentsChain(baseDir, targetFile, g.agentsFileNames, g.maxAgentsDepth, projectGetter)
+	if len(chain) == 0 {
+		return ""
+	}
 
-	for {
-		agentsPath := filepath.Join(dir, "AGENTS.md")
-		if content, err := projectGetter.ReadFile(agentsPath); err == nil {
-			instructions = append(instructions, string(content))
-		}
+	instructions := make([]string, 0, len(chain))
+	for _, f := range chain {
+		instructions = append(instructions, f.Content)
+	}
+	return strings.Join(instructions, "\n\n---\n\n")
+}
 
-		if dir == baseDir || dir == "/" || dir == "." {
-			break
+// expandAgentsVariables replaces the {{name}} variables agents instructions
+// may use: project_id, project_name (also the project ID, the only name the
+// service knows), language and file_path. Other {{...}} text is left as-is.
+func expandAgentsVariables(instructions string, req CompletionRequest) string {
+	if !strings.Contains(instructions, "{{") {
+		return instructions
+	}
+	return strings.NewReplacer(
+		"{{project_id}}", req.ProjectID,
+		"{{project_name}}", req.ProjectID,
+		"{{language}}", detectLanguage(req.FilePath),
+		"{{file_path}}", req.FilePath,
+	).Replace(instructions)
+}
+
+// defaultAgentsFileNames are the instruction files looked for when
+// Config.AgentsFileNames is empty
+var defaultAgentsFileNames = []string{"AGENTS.md"}
+
+// agentsChain walks from the target file's directory up to baseDir and
+// returns each instruction file found, nearest first. Within a directory,
+// files are checked in the order of fileNames, or defaultAgentsFileNames if
+// it is empty. The walk never leaves baseDir, and with maxDepth > 0 climbs
+// at most that many parent directories.
+func agentsChain(
+	baseDir, targetFile string,
+	fileNames []string,
+	maxDepth int,
+	projectGetter ProjectGetter,
+) []FileContext {
+	baseDir = filepath.Clean(baseDir)
+	dir := filepath.Dir(resolveFilePath(baseDir, targetFile))
+	if len(fileNames) == 0 {
+		fileNames = defaultAgentsFileNames
+	}
+	var chain []FileContext
+
+	for depth := 0; withinDir(baseDir, dir); depth++ {
+		for _, name := range fileNames {
+			agentsPath := filepath.Join(dir, name)
+			if content, err := projectGetter.ReadFile(agentsPath); err == nil {
+				chain = append(chain, FileContext{
+					Path:    agentsPath,
+					Content: string(content),
+				})
+			}
 		}
-		parent := filepath.Dir(dir)
-		if parent == dir {
+
+		if dir == baseDir || (maxDepth > 0 && depth >= maxDepth) {
 			break
 		}
-		dir = parent
+		dir = filepath.Dir(dir)
 	}
 
-	if len(instructions) == 0 {
-		return ""
-	}
+	return chain
+}
 
-	return strings.Join(instructions, "\n\n---\n\n")
+// withinDir reports whether path is dir or inside it
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
-// gatherDiscussionContext extracts recent discussion rounds
+// gatherDiscussionContext extracts recent discussion rounds. A project with
+// no discussion file yields "", but real read errors are returned. head is
+// the leading text truncation must keep: the first round and its separator
+// under first_and_recent, otherwise "".
 func (g *ContextGatherer) gatherDiscussionContext(
 	projectID string,
 	projectGetter ProjectGetter,
-) string {
+) (discussion, head string, err error) {
 	discussionFile, err := projectGetter.GetProjectDiscussionFile(projectID)
 	if err != nil {
-		return ""
+		if isNotFound(err) {
+			return "", "", nil
+		}
+		return "", "", WrapContextError("failed to locate discussion file", err)
+	}
+	if discussionFile == "" {
+		return "", "", nil
 	}
 
 	content, err := projectGetter.ReadFile(discussionFile)
 	if err != nil {
-		return ""
+		if isNotFound(err) {
+			return "", "", nil
+		}
+		return "", "", WrapFileAccessError("failed to read discussion file", err)
+	}
+
+	// Keep the last rounds of structured discussions
+	discussion = string(content)
+	if g.discussionFormat != "" && g.discussionFormat != DiscussionPlain {
+		rounds, err := parseDiscussionRounds(discussion, g.discussionFormat)
+		if err != nil {
+			return "", "", WrapContextError("failed to parse discussion file", err)
+		}
+		separator := "\n"
+		if g.discussionFormat == DiscussionMarkdown {
+			separator = "\n\n"
+		}
+		rounds = selectRounds(rounds, g.maxDiscussionRounds, g.roundPolicy)
+		discussion = strings.Join(rounds, separator)
+		if g.roundPolicy == RoundsFirstAndRecent && len(rounds) > 1 {
+			head = rounds[0] + separator
+		}
+	}
+
+	// Keep the most recent maxDiscussionChars; budget trimming may cut more
+	maxChars := g.maxDiscussionChars
+	if maxChars == 0 {
+		maxChars = defaultMaxDiscussionChars
+	}
+	if maxChars == NoDiscussionCap {
+		return discussion, head, nil
 	}
+	return truncateDiscussion(discussion, head, maxChars), head, nil
+}
 
-	// Extract last 3000 characters as simplified approach
-	str := string(content)
-	if len(str) > 3000 {
-		str = str[len(str)-3000:]
+// gatherRecentChanges fetches recent changes from a RecentChangesGetter
+func (g *ContextGatherer) gatherRecentChanges(
+	projectID string,
+	projectGetter ProjectGetter,
+) (string, error) {
+	changesGetter, ok := projectGetter.(RecentChangesGetter)
+	if !ok {
+		return "", nil
 	}
 
-	return str
+	changes, err := changesGetter.GetRecentChanges(projectID)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", WrapContextError("failed to get recent changes", err)
+	}
+	return changes, nil
 }
 
-// gatherAdditionalFiles collects context from additional files
+// gatherAdditionalFiles collects context from additional files, preferring
+// virtual content over disk. Paths already in seen are skipped, and newly
+// read paths are added to it. Disk reads run concurrently, at most
+// maxConcurrentReads at a time; results keep the order of filePaths and
+// unreadable files are skipped, with the error reported to the observer.
+// Reads not yet started when ctx is done are skipped too.
 func (g *ContextGatherer) gatherAdditionalFiles(
-	req CompletionRequest,
+	ctx context.Context,
+	projectID string,
+	filePaths []string,
 	baseDir string,
 	projectGetter ProjectGetter,
-) []FileContext {
-	var contexts []FileContext
+	virtual map[string]FileContext,
+	seen map[string]bool,
+) ([]FileContext, []ContextWarning) {
+	type slot struct {
+		path    string
+		absPath string
+		content string
+		tokens  int
+		ok      bool
+		skipped bool // not read, as the deadline had passed
+		binary  bool
+		err     error
+	}
 
-	for _, filePath := range req.ContextFiles {
-		absPath := resolveFilePath(baseDir, filePath)
-		content, err := projectGetter.ReadFile(absPath)
-		if err != nil {
+	var slots []*slot
+	for _, filePath := range filePaths {
+		absPath := filepath.Clean(resolveFilePath(baseDir, filePath))
+		if seen[absPath] {
+			continue
+		}
+		seen[absPath] = true
+
+		sl := &slot{path: filePath, absPath: absPath}
+		if f, ok := virtual[absPath]; ok {
+			sl.content, sl.tokens, sl.ok = f.Content, f.Tokens, true
+		}
+		slots = append(slots, sl)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentReads)
+	for _, sl := range slots {
+		if sl.ok {
 			continue
 		}
+		wg.Add(1)
+		go func(sl *slot) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
 
+			if ctx.Err() != nil {
+				sl.skipped = true
+				return
+			}
+			content, err := projectGetter.ReadFile(sl.absPath)
+			if err != nil {
+				sl.err = err
+				return
+			}
+			if isBinary(content) {
+				sl.binary = true
+				return
+			}
+			sl.content, sl.ok = string(content), true
+		}(sl)
+	}
+	wg.Wait()
+
+	var contexts []FileContext
+	var warnings []ContextWarning
+	for _, sl := range slots {
+		if !sl.ok {
+			switch {
+			case sl.skipped:
+				warnings = append(warnings, ContextWarning{Path: sl.path, Kind: WarningSkipped, Message: deadlineSkipMessage})
+			case sl.binary:
+				warnings = append(warnings, ContextWarning{Path: sl.path, Kind: WarningSkipped, Message: binarySkipMessage})
+			default:
+				g.sectionFailed(projectID, "file:"+sl.path, sl.err)
+				warnings = append(warnings, ContextWarning{Path: sl.path, Kind: WarningUnreadable, Message: unreadableMessage(sl.err)})
+			}
+			continue
+		}
 		contexts = append(contexts, FileContext{
-			Path:    filePath,
-			Content: string(content),
+			Path:    sl.path,
+			Content: sl.content,
+			Tokens:  sl.tokens,
 		})
 	}
 
-	return contexts
+	return contexts, warnings
 }
 
-// trimToTokenBudget ensures context fits within token budget
-func (g *ContextGatherer) trimToTokenBudget(ctx *CompletionContext) {
-	// Simplified: estimate tokens as ~4 chars per token
-	estimateTokens := func(s string) int {
-		return len(s) / 4
+// binarySniffBytes is how much of a file isBinary inspects
+const binarySniffBytes = 8000
+
+// isBinary reports whether content looks like something other than text:
+// a NUL byte, or more than one in ten runes invalid UTF-8, in its first
+// binarySniffBytes
+func isBinary(content []byte) bool {
+	if len(content) > binarySniffBytes {
+		content = content[:binarySniffBytes]
+	}
+	runes, invalid := 0, 0
+	for i := 0; i < len(content); {
+		if content[i] == 0 {
+			return true
+		}
+		r, size := utf8.DecodeRune(content[i:])
+		if r == utf8.RuneError && size == 1 && utf8.FullRune(content[i:]) {
+			invalid++
+		}
+		runes++
+		i += size
+	}
+	return invalid*10 > runes
+}
+
+// dropDuplicateFiles removes context files whose significant lines largely
+// repeat the target file's, with a warning for each. Files for which exempt
+// returns true are always kept.
+func dropDuplicateFiles(files []FileContext, target string, exempt func(FileContext) bool) ([]FileContext, []ContextWarning) {
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	targetLines := make(map[string]bool)
+	for _, line := range strings.Split(target, "\n") {
+		if line = strings.TrimSpace(line); significantLine(line) {
+			targetLines[line] = true
+		}
+	}
+
+	kept := files[:0]
+	var warnings []ContextWarning
+	for _, file := range files {
+		if exempt(file) {
+			kept = append(kept, file)
+			continue
+		}
+		total, shared := 0, 0
+		for _, line := range strings.Split(file.Content, "\n") {
+			if line = strings.TrimSpace(line); !significantLine(line) {
+				continue
+			}
+			total++
+			if targetLines[line] {
+				shared++
+			}
+		}
+		if total >= duplicateMinLines && float64(shared) >= duplicateThreshold*float64(total) {
+			warnings = append(warnings, ContextWarning{Path: file.Path, Kind: WarningSkipped, Message: "mostly repeats the target file"})
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept, warnings
+}
+
+// significantLine reports whether a trimmed line says enough to count
+// towards duplicate detection: not blank, not only brackets and
+// punctuation, and not a package clause that most files in a package share
+func significantLine(line string) bool {
+	if strings.HasPrefix(line, "package ") {
+		return false
+	}
+	return strings.IndexFunc(line, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) >= 0
+}
+
+// TrimReport records how context was trimmed to fit the token budget
+type TrimReport struct {
+	BudgetTokens int           `json:"budgetTokens"`
+	BeforeTokens int           `json:"beforeTokens"`
+	AfterTokens  int           `json:"afterTokens"`
+	Sections     []SectionTrim `json:"sections"`
+}
+
+// SectionTrim records the estimated tokens of one section before and after trimming
+type SectionTrim struct {
+	Section      string `json:"section"`
+	BeforeTokens int    `json:"beforeTokens"`
+	AfterTokens  int    `json:"afterTokens"`
+}
+
+func (r *TrimReport) add(section string, before, after int) {
+	r.Sections = append(r.Sections, SectionTrim{
+		Section:      section,
+		BeforeTokens: before,
+		AfterTokens:  after,
+	})
+}
+
+// estimateTokens estimates tokens as ~4 chars per token
+func estimateTokens(s string) int {
+	return len(s) / 4
+}
+
+// knownOrEstimated returns known if it is set, otherwise estimates the
+// tokens of s
+func knownOrEstimated(s string, known int) int {
+	if known > 0 {
+		return known
 	}
+	return estimateTokens(s)
+}
+
+// runesForTokens converts a token budget to a rune count of s, at s's own
+// runes per token when its token count is known and ~4 otherwise
+func runesForTokens(s string, known, budget int) int {
+	if known <= 0 {
+		return budget * 4
+	}
+	return budget * utf8.RuneCountInString(s) / known
+}
 
-	currentTokens := estimateTokens(ctx.Prefix) +
-		estimateTokens(ctx.Suffix) +
+// trimmedTokens scales a known token count from before to the part of it
+// kept after trimming. Unknown counts stay unknown.
+func trimmedTokens(known int, before, after string) int {
+	runes := utf8.RuneCountInString(before)
+	if known <= 0 || runes == 0 {
+		return 0
+	}
+	return known * utf8.RuneCountInString(after) / runes
+}
+
+// contextTokens estimates the total tokens of all context sections, using
+// known counts where the host supplied them
+func contextTokens(ctx *CompletionContext) int {
+	total := estimateTokens(ctx.Preamble) +
+		knownOrEstimated(ctx.Prefix, ctx.PrefixTokens) +
+		knownOrEstimated(ctx.Suffix, ctx.SuffixTokens) +
 		estimateTokens(ctx.AgentsInstructions) +
-		estimateTokens(ctx.DiscussionContext)
+		estimateTokens(ctx.DiscussionContext) +
+		estimateTokens(ctx.RecentChanges) +
+		estimateTokens(ctx.RepoMap) +
+		estimateTokens(ctx.Instruction)
 
+	for _, f := range ctx.OpenFiles {
+		total += f.tokens()
+	}
 	for _, f := range ctx.AdditionalFiles {
-		currentTokens += estimateTokens(f.Content)
+		total += f.tokens()
+	}
+	for _, section := range ctx.ProviderSections {
+		total += estimateTokens(section.Content)
+	}
+	return total
+}
+
+// defaultPrefixRatio is the share of the code budget kept before the cursor
+// when Config.PrefixRatio is unset
+const defaultPrefixRatio = 0.7
+
+// Sections for Config.TrimOrder
+const (
+	TrimDiscussion = "discussion" // cap the discussion at its most recent part
+	TrimChanges    = "changes"    // cap recent changes
+	TrimAgents     = "agents"     // cap agents instructions
+	TrimFiles      = "files"      // drop related files, last first
+	TrimProviders  = "providers"  // drop context provider sections, last first
+	TrimOpenFiles  = "open_files" // drop open files, last first
+	TrimCode       = "code"       // cut prefix and suffix, split by PrefixRatio
+	TrimPrefix     = "prefix"     // cut the start of the prefix
+	TrimSuffix     = "suffix"     // cut the end of the suffix
+	TrimRepoMap    = "repo_map"   // drop repo map outlines, last first
+	TrimPreamble   = "preamble"   // cut the end of the preamble
+)
+
+// defaultTrimOrder keeps prefix/suffix over optional context, the repo map
+// included, and the preamble, which is high priority, over everything
+var defaultTrimOrder = []string{
+	TrimDiscussion, TrimChanges, TrimAgents, TrimFiles, TrimProviders,
+	TrimOpenFiles, TrimRepoMap, TrimCode, TrimPreamble,
+}
+
+// validTrimSection reports whether section names a trimming step
+func validTrimSection(section string) bool {
+	if section == TrimPrefix || section == TrimSuffix {
+		return true
+	}
+	for _, s := range defaultTrimOrder {
+		if section == s {
+			return true
+		}
 	}
+	return false
+}
 
+// trimToTokenBudget ensures context fits within token budget, recording
+// what it trimmed in ctx.Trim. Sections are trimmed in trimOrder (or
+// defaultTrimOrder) until the context fits; sections not listed are kept.
+func (g *ContextGatherer) trimToTokenBudget(ctx *CompletionContext) {
+	currentTokens := contextTokens(ctx)
 	if currentTokens <= g.maxTokens {
 		return
 	}
 
-	// Priority: Keep prefix/suffix, trim discussion and agents
-	if estimateTokens(ctx.DiscussionContext) > 1000 {
-		ctx.DiscussionContext = ctx.DiscussionContext[len(ctx.DiscussionContext)-1000:]
+	report := &TrimReport{
+		BudgetTokens: g.maxTokens,
+		BeforeTokens: currentTokens,
+	}
+
+	order := g.trimOrder
+	if len(order) == 0 {
+		order = defaultTrimOrder
+	}
+	for _, section := range order {
+		if contextTokens(ctx) <= g.maxTokens {
+			break
+		}
+		g.trimSection(ctx, section, report)
+	}
+
+	report.AfterTokens = contextTokens(ctx)
+	ctx.Trim = report
+}
+
+// trimSection runs one trimming step, recording what it cut in report
+func (g *ContextGatherer) trimSection(ctx *CompletionContext, section string, report *TrimReport) {
+	switch section {
+	case TrimDiscussion:
+		if before := estimateTokens(ctx.DiscussionContext); before > 1000 {
+			ctx.DiscussionContext = truncateDiscussion(ctx.DiscussionContext, ctx.discussionHead, 1000)
+			report.add("discussion", before, estimateTokens(ctx.DiscussionContext))
+		}
+	case TrimChanges:
+		if before := estimateTokens(ctx.RecentChanges); before > 1000 {
+			ctx.RecentChanges = truncateHead(ctx.RecentChanges, 1000)
+			report.add("changes", before, estimateTokens(ctx.RecentChanges))
+		}
+	case TrimAgents:
+		if before := estimateTokens(ctx.AgentsInstructions); before > 2000 {
+			ctx.AgentsInstructions = truncateHead(ctx.AgentsInstructions, 2000)
+			report.add("agents", before, estimateTokens(ctx.AgentsInstructions))
+		}
+
+	case TrimFiles:
+		for len(ctx.AdditionalFiles) > 0 && contextTokens(ctx) > g.maxTokens {
+			last := ctx.AdditionalFiles[len(ctx.AdditionalFiles)-1]
+			ctx.AdditionalFiles = ctx.AdditionalFiles[:len(ctx.AdditionalFiles)-1]
+			report.add("file:"+last.Path, last.tokens(), 0)
+		}
+	case TrimProviders:
+		for len(ctx.ProviderSections) > 0 && contextTokens(ctx) > g.maxTokens {
+			last := ctx.ProviderSections[len(ctx.ProviderSections)-1]
+			ctx.ProviderSections = ctx.ProviderSections[:len(ctx.ProviderSections)-1]
+			report.add("provider:"+last.Name, estimateTokens(last.Content), 0)
+		}
+	case TrimOpenFiles:
+		for len(ctx.OpenFiles) > 0 && contextTokens(ctx) > g.maxTokens {
+			last := ctx.OpenFiles[len(ctx.OpenFiles)-1]
+			ctx.OpenFiles = ctx.OpenFiles[:len(ctx.OpenFiles)-1]
+			report.add("open_file:"+last.Path, last.tokens(), 0)
+		}
+
+	case TrimCode:
+		// Cut the far ends of prefix/suffix, split by prefixRatio, keeping
+		// the lines nearest the cursor
+		prefixTokens := knownOrEstimated(ctx.Prefix, ctx.PrefixTokens)
+		suffixTokens := knownOrEstimated(ctx.Suffix, ctx.SuffixTokens)
+		available := g.maxTokens - (contextTokens(ctx) - prefixTokens - suffixTokens)
+		if available < 0 {
+			available = 0
+		}
+		ratio := g.prefixRatio
+		if ratio <= 0 {
+			ratio = defaultPrefixRatio
+		}
+		// A side shorter than its share gives the rest to the other side
+		prefixBudget := int(float64(available) * ratio)
+		if prefixTokens < prefixBudget {
+			prefixBudget = prefixTokens
+		} else if suffixTokens < available-prefixBudget {
+			prefixBudget = available - suffixTokens
+		}
+		g.trimPrefix(ctx, prefixBudget, report)
+		g.trimSuffix(ctx, available-prefixBudget, report)
+	case TrimPrefix:
+		prefixTokens := knownOrEstimated(ctx.Prefix, ctx.PrefixTokens)
+		g.trimPrefix(ctx, max(prefixTokens-(contextTokens(ctx)-g.maxTokens), 0), report)
+	case TrimSuffix:
+		suffixTokens := knownOrEstimated(ctx.Suffix, ctx.SuffixTokens)
+		g.trimSuffix(ctx, max(suffixTokens-(contextTokens(ctx)-g.maxTokens), 0), report)
+
+	case TrimRepoMap:
+		for ctx.RepoMap != "" && contextTokens(ctx) > g.maxTokens {
+			before := estimateTokens(ctx.RepoMap)
+			var path string
+			ctx.RepoMap, path = dropLastOutline(ctx.RepoMap)
+			report.add("repo_map:"+path, before-estimateTokens(ctx.RepoMap), 0)
+		}
+	case TrimPreamble:
+		if over := contextTokens(ctx) - g.maxTokens; over > 0 && ctx.Preamble != "" {
+			before := estimateTokens(ctx.Preamble)
+			keep := utf8.RuneCountInString(ctx.Preamble) - over*4
+			ctx.Preamble = truncateHead(ctx.Preamble, keep)
+			report.add("preamble", before, estimateTokens(ctx.Preamble))
+		}
+	}
+}
+
+// trimPrefix cuts the start of the prefix to about budget tokens, keeping
+// the import block and package declaration if configured
+func (g *ContextGatherer) trimPrefix(ctx *CompletionContext, budget int, report *TrimReport) {
+	prefixTokens := knownOrEstimated(ctx.Prefix, ctx.PrefixTokens)
+	if prefixTokens <= budget {
+		return
+	}
+	before := ctx.Prefix
+	maxRunes := runesForTokens(before, ctx.PrefixTokens, budget)
+	ctx.Prefix = windowPrefix(before, ctx.Language, maxRunes, g.keepImports, g.keepPackage)
+	ctx.PrefixTokens = trimmedTokens(ctx.PrefixTokens, before, ctx.Prefix)
+	report.add("prefix", prefixTokens, knownOrEstimated(ctx.Prefix, ctx.PrefixTokens))
+}
+
+// trimSuffix cuts the end of the suffix to about budget tokens
+func (g *ContextGatherer) trimSuffix(ctx *CompletionContext, budget int, report *TrimReport) {
+	suffixTokens := knownOrEstimated(ctx.Suffix, ctx.SuffixTokens)
+	if suffixTokens <= budget {
+		return
+	}
+	before := ctx.Suffix
+	ctx.Suffix = keepSuffixHead(before, runesForTokens(before, ctx.SuffixTokens, budget))
+	ctx.SuffixTokens = trimmedTokens(ctx.SuffixTokens, before, ctx.Suffix)
+	report.add("suffix", suffixTokens, knownOrEstimated(ctx.Suffix, ctx.SuffixTokens))
+}
+
+// keepPrefixTail keeps about maxRunes of the end of prefix, dropping whole
+// lines from the start where possible
+func keepPrefixTail(prefix string, maxRunes int) string {
+	if utf8.RuneCountInString(prefix) <= maxRunes {
+		return prefix
+	}
+	kept := truncateTail(prefix, maxRunes)
+	if i := strings.IndexByte(kept, '\n'); i >= 0 {
+		kept = kept[i+1:]
+	}
+	return kept
+}
+
+// keepSuffixHead keeps about maxRunes of the start of suffix, dropping whole
+// lines from the end where possible
+func keepSuffixHead(suffix string, maxRunes int) string {
+	if utf8.RuneCountInString(suffix) <= maxRunes {
+		return suffix
 	}
-	if estimateTokens(ctx.AgentsInstructions) > 2000 {
-		ctx.AgentsInstructions = ctx.AgentsInstructions[:2000]
+	kept := truncateHead(suffix, maxRunes)
+	if i := strings.LastIndexByte(kept, '\n'); i >= 0 {
+		kept = kept[:i]
 	}
+	return kept
 }
 
 // detectLanguage infers programming language from file extension
@@ -0,0 +1,993 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestExtractPrefixSuffixEdges(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		line, col  int
+		wantPrefix string
+		wantSuffix string
+	}{
+		{"empty file", "", 0, 0, "", ""},
+		{"empty file past end", "", 3, 5, "", ""},
+		{"end of last line without newline", "a\nbc", 1, 2, "a\nbc", ""},
+		{"end of last line with newline", "a\nbc\n", 2, 0, "a\nbc\n", ""},
+		{"cursor past last line", "a\nbc", 7, 0, "a\nbc", ""},
+		{"column past end of line", "abc\nd", 0, 10, "abc", "\nd"},
+		{"column inside a multibyte rune", "héllo", 0, 2, "h", "éllo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, suffix := extractPrefixSuffix(tt.content, tt.line, tt.col)
+			if prefix != tt.wantPrefix || suffix != tt.wantSuffix {
+				t.Errorf("extractPrefixSuffix(%q, %d, %d) = %q, %q; want %q, %q",
+					tt.content, tt.line, tt.col, prefix, suffix, tt.wantPrefix, tt.wantSuffix)
+			}
+		})
+	}
+}
+
+func FuzzExtractPrefixSuffix(f *testing.F) {
+	f.Add("package main\n\nfunc main() {\n}\n", 2, 13)
+	f.Add("", 3, 5)
+	f.Add("\n\n\n", -1, -1)
+	f.Add("héllo\nwörld", 1, 2)
+	f.Add("a\r\nb", 0, 1<<30)
+	f.Fuzz(func(t *testing.T, content string, line, col int) {
+		prefix, suffix := extractPrefixSuffix(content, line, col)
+		if prefix+suffix != content {
+			t.Fatalf("extractPrefixSuffix(%q, %d, %d) = %q, %q; does not rebuild the content", content, line, col, prefix, suffix)
+		}
+		if utf8.ValidString(content) && (!utf8.ValidString(prefix) || !utf8.ValidString(suffix)) {
+			t.Fatalf("extractPrefixSuffix(%q, %d, %d) = %q, %q; split a rune", content, line, col, prefix, suffix)
+		}
+	})
+}
+
+func TestRequestSkipFlags(t *testing.T) {
+	const agents, discussion = "AGENTS-MARKER", "DISCUSSION-MARKER"
+	tests := []struct {
+		name                    string
+		skipAgents, skipDiscuss bool
+		wantAgents, wantDiscuss bool
+	}{
+		{"no skip", false, false, true, true},
+		{"skip agents", true, false, false, true},
+		{"skip discussion", false, true, true, false},
+		{"skip both", true, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{
+				"main.go":       "package main\n",
+				"AGENTS.md":     agents,
+				"discussion.md": discussion,
+			})
+			pg.discussion = "discussion.md"
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, testConfig(), client)
+
+			req := CompletionRequest{
+				ProjectID:              "p",
+				FilePath:               "main.go",
+				CursorLine:             1,
+				SkipAgentsInstructions: tt.skipAgents,
+				SkipDiscussion:         tt.skipDiscuss,
+			}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			prompt := client.lastPrompt()
+			if got := strings.Contains(prompt, agents); got != tt.wantAgents {
+				t.Errorf("AGENTS.md in prompt = %t, want %t", got, tt.wantAgents)
+			}
+			if got := strings.Contains(prompt, discussion); got != tt.wantDiscuss {
+				t.Errorf("discussion in prompt = %t, want %t", got, tt.wantDiscuss)
+			}
+		})
+	}
+}
+
+func TestAgentsChainFileNames(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"AGENTS.md":          "agents",
+		"CONVENTIONS.md":     "conventions",
+		"pkg/.cursorrules":   "cursor",
+		"pkg/CONVENTIONS.md": "pkg conventions",
+		"pkg/file.go":        "package pkg\n",
+	})
+	tests := []struct {
+		name      string
+		fileNames []string
+		want      []string
+	}{
+		{"default", nil, []string{"agents"}},
+		{"conventions only", []string{"CONVENTIONS.md"}, []string{"pkg conventions", "conventions"}},
+		{"list order within a directory", []string{".cursorrules", "CONVENTIONS.md"}, []string{"cursor", "pkg conventions", "conventions"}},
+		{"no such file", []string{"CLAUDE.md"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range agentsChain(testBaseDir, "pkg/file.go", tt.fileNames, 0, pg) {
+				got = append(got, f.Content)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("chain contents = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgentsChainDepth(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"/AGENTS.md":          "outside the project",
+		"AGENTS.md":           "root",
+		"a/AGENTS.md":         "a",
+		"a/b/AGENTS.md":       "b",
+		"a/b/c/AGENTS.md":     "c",
+		"a/b/c/d/AGENTS.md":   "d",
+		"a/b/c/d/e/file.go":   "package e\n",
+		"a/b/c/d/e/AGENTS.md": "e",
+	})
+	tests := []struct {
+		name     string
+		baseDir  string
+		maxDepth int
+		want     []string
+	}{
+		{"up to baseDir", testBaseDir, 0, []string{"e", "d", "c", "b", "a", "root"}},
+		{"trailing slash on baseDir", testBaseDir + "/", 0, []string{"e", "d", "c", "b", "a", "root"}},
+		{"depth limit", testBaseDir, 2, []string{"e", "d", "c"}},
+		{"limit beyond baseDir", testBaseDir, 20, []string{"e", "d", "c", "b", "a", "root"}},
+		{"nested baseDir", testBaseDir + "/a/b", 0, []string{"e", "d", "c", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range agentsChain(tt.baseDir, testBaseDir+"/a/b/c/d/e/file.go", nil, tt.maxDepth, pg) {
+				got = append(got, f.Content)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("chain contents = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("target outside baseDir", func(t *testing.T) {
+		if chain := agentsChain(testBaseDir+"/a/b", testBaseDir+"/a/file.go", nil, 0, pg); len(chain) != 0 {
+			t.Errorf("chain = %+v, want nothing read outside baseDir", chain)
+		}
+	})
+}
+
+func TestAgentsVariables(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"AGENTS.md":   "Write idiomatic {{language}} for {{project_name}} ({{file_path}}); keep {{unknown}} and {{ language }}.",
+		"pkg/file.py": "import os\n",
+	})
+	req := CompletionRequest{ProjectID: "storm", FilePath: "pkg/file.py", CursorLine: 1}
+	ctx, err := newGatherer(testConfig()).GatherContext(context.Background(), req, pg.files["pkg/file.py"], pg)
+	if err != nil {
+		t.Fatalf("GatherContext: %v", err)
+	}
+	want := "Write idiomatic Python for storm (pkg/file.py); keep {{unknown}} and {{ language }}."
+	if ctx.AgentsInstructions != want {
+		t.Errorf("AgentsInstructions = %q, want %q", ctx.AgentsInstructions, want)
+	}
+}
+
+func TestTrimReport(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"main.go": "package main\n\nfunc main() {\n}\n",
+		"util.go": strings.Repeat("// util helper line\n", 100),
+	})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, ContextFiles: []string{"util.go"}}
+
+	tests := []struct {
+		name        string
+		maxTokens   int
+		wantTrimmed []string // section name prefixes expected in the report
+	}{
+		{"ample budget", 100000, nil},
+		{"tight budget", 200, []string{"file:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gatherer := &ContextGatherer{maxTokens: tt.maxTokens}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			if tt.wantTrimmed == nil {
+				if ctx.Trim != nil {
+					t.Errorf("Trim = %+v, want nil", ctx.Trim)
+				}
+				return
+			}
+			if ctx.Trim == nil {
+				t.Fatal("Trim is nil with a tight budget")
+			}
+			if ctx.Trim.AfterTokens >= ctx.Trim.BeforeTokens {
+				t.Errorf("AfterTokens %d not below BeforeTokens %d", ctx.Trim.AfterTokens, ctx.Trim.BeforeTokens)
+			}
+			for _, want := range tt.wantTrimmed {
+				found := false
+				for _, section := range ctx.Trim.Sections {
+					if strings.HasPrefix(section.Section, want) && section.AfterTokens < section.BeforeTokens {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("report %+v has no trimmed %q section", ctx.Trim.Sections, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimOrder(t *testing.T) {
+	agents := strings.Repeat("a", 3000*4)
+	discussion := strings.Repeat("d", 1500*4)
+
+	tests := []struct {
+		name           string
+		order          []string
+		wantAgents     int // tokens left after trimming
+		wantDiscussion int
+	}{
+		{"default order", nil, 3000, 250},
+		{"agents before discussion", []string{TrimAgents, TrimDiscussion}, 500, 1500},
+		{"unlisted sections are kept", []string{TrimFiles}, 3000, 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gatherer := &ContextGatherer{maxTokens: 3600, trimOrder: tt.order}
+			ctx := &CompletionContext{AgentsInstructions: agents, DiscussionContext: discussion}
+			gatherer.trimToTokenBudget(ctx)
+
+			if got := estimateTokens(ctx.AgentsInstructions); got != tt.wantAgents {
+				t.Errorf("agents tokens = %d, want %d", got, tt.wantAgents)
+			}
+			if got := estimateTokens(ctx.DiscussionContext); got != tt.wantDiscussion {
+				t.Errorf("discussion tokens = %d, want %d", got, tt.wantDiscussion)
+			}
+		})
+	}
+}
+
+func TestTrimOrderRepoMapBeforeCode(t *testing.T) {
+	repoMap := buildRepoMap([]FileContext{
+		{Path: "a.go", Content: "package main\n\n" + strings.Repeat("func A() {}\n", 100)},
+		{Path: "b.go", Content: "package main\n\n" + strings.Repeat("func B() {}\n", 100)},
+	})
+	prefix := strings.Repeat("p", 400*4)
+	suffix := strings.Repeat("s", 100*4)
+	mapTokens := estimateTokens(repoMap)
+
+	// Over budget by less than the repo map, so dropping it is enough
+	gatherer := &ContextGatherer{maxTokens: 500 + mapTokens/2}
+	ctx := &CompletionContext{Prefix: prefix, Suffix: suffix, RepoMap: repoMap}
+	gatherer.trimToTokenBudget(ctx)
+
+	if ctx.Prefix != prefix || ctx.Suffix != suffix {
+		t.Errorf("code was cut to %d+%d tokens while the repo map could go", estimateTokens(ctx.Prefix), estimateTokens(ctx.Suffix))
+	}
+	if got := estimateTokens(ctx.RepoMap); got >= mapTokens {
+		t.Errorf("repo map tokens = %d, want fewer than %d", got, mapTokens)
+	}
+	if got := contextTokens(ctx); got > gatherer.maxTokens {
+		t.Errorf("context is %d tokens, over the %d budget", got, gatherer.maxTokens)
+	}
+}
+
+func TestKnownTokenCounts(t *testing.T) {
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	fileContent := strings.Repeat("var x = 1\n", 40) // ~100 estimated tokens
+	tests := []struct {
+		name        string
+		knownTokens int // a.go's known count; 0 means estimate
+		wantBefore  int
+		wantDropped []SectionTrim
+	}{
+		{"estimated", 0, 3 + 100 + 100, []SectionTrim{{"file:b.go", 100, 0}}},
+		{"known below estimate", 10, 50 + 10 + 100, nil},
+		{"known above estimate", 300, 50 + 300 + 100, []SectionTrim{{"file:b.go", 100, 0}, {"file:a.go", 300, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := CompletionRequest{
+				ProjectID:  "p",
+				FilePath:   "main.go",
+				CursorLine: 1,
+				VirtualFiles: []FileContext{
+					{Path: "a.go", Content: fileContent, Tokens: tt.knownTokens},
+					{Path: "b.go", Content: fileContent},
+				},
+			}
+			if tt.knownTokens > 0 {
+				req.PrefixTokens = 50
+			}
+			gatherer := &ContextGatherer{maxTokens: 180}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+
+			if tt.wantDropped == nil {
+				if ctx.Trim != nil {
+					t.Errorf("Trim = %+v, want nil", ctx.Trim)
+				}
+				if len(ctx.AdditionalFiles) != 2 {
+					t.Errorf("kept %d files, want both", len(ctx.AdditionalFiles))
+				}
+				return
+			}
+			if ctx.Trim == nil {
+				t.Fatal("Trim is nil, want files dropped")
+			}
+			if ctx.Trim.BeforeTokens != tt.wantBefore {
+				t.Errorf("BeforeTokens = %d, want %d", ctx.Trim.BeforeTokens, tt.wantBefore)
+			}
+			if fmt.Sprint(ctx.Trim.Sections) != fmt.Sprint(tt.wantDropped) {
+				t.Errorf("Sections = %+v, want %+v", ctx.Trim.Sections, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestOpenFiles(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"main.go":  "package main\n",
+		"open.go":  strings.Repeat("// open helper line\n", 20),
+		"other.go": strings.Repeat("// other helper line\n", 20),
+	})
+	req := CompletionRequest{
+		ProjectID:    "p",
+		FilePath:     "main.go",
+		CursorLine:   1,
+		OpenFiles:    []string{"open.go"},
+		ContextFiles: []string{"open.go", "other.go"},
+	}
+
+	gatherer := &ContextGatherer{maxTokens: 10000}
+	ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+	if err != nil {
+		t.Fatalf("GatherContext: %v", err)
+	}
+	if len(ctx.OpenFiles) != 1 || len(ctx.AdditionalFiles) != 1 || ctx.AdditionalFiles[0].Path != "other.go" {
+		t.Fatalf("open files %v, related files %v; want open.go once, in its own section", ctx.OpenFiles, ctx.AdditionalFiles)
+	}
+	prompt := (&FIMFormatter{}).FormatPrompt(ctx)
+	if !strings.Contains(prompt, "OPEN FILES:\n\n--- open.go ---\n") {
+		t.Errorf("prompt has no open files section:\n%s", prompt)
+	}
+
+	// A budget with room for one file keeps the open one
+	gatherer.maxTokens = 150
+	ctx, err = gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+	if err != nil {
+		t.Fatalf("GatherContext: %v", err)
+	}
+	if len(ctx.OpenFiles) != 1 || len(ctx.AdditionalFiles) != 0 {
+		t.Errorf("open files %v, related files %v after trimming; want only open.go", ctx.OpenFiles, ctx.AdditionalFiles)
+	}
+}
+
+func TestFastPathForTinyFiles(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		contextFiles   []string
+		wantDiscussion bool
+	}{
+		{"tiny file", "package main\n", nil, false},
+		{"tiny file with context files", "package main\n", []string{"util.go"}, true},
+		{"large file", "package main\n\n" + strings.Repeat("var x = 1\n", 50), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{
+				"main.go":       tt.content,
+				"util.go":       "package main\n\nfunc util() {}\n",
+				"AGENTS.md":     "use tabs",
+				"discussion.md": "notes",
+			})
+			pg.discussion = "discussion.md"
+			config := testConfig()
+			config.FastPathMaxBytes = 256
+			gatherer := newGatherer(config)
+
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, ContextFiles: tt.contextFiles}
+			ctx, err := gatherer.GatherContext(context.Background(), req, tt.content, pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			if ctx.AgentsInstructions != "use tabs" {
+				t.Errorf("AgentsInstructions = %q, want them kept", ctx.AgentsInstructions)
+			}
+			if gathered := pg.readCount("discussion.md") > 0; gathered != tt.wantDiscussion {
+				t.Errorf("discussion gathered = %t, want %t", gathered, tt.wantDiscussion)
+			}
+			if (ctx.DiscussionContext != "") != tt.wantDiscussion {
+				t.Errorf("DiscussionContext = %q, want present %t", ctx.DiscussionContext, tt.wantDiscussion)
+			}
+		})
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		wantNormalized string
+		wantEnding     string
+	}{
+		{"lf", "a\nb\n", "a\nb\n", "\n"},
+		{"crlf", "a\r\nb\r\n", "a\nb\n", "\r\n"},
+		{"lone cr", "a\rb\r", "a\nb\n", "\r"},
+		{"mostly crlf", "a\r\nb\r\nc\n", "a\nb\nc\n", "\r\n"},
+		{"mostly lf", "a\nb\nc\r\n", "a\nb\nc\n", "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normalized, ending := normalizeLineEndings(tt.content)
+			if normalized != tt.wantNormalized || ending != tt.wantEnding {
+				t.Errorf("normalizeLineEndings(%q) = %q, %q; want %q, %q",
+					tt.content, normalized, ending, tt.wantNormalized, tt.wantEnding)
+			}
+		})
+	}
+}
+
+func TestCRLFPrefixSuffix(t *testing.T) {
+	pg := newFakeProject(map[string]string{"main.go": "package main\r\n\r\nfunc main() {\r\n\tx := 1\r\n}\r\n"})
+	gatherer := newGatherer(testConfig())
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 3}
+	ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+	if err != nil {
+		t.Fatalf("GatherContext: %v", err)
+	}
+	if want := "package main\n\nfunc main() {\n\tx "; ctx.Prefix != want {
+		t.Errorf("Prefix = %q, want %q", ctx.Prefix, want)
+	}
+	if want := ":= 1\n}\n"; ctx.Suffix != want {
+		t.Errorf("Suffix = %q, want %q", ctx.Suffix, want)
+	}
+	if ctx.LineEnding != "\r\n" {
+		t.Errorf("LineEnding = %q, want CRLF", ctx.LineEnding)
+	}
+}
+
+func TestAlwaysIncludeFiles(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"main.go":      "package main\n\nfunc main() {\n}\n",
+		"types.go":     "package main\n\ntype Order struct{ ID int }\n",
+		"helpers.go":   strings.Repeat("// helper\n", 100),
+		"unrelated.go": "package main\n",
+	})
+	tests := []struct {
+		name         string
+		contextFiles []string
+		maxTokens    int
+		wantPaths    []string
+	}{
+		{"no request files", nil, 10000, []string{"types.go"}},
+		{"deduped against request files", []string{"types.go", "unrelated.go"}, 10000, []string{"types.go", "unrelated.go"}},
+		{"kept over request files when trimming", []string{"helpers.go"}, 100, []string{"types.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gatherer := newGatherer(testConfig())
+			gatherer.alwaysInclude = []string{"types.go"}
+			gatherer.maxTokens = tt.maxTokens
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, ContextFiles: tt.contextFiles}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			var paths []string
+			for _, f := range ctx.AdditionalFiles {
+				paths = append(paths, f.Path)
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.wantPaths, ",") {
+				t.Errorf("context files = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestVirtualFilesShadowDisk(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"main.go":  "package main\n\nfunc main() {\n}\n",
+		"types.go": "package main\n\ntype OnDisk struct{}\n",
+	})
+	tests := []struct {
+		name         string
+		contextFiles []string
+		virtual      []FileContext
+		wantContent  string
+		wantReads    int
+	}{
+		{"disk only", []string{"types.go"}, nil, "type OnDisk", 1},
+		{"virtual shadows listed file", []string{"types.go"}, []FileContext{{Path: "types.go", Content: "type Unsaved struct{}\n"}}, "type Unsaved", 0},
+		{"virtual file not listed", nil, []FileContext{{Path: "types.go", Content: "type Unsaved struct{}\n"}}, "type Unsaved", 0},
+		{"absolute virtual path", []string{"types.go"}, []FileContext{{Path: testBaseDir + "/types.go", Content: "type Unsaved struct{}\n"}}, "type Unsaved", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg.reads = make(map[string]int)
+			gatherer := newGatherer(testConfig())
+			req := CompletionRequest{
+				ProjectID:    "p",
+				FilePath:     "main.go",
+				CursorLine:   2,
+				ContextFiles: tt.contextFiles,
+				VirtualFiles: tt.virtual,
+			}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			if len(ctx.AdditionalFiles) != 1 {
+				t.Fatalf("got %d context files, want 1: %+v", len(ctx.AdditionalFiles), ctx.AdditionalFiles)
+			}
+			if !strings.Contains(ctx.AdditionalFiles[0].Content, tt.wantContent) {
+				t.Errorf("types.go content = %q, want it to contain %q", ctx.AdditionalFiles[0].Content, tt.wantContent)
+			}
+			if got := pg.readCount("types.go"); got != tt.wantReads {
+				t.Errorf("types.go read %d times, want %d", got, tt.wantReads)
+			}
+		})
+	}
+}
+
+// changesProject is a fakeProject that is also a RecentChangesGetter
+type changesProject struct {
+	*fakeProject
+	changes string
+}
+
+func (p *changesProject) GetRecentChanges(projectID string) (string, error) {
+	return p.changes, nil
+}
+
+func TestRecentChanges(t *testing.T) {
+	diff := strings.Repeat("+added line\n-removed line\n", 400) // ~2500 tokens
+	tests := []struct {
+		name        string
+		maxTokens   int
+		wantTrimmed bool
+	}{
+		{"ample budget", 100000, false},
+		{"tight budget", 1500, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := &changesProject{
+				fakeProject: newFakeProject(map[string]string{"main.go": "package main\n"}),
+				changes:     diff,
+			}
+			config := testConfig()
+			config.IncludeRecentChanges = true
+			gatherer := newGatherer(config)
+			gatherer.maxTokens = tt.maxTokens
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+
+			if trimmed := ctx.RecentChanges != diff; trimmed != tt.wantTrimmed {
+				t.Errorf("changes trimmed = %t, want %t", trimmed, tt.wantTrimmed)
+			}
+			if !strings.HasPrefix(diff, ctx.RecentChanges) || ctx.RecentChanges == "" {
+				t.Errorf("trimmed changes are not a non-empty head of the diff")
+			}
+			if prompt := (&FIMFormatter{}).FormatPrompt(ctx); !strings.Contains(prompt, "RECENT CHANGES:\n+added line") {
+				t.Errorf("prompt has no RECENT CHANGES section:\n%.300s", prompt)
+			}
+		})
+	}
+}
+
+func TestRecentChangesOffByDefault(t *testing.T) {
+	pg := &changesProject{
+		fakeProject: newFakeProject(map[string]string{"main.go": "package main\n"}),
+		changes:     "+added line\n",
+	}
+	gatherer := newGatherer(testConfig())
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+	ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+	if err != nil {
+		t.Fatalf("GatherContext: %v", err)
+	}
+	if ctx.RecentChanges != "" {
+		t.Errorf("RecentChanges = %q, want none without include_recent_changes", ctx.RecentChanges)
+	}
+}
+
+func TestTrimCodeRatio(t *testing.T) {
+	var lines []string
+	for i := 0; i < 4000; i++ {
+		lines = append(lines, fmt.Sprintf("line %04d of the file", i))
+	}
+	tests := []struct {
+		name        string
+		ratio       float64
+		suffixLines int
+		wantRatio   float64 // 0 means the suffix is kept whole
+	}{
+		{"default ratio", 0, 2000, defaultPrefixRatio},
+		{"70/30", 0.7, 2000, 0.7},
+		{"50/50", 0.5, 2000, 0.5},
+		{"short suffix gives its share to the prefix", 0.5, 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := strings.Join(lines[:2000+tt.suffixLines], "\n")
+			pg := newFakeProject(map[string]string{"big.txt": content})
+			gatherer := newGatherer(testConfig())
+			gatherer.maxTokens = 1000
+			gatherer.prefixRatio = tt.ratio
+			req := CompletionRequest{ProjectID: "p", FilePath: "big.txt", CursorLine: 2000}
+			ctx, err := gatherer.GatherContext(context.Background(), req, content, pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+
+			// The lines nearest the cursor survive
+			if !strings.HasSuffix(ctx.Prefix, "line 1999 of the file\n") {
+				t.Errorf("prefix does not end at the line before the cursor: ...%q", ctx.Prefix[max(0, len(ctx.Prefix)-40):])
+			}
+			if !strings.HasPrefix(ctx.Suffix, "line 2000 of the file") {
+				t.Errorf("suffix does not start at the cursor line: %.40q", ctx.Suffix)
+			}
+
+			prefixTokens, suffixTokens := estimateTokens(ctx.Prefix), estimateTokens(ctx.Suffix)
+			if tt.wantRatio == 0 {
+				if want := strings.Join(lines[2000:2000+tt.suffixLines], "\n"); ctx.Suffix != want {
+					t.Errorf("short suffix was trimmed to %q", ctx.Suffix)
+				}
+				if prefixTokens < 900 {
+					t.Errorf("prefix kept %d tokens; the suffix's unused share should go to it", prefixTokens)
+				}
+				return
+			}
+			got := float64(prefixTokens) / float64(prefixTokens+suffixTokens)
+			if got < tt.wantRatio-0.05 || got > tt.wantRatio+0.05 {
+				t.Errorf("prefix share = %.2f (%d/%d tokens), want about %.2f", got, prefixTokens, prefixTokens+suffixTokens, tt.wantRatio)
+			}
+		})
+	}
+}
+
+// slowProject is a fakeProject whose reads of files other than the target
+// take delay
+type slowProject struct {
+	*fakeProject
+	target string
+	delay  time.Duration
+}
+
+func (p *slowProject) ReadFile(absolutePath string) ([]byte, error) {
+	content, err := p.fakeProject.ReadFile(absolutePath)
+	if absolutePath != testBaseDir+"/"+p.target {
+		time.Sleep(p.delay)
+	}
+	return content, err
+}
+
+// expiringProject is a fakeProject that runs expire on the first read of
+// one of paths, so a test can end the request's deadline partway through
+// gathering
+type expiringProject struct {
+	*fakeProject
+	paths  map[string]bool
+	expire func()
+	once   sync.Once
+}
+
+func (p *expiringProject) ReadFile(absolutePath string) ([]byte, error) {
+	if p.paths[strings.TrimPrefix(absolutePath, testBaseDir+"/")] {
+		p.once.Do(p.expire)
+	}
+	return p.fakeProject.ReadFile(absolutePath)
+}
+
+func TestContextGatherTimeout(t *testing.T) {
+	files := map[string]string{"main.go": "package main\n"}
+	var contextFiles []string
+	isContextFile := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		path := fmt.Sprintf("dep%d.go", i)
+		files[path] = "package main\n"
+		contextFiles = append(contextFiles, path)
+		isContextFile[path] = true
+	}
+	// Each context file read outlasts the gather timeout, so reading them
+	// all can only finish if the timeout is ignored
+	const readDelay = 100 * time.Millisecond
+
+	tests := []struct {
+		name         string
+		parentCancel bool // the request's ctx ends, not the gather timeout
+		partial      bool
+		wantErr      bool
+	}{
+		{"error on timeout", false, false, true},
+		{"partial context on timeout", false, true, false},
+		{"error on parent cancellation", true, false, true},
+		{"partial context on parent cancellation", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			config := testConfig()
+			config.PartialContextOnTimeout = tt.partial
+
+			var pg interface {
+				ProjectGetter
+				readCount(path string) int
+			}
+			if tt.parentCancel {
+				// The deadline passes as the first context file is read;
+				// reads already admitted may finish, but no more may start
+				config.ContextGatherTimeout = time.Minute
+				pg = &expiringProject{fakeProject: newFakeProject(files), paths: isContextFile, expire: cancel}
+			} else {
+				// Only the gather timeout can end gathering. No agents files,
+				// so the slow reads are all context files.
+				config.ContextGatherTimeout = 20 * time.Millisecond
+				config.IncludeAgentsFile = false
+				pg = &slowProject{fakeProject: newFakeProject(files), target: "main.go", delay: readDelay}
+			}
+			client := &EchoGrokkerClient{Completion: "x"}
+			service := newTestService(t, config, client)
+
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, ContextFiles: contextFiles}
+			_, err := service.Complete(ctx, req, pg)
+			reads := 0
+			for _, path := range contextFiles {
+				reads += pg.readCount(path)
+			}
+			if reads == 0 || reads > maxConcurrentReads {
+				t.Errorf("read %d context files, want 1 to %d; gathering did not stop at its deadline", reads, maxConcurrentReads)
+			}
+
+			if tt.wantErr {
+				var completionErr *CompletionError
+				if !errors.As(err, &completionErr) || completionErr.Code != CodeTimeout {
+					t.Errorf("err = %v, want a timeout CompletionError", err)
+				}
+				if client.Calls() != 0 {
+					t.Errorf("client called %d times after gathering timed out", client.Calls())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if client.Calls() != 1 {
+				t.Errorf("client called %d times, want 1 with the partial context", client.Calls())
+			}
+		})
+	}
+}
+
+// barrierProject is a fakeProject whose reads wait until width of them are
+// in flight at once, so reads made one at a time never get past the first.
+// peak is the most reads seen in flight.
+type barrierProject struct {
+	*fakeProject
+	width int
+	full  chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (p *barrierProject) ReadFile(absolutePath string) ([]byte, error) {
+	p.mu.Lock()
+	p.inFlight++
+	p.peak = max(p.peak, p.inFlight)
+	if p.inFlight == p.width {
+		close(p.full)
+	}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.inFlight--
+		p.mu.Unlock()
+	}()
+
+	select {
+	case <-p.full:
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("reads are not concurrent")
+	}
+	return p.fakeProject.ReadFile(absolutePath)
+}
+
+func TestGatherAdditionalFilesConcurrent(t *testing.T) {
+	files := map[string]string{"main.go": "package main\n"}
+	var paths []string
+	for i := 0; i < 16; i++ {
+		path := fmt.Sprintf("dep%02d.go", i)
+		files[path] = fmt.Sprintf("// file %d\n", i)
+		paths = append(paths, path)
+	}
+	pg := &barrierProject{fakeProject: newFakeProject(files), width: maxConcurrentReads, full: make(chan struct{})}
+	pg.readErrs = map[string]error{"dep03.go": fs.ErrPermission}
+	paths = append(paths, "missing.go")
+
+	gatherer := newGatherer(testConfig())
+	got, _ := gatherer.gatherAdditionalFiles(context.Background(), "p", paths, testBaseDir, pg, nil, map[string]bool{})
+	if pg.peak != maxConcurrentReads {
+		t.Errorf("at most %d reads ran at once, want %d", pg.peak, maxConcurrentReads)
+	}
+
+	var want []string
+	for _, path := range paths {
+		if path != "dep03.go" && path != "missing.go" {
+			want = append(want, path)
+		}
+	}
+	var gotPaths []string
+	for _, f := range got {
+		gotPaths = append(gotPaths, f.Path)
+		if f.Content != files[f.Path] {
+			t.Errorf("%s content = %q, want %q", f.Path, f.Content, files[f.Path])
+		}
+	}
+	if strings.Join(gotPaths, ",") != strings.Join(want, ",") {
+		t.Errorf("files = %v, want %v in request order", gotPaths, want)
+	}
+}
+
+func TestMaxContextFiles(t *testing.T) {
+	files := map[string]string{"main.go": "package main\n"}
+	var paths []string
+	for i := 0; i < 50; i++ {
+		path := fmt.Sprintf("dep%02d.go", i)
+		files[path] = fmt.Sprintf("// file %d\n", i)
+		paths = append(paths, path)
+	}
+	pg := newFakeProject(files)
+
+	config := testConfig()
+	config.MaxContextFiles = 5
+	gatherer := newGatherer(config)
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", ContextFiles: paths}
+	ctx, err := gatherer.GatherContext(context.Background(), req, files["main.go"], pg)
+	if err != nil {
+		t.Fatalf("GatherContext: %v", err)
+	}
+
+	if len(ctx.AdditionalFiles) != 5 {
+		t.Errorf("got %d context files, want 5", len(ctx.AdditionalFiles))
+	}
+	reads := 0
+	for path, n := range pg.reads {
+		if strings.HasPrefix(path, "dep") {
+			reads += n
+		}
+	}
+	if reads != 5 {
+		t.Errorf("read %d context files, want 5", reads)
+	}
+	for _, path := range paths[:5] {
+		if pg.reads[path] != 1 {
+			t.Errorf("%s read %d times, want the first 5 files read once", path, pg.reads[path])
+		}
+	}
+}
+
+func BenchmarkGatherAdditionalFiles(b *testing.B) {
+	files := map[string]string{"main.go": "package main\n"}
+	var paths []string
+	for i := 0; i < 32; i++ {
+		path := fmt.Sprintf("dep%02d.go", i)
+		files[path] = strings.Repeat("// line\n", 100)
+		paths = append(paths, path)
+	}
+	pg := &slowProject{fakeProject: newFakeProject(files), target: "main.go", delay: time.Millisecond}
+	gatherer := newGatherer(testConfig())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gatherer.gatherAdditionalFiles(context.Background(), "p", paths, testBaseDir, pg, nil, map[string]bool{})
+	}
+}
+
+func TestTargetNotRepeatedInContextFiles(t *testing.T) {
+	main := "package main\n\nimport (\n\t\"fmt\"\n)\n\nfunc main() {\n\tfmt.Println(\"hi\")\n\tfmt.Println(\"bye\")\n}\n"
+	files := map[string]string{
+		"main.go":      main,
+		"main_copy.go": main + "\n// copy\n",
+		"types.go":     "package main\n\ntype Order struct{ ID int }\n\nfunc (o Order) Valid() bool { return o.ID > 0 }\n",
+		"short.go":     "package main\n",
+		"helper.go":    "package main\n\nimport (\n\t\"fmt\"\n)\n\nfunc helper() {\n}\n",
+	}
+	tests := []struct {
+		name         string
+		contextFiles []string
+		always       []string
+		virtual      []FileContext
+		wantPaths    []string
+	}{
+		{"target path", []string{"main.go", "types.go"}, nil, nil, []string{"types.go"}},
+		{"unclean target path", []string{"./main.go", "sub/../main.go"}, nil, nil, nil},
+		{"mostly a copy of the target", []string{"main_copy.go", "types.go"}, nil, nil, []string{"types.go"}},
+		{"too short to judge", []string{"short.go"}, nil, nil, []string{"short.go"}},
+		{"shares only boilerplate", []string{"helper.go"}, nil, nil, []string{"helper.go"}},
+		{"always included copy", nil, []string{"main_copy.go"}, nil, []string{"main_copy.go"}},
+		{"virtual copy", nil, nil, []FileContext{{Path: "scratch.go", Content: main}}, []string{"scratch.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.AlwaysIncludeFiles = tt.always
+			gatherer := newGatherer(config)
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 5, ContextFiles: tt.contextFiles, VirtualFiles: tt.virtual}
+			ctx, err := gatherer.GatherContext(context.Background(), req, main, newFakeProject(files))
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			var paths []string
+			for _, f := range ctx.AdditionalFiles {
+				paths = append(paths, f.Path)
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.wantPaths, ",") {
+				t.Errorf("context files = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestExcludeSections(t *testing.T) {
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, testConfig(), client)
+	pg := newFakeProject(map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t\n\tSUFFIX_MARKER()\n}\n",
+		"util.go": "package main\n\nfunc RELATED_MARKER() {}\n",
+	})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1, ContextFiles: []string{"util.go"}}
+
+	if _, err := service.Complete(context.Background(), req, pg); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	for _, want := range []string{"SUFFIX_MARKER", "RELATED_MARKER", "CODE AFTER CURSOR"} {
+		if !strings.Contains(client.lastPrompt(), want) {
+			t.Fatalf("prompt without exclusions lacks %q:\n%s", want, client.lastPrompt())
+		}
+	}
+
+	req.ExcludeSections = ExcludeSections{AdditionalFiles: true, Suffix: true}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	for _, unwanted := range []string{"SUFFIX_MARKER", "RELATED_MARKER", "RELATED FILES", "CODE AFTER CURSOR"} {
+		if strings.Contains(client.lastPrompt(), unwanted) {
+			t.Errorf("prompt contains excluded %q:\n%s", unwanted, client.lastPrompt())
+		}
+	}
+	if len(resp.IncludedFiles) != 0 || len(resp.Warnings) != 0 {
+		t.Errorf("IncludedFiles = %v, Warnings = %+v, want none for excluded files", resp.IncludedFiles, resp.Warnings)
+	}
+}
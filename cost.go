@@ -0,0 +1,22 @@
+package smartcomplete
+
+// ModelPrice is the price of a model in currency units per 1k tokens
+type ModelPrice struct {
+	InputPer1K  float64 `yaml:"input_per_1k"`
+	OutputPer1K float64 `yaml:"output_per_1k"`
+}
+
+// estimateCost approximates the cost of a completion. Query only reports
+// total tokens, so unless a UsageClient reports it the input share is
+// estimated from the prompt; the remainder is billed as output.
+func estimateCost(price ModelPrice, promptTokens, totalTokens int) float64 {
+	outputTokens := totalTokens - promptTokens
+	if outputTokens < 0 {
+		outputTokens = 0
+	}
+	if promptTokens > totalTokens && totalTokens > 0 {
+		promptTokens = totalTokens
+	}
+	return float64(promptTokens)/1000*price.InputPer1K +
+		float64(outputTokens)/1000*price.OutputPer1K
+}
@@ -0,0 +1,70 @@
+package smartcomplete
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestEstimateCost(t *testing.T) {
+	price := ModelPrice{InputPer1K: 0.5, OutputPer1K: 1.5}
+	tests := []struct {
+		name         string
+		promptTokens int
+		totalTokens  int
+		expected     float64
+	}{
+		{"input and output", 2000, 3000, 2*0.5 + 1*1.5},
+		{"input only", 1000, 1000, 0.5},
+		{"prompt estimate above total", 4000, 1000, 0.5},
+		{"no usage reported", 1000, 0, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateCost(price, tt.promptTokens, tt.totalTokens); math.Abs(got-tt.expected) > 1e-9 {
+				t.Errorf("estimateCost(%d, %d) = %v, want %v", tt.promptTokens, tt.totalTokens, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEstimatedCostUnpricedModel(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	resp, err := service.Complete(context.Background(), CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.EstimatedCost != 0 {
+		t.Errorf("EstimatedCost = %v without pricing, want 0", resp.EstimatedCost)
+	}
+}
+
+func TestEstimatedCostCountsEveryCandidateQuery(t *testing.T) {
+	tests := []struct {
+		candidates int
+		want       float64 // 1000 prompt + 10 completion tokens per query
+	}{
+		{0, 2},
+		{3, 6},
+	}
+	for _, tt := range tests {
+		config := testConfig()
+		config.ModelPricing = map[string]ModelPrice{config.DefaultLLM: {InputPer1K: 1, OutputPer1K: 100}}
+		client := &usageClient{
+			stopClient: stopClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}},
+			usage:      TokenUsage{PromptTokens: 1000, CompletionTokens: 10},
+		}
+		service := newTestService(t, config, client)
+		pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+
+		req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, Candidates: tt.candidates}
+		resp, err := service.Complete(context.Background(), req, pg)
+		if err != nil {
+			t.Fatalf("Complete: %v", err)
+		}
+		if math.Abs(resp.EstimatedCost-tt.want) > 1e-9 {
+			t.Errorf("EstimatedCost with %d candidates = %v, want %v", tt.candidates, resp.EstimatedCost, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package smartcomplete
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Discussion file formats
+const (
+	DiscussionPlain    = "plain"
+	DiscussionMarkdown = "markdown"
+	DiscussionJSONL    = "jsonl"
+)
+
+// Discussion round retention policies
+const (
+	RoundsTail           = "tail"             // the last N rounds
+	RoundsFirstAndRecent = "first_and_recent" // the first round plus the last N-1
+)
+
+// NoDiscussionCap as Config.MaxDiscussionChars keeps the whole discussion,
+// leaving only budget trimming to cut it
+const NoDiscussionCap = -1
+
+// defaultMaxDiscussionChars is the discussion cap when
+// Config.MaxDiscussionChars is unset
+const defaultMaxDiscussionChars = 3000
+
+// discussionMessage is one line of a JSONL discussion file
+type discussionMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// parseDiscussionRounds splits a discussion into rounds according to format.
+// Plain discussions are a single round.
+func parseDiscussionRounds(content, format string) ([]string, error) {
+	switch format {
+	case DiscussionMarkdown:
+		return splitMarkdownRounds(content), nil
+	case DiscussionJSONL:
+		return parseJSONLRounds(content)
+	default:
+		return []string{content}, nil
+	}
+}
+
+// splitMarkdownRounds starts a new round at every markdown heading
+func splitMarkdownRounds(content string) []string {
+	var rounds []string
+	var current []string
+	for _, line := range strings.Split(content, "\n") {
+		if isMarkdownHeading(line) && len(current) > 0 {
+			rounds = append(rounds, strings.Join(current, "\n"))
+			current = nil
+		}
+		current = append(current, line)
+	}
+	if len(current) > 0 {
+		rounds = append(rounds, strings.Join(current, "\n"))
+	}
+	return rounds
+}
+
+// isMarkdownHeading reports whether line is an ATX heading like "## Title"
+func isMarkdownHeading(line string) bool {
+	trimmed := strings.TrimLeft(line, "#")
+	level := len(line) - len(trimmed)
+	return level >= 1 && level <= 6 && strings.HasPrefix(trimmed, " ")
+}
+
+// parseJSONLRounds renders each JSONL message as "role: content"
+func parseJSONLRounds(content string) ([]string, error) {
+	var rounds []string
+	for i, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var msg discussionMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			return nil, fmt.Errorf("discussion line %d: %w", i+1, err)
+		}
+		rounds = append(rounds, msg.Role+": "+msg.Content)
+	}
+	return rounds, nil
+}
+
+// selectRounds keeps n rounds according to policy; n <= 0 keeps them all
+func selectRounds(rounds []string, n int, policy string) []string {
+	if n <= 0 || len(rounds) <= n {
+		return rounds
+	}
+	if policy == RoundsFirstAndRecent {
+		// The first round often holds the original spec
+		kept := append([]string{rounds[0]}, rounds[len(rounds)-(n-1):]...)
+		return kept
+	}
+	return rounds[len(rounds)-n:]
+}
+
+// truncateDiscussion keeps at most maxRunes runes of discussion. Without a
+// head it keeps the most recent text; with one, such as the first round
+// kept by first_and_recent, it keeps head and cuts from the rounds after it.
+// head gets at most half of maxRunes so the latest round is never lost.
+func truncateDiscussion(discussion, head string, maxRunes int) string {
+	if head == "" || !strings.HasPrefix(discussion, head) {
+		return truncateTail(discussion, maxRunes)
+	}
+	if utf8.RuneCountInString(discussion) <= maxRunes {
+		return discussion
+	}
+	rest := discussion[len(head):]
+	head = truncateHead(head, maxRunes/2)
+	return head + truncateTail(rest, maxRunes-utf8.RuneCountInString(head))
+}
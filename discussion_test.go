@@ -0,0 +1,250 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestDiscussionFileErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		discussion string // relative path; "" means none configured
+		readErr    error
+		wantErr    error
+	}{
+		{"none configured", "", nil, nil},
+		{"missing file", "missing.md", nil, nil},
+		{"wrapped not found", "discussion.md", ErrFileNotFound, nil},
+		{"permission denied", "discussion.md", fs.ErrPermission, fs.ErrPermission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{
+				"main.go":       "package main\n",
+				"discussion.md": "notes",
+			})
+			pg.discussion = tt.discussion
+			if tt.readErr != nil {
+				pg.readErrs = map[string]error{tt.discussion: tt.readErr}
+			}
+			gatherer := newGatherer(testConfig())
+
+			discussion, _, err := gatherer.gatherDiscussionContext("p", pg)
+			if tt.wantErr == nil {
+				if err != nil || discussion != "" {
+					t.Errorf("gatherDiscussionContext() = %q, %v; want empty, nil", discussion, err)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Errorf("gatherDiscussionContext() err = %v, want %v", err, tt.wantErr)
+			}
+
+			// GatherContext drops the section instead and reports the error
+			observer := &recordingObserver{}
+			gatherer.observer = observer
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil || ctx.DiscussionContext != "" {
+				t.Fatalf("GatherContext() = %q, %v; want no discussion, nil", ctx.DiscussionContext, err)
+			}
+			if failed := observer.failedSections(); tt.wantErr == nil && len(failed) != 0 {
+				t.Errorf("reported failures %v, want none", failed)
+			} else if tt.wantErr != nil && (len(failed) != 1 || !errors.Is(observer.errs[0], tt.wantErr)) {
+				t.Errorf("reported failures %v (%v), want one discussion failure wrapping %v", failed, observer.errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxDiscussionChars(t *testing.T) {
+	discussion := strings.Repeat("0123456789", 1000) // 10000 chars
+	tests := []struct {
+		name      string
+		maxChars  int
+		maxTokens int
+		wantLen   int
+	}{
+		{"default cap", DefaultConfig().MaxDiscussionChars, 100000, 3000},
+		{"larger cap", 8000, 100000, 8000},
+		{"zero is the default cap", 0, 100000, 3000},
+		{"no cap", NoDiscussionCap, 100000, 10000},
+		{"budget still trims", 8000, 1500, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{"main.go": "package main\n", "discussion.md": discussion})
+			pg.discussion = "discussion.md"
+			config := testConfig()
+			config.MaxDiscussionChars = tt.maxChars
+			gatherer := newGatherer(config)
+			gatherer.maxTokens = tt.maxTokens
+
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			if len(ctx.DiscussionContext) != tt.wantLen {
+				t.Errorf("kept %d discussion chars, want %d", len(ctx.DiscussionContext), tt.wantLen)
+			}
+			if !strings.HasSuffix(discussion, ctx.DiscussionContext) {
+				t.Error("kept discussion is not the most recent part")
+			}
+		})
+	}
+}
+
+func TestDiscussionFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    string
+	}{
+		{
+			name:    "plain",
+			format:  DiscussionPlain,
+			content: "first\nsecond\nthird",
+			want:    "first\nsecond\nthird",
+		},
+		{
+			name:    "markdown",
+			format:  DiscussionMarkdown,
+			content: "## Round 1\nold\n## Round 2\nmiddle\n## Round 3\nnew",
+			want:    "## Round 2\nmiddle\n\n## Round 3\nnew",
+		},
+		{
+			name:   "jsonl",
+			format: DiscussionJSONL,
+			content: `{"role":"user","content":"hi"}` + "\n" +
+				`{"role":"assistant","content":"hello"}` + "\n\n" +
+				`{"role":"user","content":"write tests"}` + "\n",
+			want: "assistant: hello\nuser: write tests",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{"discussion.md": tt.content})
+			pg.discussion = "discussion.md"
+			gatherer := newGatherer(testConfig())
+			gatherer.discussionFormat = tt.format
+			gatherer.maxDiscussionRounds = 2
+
+			got, _, err := gatherer.gatherDiscussionContext("p", pg)
+			if err != nil {
+				t.Fatalf("gatherDiscussionContext: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("discussion = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscussionJSONLMalformed(t *testing.T) {
+	pg := newFakeProject(map[string]string{"discussion.jsonl": `{"role":"user","content":"hi"}` + "\nnot json\n"})
+	pg.discussion = "discussion.jsonl"
+	gatherer := newGatherer(testConfig())
+	gatherer.discussionFormat = DiscussionJSONL
+
+	if _, _, err := gatherer.gatherDiscussionContext("p", pg); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("err = %v, want a parse error naming line 2", err)
+	}
+}
+
+func TestSelectRounds(t *testing.T) {
+	rounds := []string{"round 1", "round 2", "round 3", "round 4", "round 5"}
+	tests := []struct {
+		name   string
+		n      int
+		policy string
+		want   []string
+	}{
+		{"tail", 3, RoundsTail, []string{"round 3", "round 4", "round 5"}},
+		{"default policy is tail", 3, "", []string{"round 3", "round 4", "round 5"}},
+		{"first and recent", 3, RoundsFirstAndRecent, []string{"round 1", "round 4", "round 5"}},
+		{"first and recent, one round", 1, RoundsFirstAndRecent, []string{"round 1"}},
+		{"all fit", 5, RoundsFirstAndRecent, rounds},
+		{"no limit", 0, RoundsTail, rounds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectRounds(append([]string(nil), rounds...), tt.n, tt.policy)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("selectRounds(%d, %q) = %q, want %q", tt.n, tt.policy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscussionFirstAndRecentRounds(t *testing.T) {
+	var content []string
+	for i := 1; i <= 5; i++ {
+		content = append(content, fmt.Sprintf("## Round %d\nmessage %d", i, i))
+	}
+	pg := newFakeProject(map[string]string{"discussion.md": strings.Join(content, "\n")})
+	pg.discussion = "discussion.md"
+	gatherer := newGatherer(testConfig())
+	gatherer.discussionFormat = DiscussionMarkdown
+	gatherer.maxDiscussionRounds = 3
+	gatherer.roundPolicy = RoundsFirstAndRecent
+
+	got, _, err := gatherer.gatherDiscussionContext("p", pg)
+	if err != nil {
+		t.Fatalf("gatherDiscussionContext: %v", err)
+	}
+	want := "## Round 1\nmessage 1\n\n## Round 4\nmessage 4\n\n## Round 5\nmessage 5"
+	if got != want {
+		t.Errorf("discussion = %q, want %q", got, want)
+	}
+}
+
+func TestDiscussionFirstRoundSurvivesTruncation(t *testing.T) {
+	var content []string
+	for i := 1; i <= 5; i++ {
+		content = append(content, fmt.Sprintf("## Round %d\n%s", i, strings.Repeat(fmt.Sprintf("message %d ", i), 100)))
+	}
+	pg := newFakeProject(map[string]string{"discussion.md": strings.Join(content, "\n")})
+	pg.discussion = "discussion.md"
+	gatherer := newGatherer(testConfig())
+	gatherer.discussionFormat = DiscussionMarkdown
+	gatherer.maxDiscussionRounds = 5
+	gatherer.roundPolicy = RoundsFirstAndRecent
+	gatherer.maxDiscussionChars = DefaultConfig().MaxDiscussionChars
+
+	got, head, err := gatherer.gatherDiscussionContext("p", pg)
+	if err != nil {
+		t.Fatalf("gatherDiscussionContext: %v", err)
+	}
+	if n := len(got); n > gatherer.maxDiscussionChars {
+		t.Errorf("discussion is %d chars, want at most %d", n, gatherer.maxDiscussionChars)
+	}
+	if !strings.HasPrefix(got, "## Round 1\n") {
+		t.Errorf("first round was cut: %q", got[:40])
+	}
+	if !strings.HasSuffix(got, "message 5 ") {
+		t.Errorf("most recent round was cut: %q", got[len(got)-40:])
+	}
+	if strings.Contains(got, "## Round 2") {
+		t.Error("middle round survived truncation")
+	}
+
+	// Budget trimming cuts an uncapped discussion the same way
+	gatherer.maxDiscussionChars = NoDiscussionCap
+	got, head, err = gatherer.gatherDiscussionContext("p", pg)
+	if err != nil {
+		t.Fatalf("gatherDiscussionContext: %v", err)
+	}
+	ctx := &CompletionContext{DiscussionContext: got, discussionHead: head}
+	report := &TrimReport{}
+	gatherer.trimSection(ctx, TrimDiscussion, report)
+	if len(report.Sections) == 0 {
+		t.Fatal("discussion was not budget-trimmed")
+	}
+	if !strings.HasPrefix(ctx.DiscussionContext, "## Round 1\n") || !strings.HasSuffix(ctx.DiscussionContext, "message 5 ") {
+		t.Errorf("budget trim lost the first or most recent round: %q", ctx.DiscussionContext)
+	}
+}
@@ -0,0 +1,59 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// EchoGrokkerClient is a GrokkerClient that never calls a provider, for
+// testing integrations without network access or cost. It returns
+// Completion, or if that is empty the last non-blank line of the prompt,
+// after waiting Latency. Err, if set, is returned instead: on every call,
+// or on every FailEvery-th call when that is positive. It is safe for
+// concurrent use once configured.
+type EchoGrokkerClient struct {
+	Completion string
+	Latency    time.Duration
+	Err        error
+	FailEvery  int
+
+	calls atomic.Int64
+}
+
+// Query returns the configured completion and about a quarter of its length
+// as tokens used
+func (c *EchoGrokkerClient) Query(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int) (string, int, error) {
+	call := c.calls.Add(1)
+
+	if c.Latency > 0 {
+		timer := time.NewTimer(c.Latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		}
+	}
+
+	if c.Err != nil && (c.FailEvery <= 0 || call%int64(c.FailEvery) == 0) {
+		return "", 0, c.Err
+	}
+
+	completion := c.Completion
+	if completion == "" {
+		lines := strings.Split(userMsg, "\n")
+		for i := len(lines) - 1; i >= 0 && completion == ""; i-- {
+			if strings.TrimSpace(lines[i]) != "" {
+				completion = lines[i]
+			}
+		}
+	}
+	return completion, len(completion) / 4, nil
+}
+
+// Calls returns how many times Query has been called
+func (c *EchoGrokkerClient) Calls() int {
+	return int(c.calls.Load())
+}
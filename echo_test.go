@@ -0,0 +1,75 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEchoGrokkerClient(t *testing.T) {
+	errDown := errors.New("provider down")
+	tests := []struct {
+		name    string
+		client  *EchoGrokkerClient
+		calls   int
+		want    string
+		wantErr error // of the last call
+	}{
+		{"fixed completion", &EchoGrokkerClient{Completion: "x++"}, 1, "x++", nil},
+		{"echoes the last non-blank line", &EchoGrokkerClient{}, 1, "last line", nil},
+		{"always fails", &EchoGrokkerClient{Completion: "x", Err: errDown}, 1, "", errDown},
+		{"fails every other call", &EchoGrokkerClient{Completion: "x", Err: errDown, FailEvery: 2}, 2, "", errDown},
+		{"succeeds between failures", &EchoGrokkerClient{Completion: "x", Err: errDown, FailEvery: 2}, 3, "x", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			var err error
+			for i := 0; i < tt.calls; i++ {
+				got, _, err = tt.client.Query(context.Background(), "m", "system", "first line\nlast line\n\n", 100)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("completion = %q, want %q", got, tt.want)
+			}
+			if tt.client.Calls() != tt.calls {
+				t.Errorf("Calls() = %d, want %d", tt.client.Calls(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestEchoGrokkerClientLatency(t *testing.T) {
+	client := &EchoGrokkerClient{Completion: "x", Latency: 20 * time.Millisecond}
+
+	start := time.Now()
+	if _, _, err := client.Query(context.Background(), "m", "", "", 10); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < client.Latency {
+		t.Errorf("Query returned after %v, want at least %v", elapsed, client.Latency)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, _, err := client.Query(ctx, "m", "", "", 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the context's deadline error", err)
+	}
+}
+
+func TestEchoGrokkerClientWithService(t *testing.T) {
+	client := &EchoGrokkerClient{Completion: "fmt.Println(\"hi\")"}
+	service := newTestService(t, testConfig(), client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"})
+
+	resp, err := service.Complete(context.Background(), CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Completion != client.Completion || client.Calls() != 1 {
+		t.Errorf("Completion = %q after %d calls, want %q after 1", resp.Completion, client.Calls(), client.Completion)
+	}
+}
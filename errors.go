@@ -1,8 +1,13 @@
 package smartcomplete
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"time"
 )
 
 // Standard errors
@@ -16,13 +21,23 @@ var (
 	ErrCacheMiss          = errors.New("cache miss")
 	ErrFileNotFound       = errors.New("file not found")
 	ErrInvalidConfig      = errors.New("invalid configuration")
+	ErrEmptyResponse      = errors.New("LLM returned an empty response")
+	ErrBinaryFile         = errors.New("file is not text")
 )
 
+// isNotFound reports whether err means a file simply doesn't exist
+func isNotFound(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrFileNotFound)
+}
+
 // CompletionError wraps errors with context
 type CompletionError struct {
 	Code    string
 	Message string
 	Err     error
+
+	// RetryAfter is how long to wait before retrying a rate-limited request
+	RetryAfter time.Duration
 }
 
 // Error returns the error message
@@ -104,3 +119,32 @@ func WrapTimeoutError(message string, err error) *CompletionError {
 func WrapInternalError(message string, err error) *CompletionError {
 	return NewCompletionError(CodeInternal, message, err)
 }
+
+// RetryableError is implemented by LLM client errors that know whether
+// another client could serve the same request, e.g. from the HTTP status
+type RetryableError interface {
+	error
+	Retryable() bool
+}
+
+// isRetryable reports whether an LLM client error is transient, so the next
+// fallback client is worth trying: connection failures, timeouts, rate
+// limits and silent empty responses. Auth failures, invalid requests and
+// prompts that are too large would fail the same way anywhere, as does any
+// error not known to be transient.
+func isRetryable(err error) bool {
+	var retryable RetryableError
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+	if errors.Is(err, ErrInvalidRequest) || errors.Is(err, ErrContextTooLarge) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrLLMTimeout) ||
+		errors.Is(err, ErrRateLimitExceeded) ||
+		errors.Is(err, ErrEmptyResponse)
+}
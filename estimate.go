@@ -0,0 +1,106 @@
+package smartcomplete
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// ContextBudget previews how a request's context fits the token budget
+type ContextBudget struct {
+	BudgetTokens int `json:"budgetTokens"`
+
+	// Sections are the estimated tokens of each section before trimming,
+	// named as in TrimReport; TotalTokens is their sum
+	Sections    []SectionEstimate `json:"sections"`
+	TotalTokens int               `json:"totalTokens"`
+
+	// Trim is what trimming to the budget would cut; nil if it fits
+	Trim *TrimReport `json:"trim,omitempty"`
+}
+
+// SectionEstimate is the estimated token count of one context section
+type SectionEstimate struct {
+	Section string `json:"section"`
+	Tokens  int    `json:"tokens"`
+}
+
+// EstimateContext gathers context for req as Complete would and reports
+// each section's estimated tokens and what trimming would cut, without
+// calling the LLM. It doesn't count against rate limits or use the cache.
+func (s *CompletionService) EstimateContext(
+	ctx context.Context,
+	req CompletionRequest,
+	projectGetter ProjectGetter,
+) (*ContextBudget, error) {
+	if err := s.validateRequest(req, projectGetter); err != nil {
+		return nil, err
+	}
+	config, err := projectConfig(s.currentConfig(), req.ProjectID, projectGetter)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := requestDeadline(ctx, config)
+	defer cancel()
+	req = resolveRequest(req, config)
+
+	baseDir, _ := projectGetter.GetProjectBaseDir(req.ProjectID)
+	fileContent, err := loadTarget(req, config, projectGetter, resolveTarget(req, baseDir))
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := contextBudget(config, req.LLM, req.MaxTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gather untrimmed, then trim a copy to see what the budget would cut
+	gatherer := s.requestGatherer(config, math.MaxInt)
+	gatherCtx, cancelGather := gatherContextDeadline(ctx, config)
+	defer cancelGather()
+	completionCtx, err := gatherer.GatherContext(gatherCtx, req, string(fileContent), projectGetter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather context: %w", err)
+	}
+
+	estimate := &ContextBudget{
+		BudgetTokens: budget,
+		Sections:     completionCtx.sectionEstimates(),
+		TotalTokens:  contextTokens(completionCtx),
+	}
+	trimmed := *completionCtx
+	gatherer.maxTokens = budget
+	gatherer.trimToTokenBudget(&trimmed)
+	estimate.Trim = trimmed.Trim
+	return estimate, nil
+}
+
+// sectionEstimates returns the estimated tokens of each non-empty section,
+// counted as contextTokens counts them
+func (c *CompletionContext) sectionEstimates() []SectionEstimate {
+	var sections []SectionEstimate
+	add := func(section string, tokens int) {
+		if tokens > 0 {
+			sections = append(sections, SectionEstimate{Section: section, Tokens: tokens})
+		}
+	}
+	add("preamble", estimateTokens(c.Preamble))
+	add("agents", estimateTokens(c.AgentsInstructions))
+	add("discussion", estimateTokens(c.DiscussionContext))
+	add("changes", estimateTokens(c.RecentChanges))
+	for _, section := range c.ProviderSections {
+		add("provider:"+section.Name, estimateTokens(section.Content))
+	}
+	for _, f := range c.AdditionalFiles {
+		add("file:"+f.Path, f.tokens())
+	}
+	for _, f := range c.OpenFiles {
+		add("open_file:"+f.Path, f.tokens())
+	}
+	add("repo_map", estimateTokens(c.RepoMap))
+	add("prefix", knownOrEstimated(c.Prefix, c.PrefixTokens))
+	add("suffix", knownOrEstimated(c.Suffix, c.SuffixTokens))
+	add("instruction", estimateTokens(c.Instruction))
+	return sections
+}
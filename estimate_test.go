@@ -0,0 +1,102 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEstimateContext(t *testing.T) {
+	main := "package main\n\nfunc main() {\n\t\n\tprintln(\"done\")\n}\n"
+	util := strings.Repeat("// util helper line\n", 100)
+	agents := "Use tabs."
+	pg := newFakeProject(map[string]string{
+		"AGENTS.md": agents,
+		"main.go":   main,
+		"util.go":   util,
+	})
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+
+	tests := []struct {
+		name      string
+		maxTokens int
+		wantTrim  bool
+	}{
+		{"fits", 10000, false},
+		{"over budget", 200, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.IncludeAgentsFile = true
+			config.IncludeDiscussion = false
+			config.MaxContextTokens = tt.maxTokens
+			service := newTestService(t, config, client)
+
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1, ContextFiles: []string{"util.go"}}
+			estimate, err := service.EstimateContext(context.Background(), req, pg)
+			if err != nil {
+				t.Fatalf("EstimateContext: %v", err)
+			}
+
+			prefix, suffix := extractPrefixSuffix(main, 3, 1)
+			want := map[string]int{
+				"agents":       estimateTokens(agents),
+				"file:util.go": estimateTokens(util),
+				"prefix":       estimateTokens(prefix),
+				"suffix":       estimateTokens(suffix),
+			}
+			total := 0
+			for _, section := range estimate.Sections {
+				if wantTokens, ok := want[section.Section]; !ok || section.Tokens != wantTokens {
+					t.Errorf("section %s = %d tokens, want %d", section.Section, section.Tokens, wantTokens)
+				}
+				delete(want, section.Section)
+				total += section.Tokens
+			}
+			for section := range want {
+				t.Errorf("section %s is missing", section)
+			}
+			if estimate.TotalTokens != total {
+				t.Errorf("TotalTokens = %d, want the sections' sum %d", estimate.TotalTokens, total)
+			}
+			if estimate.BudgetTokens != tt.maxTokens {
+				t.Errorf("BudgetTokens = %d, want %d", estimate.BudgetTokens, tt.maxTokens)
+			}
+			if (estimate.Trim != nil) != tt.wantTrim {
+				t.Errorf("Trim = %+v, want trimming %t", estimate.Trim, tt.wantTrim)
+			}
+		})
+	}
+	if prompt := client.lastPrompt(); prompt != "" {
+		t.Errorf("EstimateContext queried the client:\n%s", prompt)
+	}
+}
+
+func TestEstimateContextValidatesTarget(t *testing.T) {
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	binary := binaryBlob
+	tests := []struct {
+		name    string
+		req     CompletionRequest
+		wantErr error
+	}{
+		{"binary file content", CompletionRequest{FileContent: &binary}, ErrBinaryFile},
+		{"binary virtual file", CompletionRequest{VirtualFiles: []FileContext{{Path: "main.go", Content: binaryBlob}}}, ErrBinaryFile},
+		{"cursor past end of file", CompletionRequest{CursorLine: 5}, ErrInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.StrictCursorValidation = true
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+
+			req := tt.req
+			req.ProjectID, req.FilePath = "p", "main.go"
+			if _, err := service.EstimateContext(context.Background(), req, pg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
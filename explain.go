@@ -0,0 +1,23 @@
+package smartcomplete
+
+import "strings"
+
+// explanationDelimiter separates the completion from its rationale in the
+// output of a request with Explain set
+const explanationDelimiter = "<<<EXPLANATION>>>"
+
+// explainInstruction is appended to the system message for Explain requests
+const explainInstruction = " After the completion, write a line containing only " + explanationDelimiter +
+	" followed by one or two sentences explaining why the completion fits."
+
+// splitExplanation separates the completion from the explanation after
+// explanationDelimiter. Without the delimiter the whole text is the
+// completion and the explanation is "".
+func splitExplanation(text string) (completion, explanation string) {
+	completion, explanation, found := strings.Cut(text, explanationDelimiter)
+	if !found {
+		return text, ""
+	}
+	completion = strings.TrimSuffix(strings.TrimSuffix(completion, "\n"), "\r")
+	return completion, strings.TrimSpace(explanation)
+}
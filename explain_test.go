@@ -0,0 +1,64 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// systemMsgClient returns a fixed completion and keeps the last system message
+type systemMsgClient struct {
+	completion string
+	systemMsg  string
+}
+
+func (c *systemMsgClient) Query(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int) (string, int, error) {
+	c.systemMsg = systemMsg
+	return c.completion, 1, nil
+}
+
+func TestExplain(t *testing.T) {
+	client := &systemMsgClient{completion: "return a + b\n" + explanationDelimiter + "\nAdd sums its two arguments.\n"}
+	service := newTestService(t, testConfig(), client)
+	pg := newFakeProject(map[string]string{"add.go": "package main\n\nfunc Add(a, b int) int {\n\t\n}\n"})
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "add.go", CursorLine: 3, CursorColumn: 1, Explain: true}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Completion != "return a + b" {
+		t.Errorf("Completion = %q, want the code before the delimiter", resp.Completion)
+	}
+	if resp.Explanation != "Add sums its two arguments." {
+		t.Errorf("Explanation = %q, want the text after the delimiter", resp.Explanation)
+	}
+	if !strings.Contains(client.systemMsg, explanationDelimiter) {
+		t.Errorf("system message doesn't ask for an explanation: %q", client.systemMsg)
+	}
+
+	req.Explain = false
+	resp, err = service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if strings.Contains(client.systemMsg, explanationDelimiter) || resp.Explanation != "" {
+		t.Errorf("explanation requested without Explain: system message %q, explanation %q", client.systemMsg, resp.Explanation)
+	}
+}
+
+func TestSplitExplanation(t *testing.T) {
+	tests := []struct {
+		text, completion, explanation string
+	}{
+		{"x + 1\n" + explanationDelimiter + " because.", "x + 1", "because."},
+		{"x + 1\r\n" + explanationDelimiter + "\nbecause.\n", "x + 1", "because."},
+		{"x + 1", "x + 1", ""},
+	}
+	for _, tt := range tests {
+		completion, explanation := splitExplanation(tt.text)
+		if completion != tt.completion || explanation != tt.explanation {
+			t.Errorf("splitExplanation(%q) = %q, %q, want %q, %q", tt.text, completion, explanation, tt.completion, tt.explanation)
+		}
+	}
+}
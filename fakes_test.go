@@ -0,0 +1,137 @@
+package smartcomplete
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBaseDir is the base directory of fakeProject projects
+const testBaseDir = "/project"
+
+// fakeProject is an in-memory ProjectGetter. Files are keyed by path
+// relative to testBaseDir; every file is authorized unless authorized is
+// set.
+type fakeProject struct {
+	files      map[string]string
+	authorized []string
+	discussion string // relative path of the discussion file, if any
+	readErrs   map[string]error
+
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func newFakeProject(files map[string]string) *fakeProject {
+	return &fakeProject{files: files, reads: make(map[string]int)}
+}
+
+func (p *fakeProject) GetProjectBaseDir(projectID string) (string, error) {
+	return testBaseDir, nil
+}
+
+func (p *fakeProject) GetProjectAuthorizedFiles(projectID string) ([]string, error) {
+	if p.authorized != nil {
+		return p.authorized, nil
+	}
+	var files []string
+	for path := range p.files {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+func (p *fakeProject) GetProjectDiscussionFile(projectID string) (string, error) {
+	if p.discussion == "" {
+		return "", nil
+	}
+	return filepath.Join(testBaseDir, p.discussion), nil
+}
+
+func (p *fakeProject) ReadFile(absolutePath string) ([]byte, error) {
+	rel := strings.TrimPrefix(absolutePath, testBaseDir+"/")
+	p.mu.Lock()
+	p.reads[rel]++
+	p.mu.Unlock()
+
+	if err, ok := p.readErrs[rel]; ok {
+		return nil, err
+	}
+	content, ok := p.files[rel]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return []byte(content), nil
+}
+
+// readCount returns how many times the file at rel was read
+func (p *fakeProject) readCount(rel string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reads[rel]
+}
+
+// recordingClient is an EchoGrokkerClient that keeps the prompts it is sent
+type recordingClient struct {
+	EchoGrokkerClient
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (c *recordingClient) Query(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int) (string, int, error) {
+	c.mu.Lock()
+	c.prompts = append(c.prompts, userMsg)
+	c.mu.Unlock()
+	return c.EchoGrokkerClient.Query(ctx, llm, systemMsg, userMsg, maxTokens)
+}
+
+// lastPrompt returns the most recent prompt, or "" if there was none
+func (c *recordingClient) lastPrompt() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.prompts) == 0 {
+		return ""
+	}
+	return c.prompts[len(c.prompts)-1]
+}
+
+// testConfig is DefaultConfig without rate limits or caching, so tests
+// can make any number of requests and always reach the client
+func testConfig() *Config {
+	config := DefaultConfig()
+	config.RateLimitEnabled = false
+	config.EnableCache = false
+	return config
+}
+
+// newTestService creates a service with config and client, failing the
+// test if config is invalid
+func newTestService(t testing.TB, config *Config, client GrokkerClient) *CompletionService {
+	t.Helper()
+	service, err := NewCompletionService(config)
+	if err != nil {
+		t.Fatalf("NewCompletionService: %v", err)
+	}
+	service.SetGrokkerClient(client)
+	return service
+}
+
+// statProject is a fakeProject that is also a FileStater
+type statProject struct {
+	*fakeProject
+	modTimes map[string]time.Time
+}
+
+func (p *statProject) Stat(absolutePath string) (int64, time.Time, error) {
+	rel := strings.TrimPrefix(absolutePath, testBaseDir+"/")
+	content, ok := p.files[rel]
+	if !ok {
+		return 0, time.Time{}, fs.ErrNotExist
+	}
+	return int64(len(content)), p.modTimes[rel], nil
+}
@@ -8,18 +8,103 @@ import (
 // FIMFormatter formats Fill-in-Middle prompts
 type FIMFormatter struct {
 	instructionTemplate string
+
+	// SuffixFirst places the code after the cursor ahead of the code before it
+	SuffixFirst bool
+
+	// FileHeaders selects how related files are labelled (FileHeaderPath if empty)
+	FileHeaders string
+
+	// LanguageInstructions maps language names, matched case-insensitively,
+	// to instructions appended when completing code in that language
+	LanguageInstructions map[string]string
 }
 
+// Related-file header styles
+const (
+	FileHeaderNone    = "none"
+	FileHeaderPath    = "path"
+	FileHeaderVerbose = "verbose"
+)
+
 // FormatPrompt creates a FIM prompt from context
 func (f *FIMFormatter) FormatPrompt(ctx *CompletionContext) string {
 	var prompt strings.Builder
 
+	writeContextSections(&prompt, ctx, f.FileHeaders)
+
+	// Main FIM prompt
+	before := "CODE BEFORE CURSOR:\n" + ctx.Prefix + "\n\n"
+	after := "CODE AFTER CURSOR:\n" + ctx.Suffix + "\n\n"
+	switch {
+	case ctx.SuffixExcluded:
+		prompt.WriteString(before)
+	case f.SuffixFirst:
+		prompt.WriteString(after)
+		prompt.WriteString(before)
+		prompt.WriteString("The completion goes at the end of CODE BEFORE CURSOR, directly ahead of CODE AFTER CURSOR.\n\n")
+	default:
+		prompt.WriteString(before)
+		prompt.WriteString(after)
+	}
+
+	writeInstructions(&prompt, ctx, "Do not repeat the prefix or suffix.\n", f.LanguageInstructions)
+
+	return prompt.String()
+}
+
+// DefaultCursorMarker marks the cursor in CursorMarkerFormatter prompts
+const DefaultCursorMarker = "<CURSOR>"
+
+// CursorMarkerFormatter sends the whole file with the cursor marked inline,
+// which some models handle better than a split prefix/suffix
+type CursorMarkerFormatter struct {
+	Marker      string // defaults to DefaultCursorMarker
+	FileHeaders string // see FIMFormatter.FileHeaders
+
+	// LanguageInstructions are as in FIMFormatter
+	LanguageInstructions map[string]string
+}
+
+// FormatPrompt creates a cursor-marker prompt from context
+func (f *CursorMarkerFormatter) FormatPrompt(ctx *CompletionContext) string {
+	marker := f.Marker
+	if marker == "" {
+		marker = DefaultCursorMarker
+	}
+
+	var prompt strings.Builder
+
+	writeContextSections(&prompt, ctx, f.FileHeaders)
+
+	prompt.WriteString(fmt.Sprintf("CODE (cursor marked with %s):\n", marker))
+	prompt.WriteString(ctx.Prefix)
+	prompt.WriteString(marker)
+	prompt.WriteString(ctx.Suffix)
+	prompt.WriteString("\n\n")
+
+	writeInstructions(&prompt, ctx, fmt.Sprintf(
+		"Do not repeat the surrounding code or include the %s marker.\n", marker,
+	), f.LanguageInstructions)
+
+	return prompt.String()
+}
+
+// writeContextSections writes everything that precedes the code itself
+func writeContextSections(prompt *strings.Builder, ctx *CompletionContext, fileHeaders string) {
 	// System instructions
 	prompt.WriteString(fmt.Sprintf(
 		"You are an expert %s programmer. Complete the code at the cursor position.\n\n",
 		ctx.Language,
 	))
 
+	// Global preamble (if present)
+	if ctx.Preamble != "" {
+		prompt.WriteString("CODING STANDARDS:\n")
+		prompt.WriteString(ctx.Preamble)
+		prompt.WriteString("\n\n")
+	}
+
 	// AGENTS.md instructions (if present)
 	if ctx.AgentsInstructions != "" {
 		prompt.WriteString("PROJECT INSTRUCTIONS:\n")
@@ -34,29 +119,99 @@ func (f *FIMFormatter) FormatPrompt(ctx *CompletionContext) string {
 		prompt.WriteString("\n\n")
 	}
 
+	// Recent changes (if present)
+	if ctx.RecentChanges != "" {
+		prompt.WriteString("RECENT CHANGES:\n")
+		prompt.WriteString(ctx.RecentChanges)
+		prompt.WriteString("\n\n")
+	}
+
+	// Sections from context providers
+	for _, section := range ctx.ProviderSections {
+		prompt.WriteString(strings.ToUpper(section.Name) + ":\n")
+		prompt.WriteString(section.Content)
+		prompt.WriteString("\n\n")
+	}
+
 	// Additional context files
 	if len(ctx.AdditionalFiles) > 0 {
 		prompt.WriteString("RELATED FILES:\n")
 		for _, file := range ctx.AdditionalFiles {
-			prompt.WriteString(fmt.Sprintf("\n--- %s ---\n%s\n", file.Path, file.Content))
+			prompt.WriteString("\n" + fileHeader(file, fileHeaders))
+			prompt.WriteString(file.Content + "\n")
 		}
 		prompt.WriteString("\n")
 	}
 
-	// Main FIM prompt
-	prompt.WriteString("CODE BEFORE CURSOR:\n")
-	prompt.WriteString(ctx.Prefix)
-	prompt.WriteString("\n\n")
+	// Files open in the editor
+	if len(ctx.OpenFiles) > 0 {
+		prompt.WriteString("OPEN FILES:\n")
+		for _, file := range ctx.OpenFiles {
+			prompt.WriteString("\n" + fileHeader(file, fileHeaders))
+			prompt.WriteString(file.Content + "\n")
+		}
+		prompt.WriteString("\n")
+	}
 
-	prompt.WriteString("CODE AFTER CURSOR:\n")
-	prompt.WriteString(ctx.Suffix)
-	prompt.WriteString("\n\n")
+	// Outline of related files (if present)
+	if ctx.RepoMap != "" {
+		prompt.WriteString("REPOSITORY OUTLINE:\n")
+		prompt.WriteString(ctx.RepoMap)
+		prompt.WriteString("\n")
+	}
+}
+
+// fileHeader returns the label line for a related file in the given style
+func fileHeader(file FileContext, style string) string {
+	switch style {
+	case FileHeaderNone:
+		return "---\n"
+	case FileHeaderVerbose:
+		lines := strings.Count(file.Content, "\n") + 1
+		return fmt.Sprintf("--- %s (%s, %d lines) ---\n", file.Path, detectLanguage(file.Path), lines)
+	default:
+		return fmt.Sprintf("--- %s ---\n", file.Path)
+	}
+}
+
+// writeInstructions writes the closing instructions block, with the
+// language's entry in languageInstructions when completing code
+func writeInstructions(prompt *strings.Builder, ctx *CompletionContext, noRepeat string, languageInstructions map[string]string) {
+	// Request-specific guidance (if present)
+	if ctx.Instruction != "" {
+		prompt.WriteString("USER INSTRUCTION:\n")
+		prompt.WriteString(ctx.Instruction)
+		prompt.WriteString("\n\n")
+	}
 
 	prompt.WriteString("INSTRUCTIONS:\n")
-	prompt.WriteString("Complete only the code at the cursor position.\n")
-	prompt.WriteString("Provide syntactically correct, idiomatic " + ctx.Language + " code.\n")
-	prompt.WriteString("Do not repeat the prefix or suffix.\n")
+	if ctx.Intent.inText() {
+		prompt.WriteString(intentInstruction(ctx.Intent))
+		if ctx.Mode == ModeLine {
+			prompt.WriteString(modeInstruction(ctx.Mode))
+		}
+	} else {
+		prompt.WriteString(modeInstruction(ctx.Mode))
+		prompt.WriteString(intentInstruction(ctx.Intent))
+		prompt.WriteString("Provide syntactically correct, idiomatic " + ctx.Language + " code.\n")
+		if addendum := languageInstruction(languageInstructions, ctx.Language); addendum != "" {
+			prompt.WriteString(strings.TrimRight(addendum, "\n") + "\n")
+		}
+	}
+	prompt.WriteString(noRepeat)
 	prompt.WriteString("Output only the completion, nothing else.\n")
+}
 
-	return prompt.String()
+// languageInstruction returns the entry for language in instructions,
+// matching names case-insensitively
+func languageInstruction(instructions map[string]string, language string) string {
+	if instruction, ok := instructions[language]; ok {
+		return instruction
+	}
+	for name, instruction := range instructions {
+		if strings.EqualFold(name, language) {
+			return instruction
+		}
+	}
+	return ""
 }
@@ -0,0 +1,235 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGlobalPreamble(t *testing.T) {
+	const preamble, agents = "PREAMBLE-MARKER", "AGENTS-MARKER"
+	tests := []struct {
+		name      string
+		maxTokens int
+		wantFile  bool
+	}{
+		{"ample budget", 10000, true},
+		{"files trimmed before preamble", 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{
+				"main.go":   "package main\n",
+				"AGENTS.md": agents,
+				"big.go":    strings.Repeat("// filler\n", 200),
+			})
+			config := testConfig()
+			config.GlobalPreamble = preamble
+			config.MaxContextTokens = tt.maxTokens
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, config, client)
+
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, ContextFiles: []string{"big.go"}}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			prompt := client.lastPrompt()
+			p, a := strings.Index(prompt, preamble), strings.Index(prompt, agents)
+			if p < 0 || a < 0 {
+				t.Fatalf("prompt is missing the preamble (%d) or project instructions (%d):\n%s", p, a, prompt)
+			}
+			if p > a {
+				t.Errorf("preamble at %d comes after project instructions at %d", p, a)
+			}
+			if got := strings.Contains(prompt, "// filler"); got != tt.wantFile {
+				t.Errorf("big.go in prompt = %t, want %t", got, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestCursorMarkerFormatter(t *testing.T) {
+	content := "package main\n\nfunc main() {\n\tfmt.Println()\n}\n"
+	tests := []struct {
+		name      string
+		marker    string
+		line, col int
+	}{
+		{"default marker mid-line", "", 3, 5},
+		{"custom marker", "<|fill|>", 3, 1},
+		{"start of file", "", 0, 0},
+		{"end of file", "", 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, suffix := extractPrefixSuffix(content, tt.line, tt.col)
+			marker := tt.marker
+			if marker == "" {
+				marker = DefaultCursorMarker
+			}
+
+			prompt := (&CursorMarkerFormatter{Marker: tt.marker}).FormatPrompt(&CompletionContext{
+				Prefix:   prefix,
+				Suffix:   suffix,
+				Language: "go",
+			})
+			if want := prefix + marker + suffix; !strings.Contains(prompt, want) {
+				t.Errorf("prompt does not contain %q:\n%s", want, prompt)
+			}
+			if !strings.Contains(prompt, "CODE (cursor marked with "+marker+"):\n") {
+				t.Errorf("prompt does not name the marker %q:\n%s", marker, prompt)
+			}
+		})
+	}
+}
+
+func TestPromptFormatConfig(t *testing.T) {
+	tests := []struct {
+		format     string
+		wantMarker bool
+	}{
+		{"", false},
+		{PromptFormatFIM, false},
+		{PromptFormatCursorMarker, true},
+	}
+	for _, tt := range tests {
+		t.Run("format "+tt.format, func(t *testing.T) {
+			config := testConfig()
+			config.PromptFormat = tt.format
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, config, client)
+
+			pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if got := strings.Contains(client.lastPrompt(), DefaultCursorMarker); got != tt.wantMarker {
+				t.Errorf("prompt has cursor marker = %t, want %t", got, tt.wantMarker)
+			}
+		})
+	}
+}
+
+func TestUserInstruction(t *testing.T) {
+	long := strings.Repeat("x", maxInstructionRunes+100)
+	tests := []struct {
+		name        string
+		instruction string
+		want        string // "" means no USER INSTRUCTION section
+	}{
+		{"none", "", ""},
+		{"short", "  use table-driven tests  ", "USER INSTRUCTION:\nuse table-driven tests\n\nINSTRUCTIONS:"},
+		{"too long", long, "USER INSTRUCTION:\n" + long[:maxInstructionRunes] + "\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, testConfig(), client)
+
+			pg := newFakeProject(map[string]string{"main_test.go": "package main\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main_test.go", CursorLine: 1, Instruction: tt.instruction}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			prompt := client.lastPrompt()
+			if tt.want == "" {
+				if strings.Contains(prompt, "USER INSTRUCTION") {
+					t.Errorf("prompt has a USER INSTRUCTION section without an instruction:\n%s", prompt)
+				}
+				return
+			}
+			if !strings.Contains(prompt, tt.want) {
+				t.Errorf("prompt does not contain %q:\n%s", tt.want, prompt)
+			}
+		})
+	}
+}
+
+func TestFIMSuffixFirst(t *testing.T) {
+	ctx := &CompletionContext{Prefix: "PREFIX-CODE", Suffix: "SUFFIX-CODE", Language: "go"}
+	tests := []struct {
+		name          string
+		suffixFirst   bool
+		wantPlacement bool
+	}{
+		{"prefix first", false, false},
+		{"suffix first", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt := (&FIMFormatter{SuffixFirst: tt.suffixFirst}).FormatPrompt(ctx)
+			before := strings.Index(prompt, "CODE BEFORE CURSOR:\nPREFIX-CODE")
+			after := strings.Index(prompt, "CODE AFTER CURSOR:\nSUFFIX-CODE")
+			if before < 0 || after < 0 {
+				t.Fatalf("prompt is missing a code section:\n%s", prompt)
+			}
+			if suffixFirst := after < before; suffixFirst != tt.suffixFirst {
+				t.Errorf("suffix section first = %t, want %t", suffixFirst, tt.suffixFirst)
+			}
+			if got := strings.Contains(prompt, "The completion goes at the end of CODE BEFORE CURSOR"); got != tt.wantPlacement {
+				t.Errorf("placement note present = %t, want %t", got, tt.wantPlacement)
+			}
+		})
+	}
+}
+
+func TestFileHeaderStyles(t *testing.T) {
+	ctx := &CompletionContext{
+		Language:        "Go",
+		AdditionalFiles: []FileContext{{Path: "pkg/types.go", Content: "package pkg\n\ntype T struct{}"}},
+	}
+	tests := []struct {
+		style   string
+		want    string
+		notWant string
+	}{
+		{"", "RELATED FILES:\n\n--- pkg/types.go ---\npackage pkg", ""},
+		{FileHeaderPath, "RELATED FILES:\n\n--- pkg/types.go ---\npackage pkg", ""},
+		{FileHeaderNone, "RELATED FILES:\n\n---\npackage pkg", "pkg/types.go"},
+		{FileHeaderVerbose, "RELATED FILES:\n\n--- pkg/types.go (Go, 3 lines) ---\npackage pkg", ""},
+	}
+	for _, tt := range tests {
+		t.Run("style "+tt.style, func(t *testing.T) {
+			prompt := (&FIMFormatter{FileHeaders: tt.style}).FormatPrompt(ctx)
+			if !strings.Contains(prompt, tt.want) {
+				t.Errorf("prompt does not contain %q:\n%s", tt.want, prompt)
+			}
+			if tt.notWant != "" && strings.Contains(prompt, tt.notWant) {
+				t.Errorf("prompt contains %q:\n%s", tt.notWant, prompt)
+			}
+		})
+	}
+}
+
+func TestLanguageInstructions(t *testing.T) {
+	const goAddendum = "Format as gofmt would; add no comments."
+	config := testConfig()
+	config.LanguageInstructions = map[string]string{"go": goAddendum}
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, config, client)
+	pg := newFakeProject(map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t\n}\n",
+		"main.py": "def main():\n    \n",
+	})
+
+	tests := []struct {
+		file string
+		line int
+		want bool
+	}{
+		{"main.go", 3, true},
+		{"main.py", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			req := CompletionRequest{ProjectID: "p", FilePath: tt.file, CursorLine: tt.line, CursorColumn: 1}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if got := strings.Contains(client.lastPrompt(), goAddendum); got != tt.want {
+				t.Errorf("prompt contains the Go addendum = %v, want %v:\n%s", got, tt.want, client.lastPrompt())
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package smartcomplete
+
+import (
+	"path"
+	"sync"
+)
+
+// Prompt formats selectable as the default via Config.PromptFormat. FIM is
+// used when none is set.
+const (
+	PromptFormatFIM          = "fim"
+	PromptFormatCursorMarker = "cursor_marker"
+)
+
+// PromptFormatter builds the LLM prompt from gathered context
+type PromptFormatter interface {
+	FormatPrompt(ctx *CompletionContext) string
+}
+
+// FormatterRegistry maps model name patterns to prompt formatters
+type FormatterRegistry struct {
+	entries  []formatterEntry
+	fallback PromptFormatter
+	mu       sync.RWMutex
+
+	// customFallback is set once SetFallback replaces the config's fallback
+	customFallback bool
+}
+
+// formatterEntry pairs a model name pattern with its formatter
+type formatterEntry struct {
+	pattern   string
+	formatter PromptFormatter
+}
+
+// NewFormatterRegistry creates a registry that falls back to FIMFormatter
+func NewFormatterRegistry() *FormatterRegistry {
+	return &FormatterRegistry{
+		fallback: &FIMFormatter{},
+	}
+}
+
+// Register associates a formatter with a model name pattern. Patterns use
+// path.Match syntax (e.g. "deepseek-*"); the first registered match wins.
+func (r *FormatterRegistry) Register(pattern string, formatter PromptFormatter) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, formatterEntry{pattern: pattern, formatter: formatter})
+	return nil
+}
+
+// SetFallback sets the formatter used when no pattern matches, in place of
+// the one built from each request's config
+func (r *FormatterRegistry) SetFallback(formatter PromptFormatter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = formatter
+	r.customFallback = true
+}
+
+// setConfigFallback sets the fallback built from the service config, unless
+// SetFallback has replaced it
+func (r *FormatterRegistry) setConfigFallback(formatter PromptFormatter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.customFallback {
+		r.fallback = formatter
+	}
+}
+
+// Lookup returns the formatter for a model name
+func (r *FormatterRegistry) Lookup(model string) PromptFormatter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, entry := range r.entries {
+		if matched, _ := path.Match(entry.pattern, model); matched {
+			return entry.formatter
+		}
+	}
+	return r.fallback
+}
+
+// lookupFor is Lookup with configFallback, built from the request's
+// config, as the fallback unless SetFallback has set one
+func (r *FormatterRegistry) lookupFor(model string, configFallback PromptFormatter) PromptFormatter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, entry := range r.entries {
+		if matched, _ := path.Match(entry.pattern, model); matched {
+			return entry.formatter
+		}
+	}
+	if r.customFallback {
+		return r.fallback
+	}
+	return configFallback
+}
@@ -0,0 +1,59 @@
+package smartcomplete
+
+import (
+	"context"
+	"testing"
+)
+
+// markerFormatter formats every prompt as its marker
+type markerFormatter string
+
+func (f markerFormatter) FormatPrompt(ctx *CompletionContext) string {
+	return string(f)
+}
+
+func TestFormatterRegistrySelectsByModel(t *testing.T) {
+	tests := []struct {
+		name        string
+		llm         string
+		setFallback bool
+		wantPrompt  string // "" means the default FIM prompt
+	}{
+		{"deepseek model", "deepseek-coder", false, "DEEPSEEK"},
+		{"other model", "gpt-4o", false, ""},
+		{"other model with custom fallback", "gpt-4o", true, "FALLBACK"},
+		{"deepseek model with custom fallback", "deepseek-coder", true, "DEEPSEEK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, testConfig(), client)
+			if err := service.Formatters().Register("deepseek-*", markerFormatter("DEEPSEEK")); err != nil {
+				t.Fatalf("Register: %v", err)
+			}
+			if tt.setFallback {
+				service.Formatters().SetFallback(markerFormatter("FALLBACK"))
+			}
+
+			pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, LLM: tt.llm}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+
+			prompt := client.lastPrompt()
+			switch {
+			case tt.wantPrompt != "" && prompt != tt.wantPrompt:
+				t.Errorf("prompt = %q, want %q", prompt, tt.wantPrompt)
+			case tt.wantPrompt == "" && (prompt == "DEEPSEEK" || prompt == "FALLBACK"):
+				t.Errorf("prompt = %q, want the default formatter's prompt", prompt)
+			}
+		})
+	}
+}
+
+func TestFormatterRegistryRejectsBadPattern(t *testing.T) {
+	if err := NewFormatterRegistry().Register("[", markerFormatter("x")); err == nil {
+		t.Error("Register accepted a malformed pattern")
+	}
+}
@@ -0,0 +1,60 @@
+package smartcomplete
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyStore remembers responses by idempotency key for a short
+// window, so client retries don't re-run the LLM
+type idempotencyStore struct {
+	entries map[string]idempotentResponse
+	window  time.Duration
+	mu      sync.Mutex
+}
+
+// idempotentResponse is a stored response and when it stops being replayed
+type idempotentResponse struct {
+	response  *CompletionResponse
+	expiresAt time.Time
+}
+
+// newIdempotencyStore creates a store that keeps responses for window
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		entries: make(map[string]idempotentResponse),
+		window:  window,
+	}
+}
+
+// get returns a copy of the stored response for key if it is still within
+// the window, so callers can't change what later replays see
+func (s *idempotencyStore) get(key string) (*CompletionResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.entries[key]
+	if !exists || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	response := *entry.response
+	return &response, true
+}
+
+// put stores a copy of a response for key, pruning expired keys
+func (s *idempotencyStore) put(key string, resp *CompletionResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, k)
+		}
+	}
+	stored := *resp
+	s.entries[key] = idempotentResponse{
+		response:  &stored,
+		expiresAt: now.Add(s.window),
+	}
+}
@@ -0,0 +1,99 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        [2]string
+		wantCalls   int
+		wantLimited bool // second request exceeds the one-per-minute limit
+	}{
+		{"same key", [2]string{"k1", "k1"}, 1, false},
+		{"different keys", [2]string{"k1", "k2"}, 1, true},
+		{"no key", [2]string{"", ""}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.RateLimitEnabled = true
+			config.MaxRequestsPerMinute = 1
+			client := &EchoGrokkerClient{Completion: "x"}
+			service := newTestService(t, config, client)
+			pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+
+			complete := func(key string) (*CompletionResponse, error) {
+				req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, IdempotencyKey: key}
+				return service.Complete(context.Background(), req, pg)
+			}
+			first, err := complete(tt.keys[0])
+			if err != nil {
+				t.Fatalf("first Complete: %v", err)
+			}
+			second, err := complete(tt.keys[1])
+			if tt.wantLimited {
+				if !errors.Is(err, ErrRateLimitExceeded) {
+					t.Errorf("second Complete err = %v, want ErrRateLimitExceeded", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("replayed Complete: %v", err)
+				}
+				if second == first || !reflect.DeepEqual(second, first) {
+					t.Error("replayed request did not return a copy of the stored response")
+				}
+			}
+			if client.Calls() != tt.wantCalls {
+				t.Errorf("client called %d times, want %d", client.Calls(), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyIsPerProject(t *testing.T) {
+	client := &EchoGrokkerClient{Completion: "x"}
+	service := newTestService(t, testConfig(), client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	for _, project := range []string{"a", "b"} {
+		req := CompletionRequest{ProjectID: project, FilePath: "main.go", CursorLine: 1, IdempotencyKey: "k"}
+		if _, err := service.Complete(context.Background(), req, pg); err != nil {
+			t.Fatalf("Complete for project %s: %v", project, err)
+		}
+	}
+	if client.Calls() != 2 {
+		t.Errorf("client called %d times, want 2: the key must not be shared across projects", client.Calls())
+	}
+}
+
+func TestIdempotentReplayIsolated(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	client := &EchoGrokkerClient{Completion: "x"}
+	service := newTestService(t, config, client)
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, IdempotencyKey: "k"}
+
+	// Neither the first caller's nor a replaying caller's changes reach
+	// later replays or cache hits
+	for i := 0; i < 4; i++ {
+		if i == 3 {
+			req.IdempotencyKey = ""
+		}
+		resp, err := service.Complete(context.Background(), req, pg)
+		if err != nil {
+			t.Fatalf("Complete %d: %v", i, err)
+		}
+		if resp.Completion != "x" {
+			t.Errorf("Complete %d: Completion = %q, want x", i, resp.Completion)
+		}
+		resp.Completion = "mutated"
+	}
+	if client.Calls() != 1 {
+		t.Errorf("client called %d times, want 1", client.Calls())
+	}
+}
@@ -0,0 +1,134 @@
+package smartcomplete
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// importPatterns match the first line of an import statement per language,
+// as named by detectLanguage
+var importPatterns = map[string]*regexp.Regexp{
+	"Go":         regexp.MustCompile(`^import\b`),
+	"Python":     regexp.MustCompile(`^(import|from)\s`),
+	"JavaScript": regexp.MustCompile(`^(import\b|(const|let|var)\s.*=\s*require\()`),
+	"TypeScript": regexp.MustCompile(`^(import\b|(const|let|var)\s.*=\s*require\()`),
+	"Java":       regexp.MustCompile(`^import\s`),
+	"C":          regexp.MustCompile(`^#\s*include\b`),
+	"C++":        regexp.MustCompile(`^(#\s*include\b|using\s)`),
+	"Rust":       regexp.MustCompile(`^(pub\s+)?(use|extern\s+crate)\s`),
+	"Ruby":       regexp.MustCompile(`^require(_relative)?\s`),
+	"PHP":        regexp.MustCompile(`^(use|require|require_once|include|include_once)\b`),
+}
+
+// packagePatterns match a package, module or namespace declaration per
+// language, as named by detectLanguage
+var packagePatterns = map[string]*regexp.Regexp{
+	"Go":   regexp.MustCompile(`^package\s+\w+`),
+	"Java": regexp.MustCompile(`^package\s+[\w.]+\s*;`),
+	"PHP":  regexp.MustCompile(`^namespace\s+[\w\\]+\s*;`),
+	"C++":  regexp.MustCompile(`^namespace\s+[\w:]+\s*\{?$`),
+}
+
+// headerLine matches lines that may appear among imports without ending
+// the header: package declarations, comments and preprocessor lines
+var headerLine = regexp.MustCompile(`^(package\s|//|#|/\*|\*|<\?php|"use strict"|'use strict')`)
+
+// importBlock returns the start of prefix through its last import
+// statement, found heuristically for language, or "" if it has none. Only
+// the file header is searched: the first line that is not an import,
+// package declaration, comment or blank ends it. Multi-line statements
+// such as Go's import ( ... ) run until their brackets close.
+func importBlock(prefix, language string) string {
+	pattern, ok := importPatterns[language]
+	if !ok {
+		return ""
+	}
+
+	end := 0 // byte offset just past the last import line
+	depth := 0
+	offset := 0
+	for offset < len(prefix) {
+		lineEnd := strings.IndexByte(prefix[offset:], '\n')
+		if lineEnd < 0 {
+			// The cursor's line is never part of the block
+			break
+		}
+		line := strings.TrimSpace(prefix[offset : offset+lineEnd])
+		next := offset + lineEnd + 1
+
+		switch {
+		case depth > 0 || pattern.MatchString(line):
+			depth += strings.Count(line, "(") + strings.Count(line, "{") -
+				strings.Count(line, ")") - strings.Count(line, "}")
+			if depth < 0 {
+				depth = 0
+			}
+			end = next
+		case line == "" || headerLine.MatchString(line):
+		default:
+			return prefix[:end]
+		}
+		offset = next
+	}
+	if depth > 0 {
+		return ""
+	}
+	return prefix[:end]
+}
+
+// packageDecl returns the first line of prefix, newline included, that
+// declares its package or namespace for language, or "" if there is none.
+// The cursor's line is never returned.
+func packageDecl(prefix, language string) string {
+	pattern, ok := packagePatterns[language]
+	if !ok {
+		return ""
+	}
+	for offset := 0; offset < len(prefix); {
+		lineEnd := strings.IndexByte(prefix[offset:], '\n')
+		if lineEnd < 0 {
+			break
+		}
+		line := prefix[offset : offset+lineEnd+1]
+		if pattern.MatchString(strings.TrimSpace(line)) {
+			return line
+		}
+		offset += lineEnd + 1
+	}
+	return ""
+}
+
+// windowPrefix keeps about maxRunes of the end of prefix, plus the import
+// block with keepImports and the package declaration with keepPackage,
+// ahead of the kept tail, when they fit
+func windowPrefix(prefix, language string, maxRunes int, keepImports, keepPackage bool) string {
+	window := func(maxRunes int) string {
+		if keepImports {
+			return keepPrefixTailWithImports(prefix, language, maxRunes)
+		}
+		return keepPrefixTail(prefix, maxRunes)
+	}
+
+	kept := window(maxRunes)
+	if !keepPackage {
+		return kept
+	}
+	decl := packageDecl(prefix, language)
+	declRunes := utf8.RuneCountInString(decl)
+	if decl == "" || strings.Contains(kept, decl) || declRunes >= maxRunes {
+		return kept
+	}
+	return decl + window(maxRunes-declRunes)
+}
+
+// keepPrefixTailWithImports is keepPrefixTail that also keeps the prefix's
+// import block, ahead of the kept tail, when both fit within maxRunes
+func keepPrefixTailWithImports(prefix, language string, maxRunes int) string {
+	imports := importBlock(prefix, language)
+	importRunes := utf8.RuneCountInString(imports)
+	if imports == "" || importRunes >= maxRunes {
+		return keepPrefixTail(prefix, maxRunes)
+	}
+	return imports + keepPrefixTail(prefix[len(imports):], maxRunes-importRunes)
+}
@@ -0,0 +1,121 @@
+package smartcomplete
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestImportBlock(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		prefix   string
+		want     string
+	}{
+		{
+			"go block",
+			"Go",
+			"// Package main does things.\npackage main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n\t",
+			"// Package main does things.\npackage main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n",
+		},
+		{"go single", "Go", "package main\n\nimport \"fmt\"\n\nvar x = 1\n", "package main\n\nimport \"fmt\"\n"},
+		{"python", "Python", "import os\nfrom typing import List\n\ndef f():\n    ", "import os\nfrom typing import List\n"},
+		{"javascript require", "JavaScript", "'use strict'\nconst fs = require('fs')\n\nfs.", "'use strict'\nconst fs = require('fs')\n"},
+		{"no imports", "Go", "package main\n\nfunc main() {\n", ""},
+		{"unclosed block at cursor", "Go", "package main\n\nimport (\n\t\"fmt\"\n\t", ""},
+		{"unknown language", "code", "import x\n\ny\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := importBlock(tt.prefix, tt.language); got != tt.want {
+				t.Errorf("importBlock() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackageDecl(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		prefix   string
+		want     string
+	}{
+		{"go", "Go", "// Package main does things.\npackage main\n\nfunc main() {\n\t", "package main\n"},
+		{"java", "Java", "package com.example.app;\n\nclass A {\n", "package com.example.app;\n"},
+		{"php", "PHP", "<?php\nnamespace App\\Models;\n\nclass User {\n", "namespace App\\Models;\n"},
+		{"cursor line", "Go", "package ma", ""},
+		{"no declaration", "Python", "import os\n\ndef f():\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := packageDecl(tt.prefix, tt.language); got != tt.want {
+				t.Errorf("packageDecl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepHeaderInPrefixWindow(t *testing.T) {
+	var body []string
+	for i := 0; i < 400; i++ {
+		body = append(body, fmt.Sprintf("\tfmt.Println(%d)", i))
+	}
+	header := "// Package tools is big.\npackage tools\n\nimport (\n\t\"fmt\"\n)\n"
+	content := header + "\nfunc Run() {\n" + strings.Join(body, "\n") + "\n\t\n}\n"
+	pg := newFakeProject(map[string]string{"tools.go": content})
+	req := CompletionRequest{ProjectID: "p", FilePath: "tools.go", CursorLine: 408, CursorColumn: 1}
+
+	tests := []struct {
+		name        string
+		keepImports bool
+		keepPackage bool
+		wantStart   string // "" means the window starts in the body
+	}{
+		{"neither", false, false, ""},
+		{"keep_imports", true, false, header},
+		{"keep_package", false, true, "package tools\n"},
+		{"both", true, true, header},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.KeepImports = tt.keepImports
+			config.KeepPackage = tt.keepPackage
+			gatherer := newGatherer(config)
+			gatherer.maxTokens = 200
+
+			ctx, err := gatherer.GatherContext(context.Background(), req, content, pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			if ctx.Trim == nil {
+				t.Fatal("prefix was not trimmed")
+			}
+			if strings.Contains(ctx.Prefix, "func Run()") {
+				t.Fatal("the window still includes the top of the file")
+			}
+			if tt.wantStart == "" {
+				if strings.Contains(ctx.Prefix, "package tools") || strings.Contains(ctx.Prefix, "import (") {
+					t.Errorf("header kept without keep_imports or keep_package; prefix starts %q", truncateHead(ctx.Prefix, 80))
+				}
+			} else if !strings.HasPrefix(ctx.Prefix, tt.wantStart) {
+				t.Errorf("prefix starts %q, want %q", truncateHead(ctx.Prefix, 80), tt.wantStart)
+			}
+			if n := strings.Count(ctx.Prefix, "package tools"); n > 1 {
+				t.Errorf("package line repeated %d times", n)
+			}
+			if !tt.keepImports && strings.Contains(ctx.Prefix, "import (") {
+				t.Error("import block kept without keep_imports")
+			}
+			if !strings.HasSuffix(ctx.Prefix, "fmt.Println(399)\n\t") {
+				t.Errorf("prefix lost the code before the cursor: ends %q", truncateTail(ctx.Prefix, 40))
+			}
+			if tokens := estimateTokens(ctx.Prefix) + estimateTokens(ctx.Suffix); tokens > gatherer.maxTokens {
+				t.Errorf("code is ~%d tokens, over the %d budget", tokens, gatherer.maxTokens)
+			}
+		})
+	}
+}
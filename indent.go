@@ -0,0 +1,114 @@
+package smartcomplete
+
+import (
+	"strings"
+)
+
+// indentStyle describes how a file indents: with tabs, or with a number of
+// spaces per level
+type indentStyle struct {
+	tabs  bool
+	width int
+}
+
+// leadingWhitespace returns the indentation at the start of line
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// detectIndentStyle infers the indent style of text from its indented lines.
+// ok is false if no line is indented.
+func detectIndentStyle(text string) (style indentStyle, ok bool) {
+	tabLines, spaceLines := 0, 0
+	width := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := leadingWhitespace(line)
+		switch {
+		case strings.HasPrefix(indent, "\t"):
+			tabLines++
+		case len(indent) > 0:
+			spaceLines++
+			if width == 0 || len(indent) < width {
+				width = len(indent)
+			}
+		}
+	}
+	if tabLines == 0 && spaceLines == 0 {
+		return indentStyle{}, false
+	}
+	if tabLines >= spaceLines {
+		return indentStyle{tabs: true, width: 1}, true
+	}
+	return indentStyle{width: width}, true
+}
+
+// convertIndent rewrites the leading indentation of line from one style to another
+func convertIndent(line string, from, to indentStyle) string {
+	indent := leadingWhitespace(line)
+	if indent == "" {
+		return line
+	}
+
+	levels := strings.Count(indent, "\t")
+	spaces := strings.Count(indent, " ")
+	if from.width > 0 {
+		levels += spaces / from.width
+		spaces %= from.width
+	}
+
+	var unit string
+	if to.tabs {
+		unit = "\t"
+	} else {
+		unit = strings.Repeat(" ", to.width)
+	}
+	return strings.Repeat(unit, levels) + strings.Repeat(" ", spaces) + line[len(indent):]
+}
+
+// normalizeIndentation converts the completion to the file's indent style and,
+// if the completion's continuation lines assume zero indentation, re-indents
+// them relative to the line the cursor is on. The first line continues the
+// cursor line and is left as is.
+func normalizeIndentation(completion, prefix, suffix string) string {
+	lines := strings.Split(completion, "\n")
+	if len(lines) < 2 {
+		return completion
+	}
+
+	fileStyle, fileOK := detectIndentStyle(prefix + "\n" + suffix)
+	completionStyle, completionOK := detectIndentStyle(strings.Join(lines[1:], "\n"))
+	if fileOK && completionOK && fileStyle != completionStyle {
+		for i := 1; i < len(lines); i++ {
+			lines[i] = convertIndent(lines[i], completionStyle, fileStyle)
+		}
+	}
+
+	cursorLine := prefix[strings.LastIndex(prefix, "\n")+1:]
+	cursorIndent := leadingWhitespace(cursorLine)
+	if cursorIndent == "" {
+		return strings.Join(lines, "\n")
+	}
+
+	// Only shift when some line sits at column zero; otherwise the model
+	// already accounted for the surrounding indentation
+	atColumnZero := false
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) != "" && leadingWhitespace(line) == "" {
+			atColumnZero = true
+			break
+		}
+	}
+	if !atColumnZero {
+		return strings.Join(lines, "\n")
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "" {
+			lines[i] = cursorIndent + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,56 @@
+package smartcomplete
+
+import "testing"
+
+func TestNormalizeIndentation(t *testing.T) {
+	tests := []struct {
+		name       string
+		completion string
+		prefix     string
+		suffix     string
+		expected   string
+	}{
+		{
+			name:       "zero indent into two tab levels",
+			completion: "x := 1\nif x > 0 {\n\ty()\n}",
+			prefix:     "func f() {\n\tfor {\n\t\t",
+			suffix:     "\n\t}\n}",
+			expected:   "x := 1\n\t\tif x > 0 {\n\t\t\ty()\n\t\t}",
+		},
+		{
+			name:       "zero indent into two space levels",
+			completion: "a = 1\nif a:\n  b()",
+			prefix:     "def f():\n  while True:\n    ",
+			suffix:     "\n",
+			expected:   "a = 1\n    if a:\n      b()",
+		},
+		{
+			name:       "already indented",
+			completion: "x := 1\n\t\ty()",
+			prefix:     "func f() {\n\tfor {\n\t\t",
+			suffix:     "\n\t}\n}",
+			expected:   "x := 1\n\t\ty()",
+		},
+		{
+			name:       "spaces converted to the file's tabs",
+			completion: "x := 1\n    if x {\n        y()\n    }",
+			prefix:     "func f() {\n\ta := 0\n\t",
+			suffix:     "\n}",
+			expected:   "x := 1\n\tif x {\n\t\ty()\n\t}",
+		},
+		{
+			name:       "single line untouched",
+			completion: "  x := 1",
+			prefix:     "func f() {\n\t",
+			suffix:     "\n}",
+			expected:   "  x := 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeIndentation(tt.completion, tt.prefix, tt.suffix); got != tt.expected {
+				t.Errorf("normalizeIndentation() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package smartcomplete
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CursorIntent is a heuristic guess at what the code at the cursor is
+type CursorIntent string
+
+// Cursor intents, as classified by classifyCursor
+const (
+	IntentExpression  CursorIntent = "expression" // ordinary code
+	IntentDeclaration CursorIntent = "declaration"
+	IntentComment     CursorIntent = "comment"
+	IntentString      CursorIntent = "string"
+)
+
+// commentSyntax describes a language's comments for classifyCursor
+type commentSyntax struct {
+	line  []string // line comment markers
+	block bool     // C-style /* */ comments
+}
+
+// commentSyntaxes are keyed by detectLanguage names; other languages,
+// including "code", use C-style comments
+var commentSyntaxes = map[string]commentSyntax{
+	"Python": {line: []string{"#"}},
+	"Ruby":   {line: []string{"#"}},
+	"Shell":  {line: []string{"#"}},
+	"PHP":    {line: []string{"//", "#"}, block: true},
+}
+
+var cStyleComments = commentSyntax{line: []string{"//"}, block: true}
+
+// declarationLine matches a line ending just after a declaration keyword,
+// optionally followed by a Go method receiver and a partial name
+var declarationLine = regexp.MustCompile(
+	`(^|[^\w.])(func|def|class|fn|function|type|struct|interface|enum|trait|impl|var|const|let)\s+(\([^)]*\)\s*)?\w*$`,
+)
+
+// classifyCursor guesses the intent at the end of prefix. It scans the
+// prefix tracking comments and string literals for language, so a prefix
+// trimmed mid-comment or mid-string can be misread.
+func classifyCursor(prefix, language string) CursorIntent {
+	syntax, ok := commentSyntaxes[language]
+	if !ok {
+		syntax = cStyleComments
+	}
+
+	// quote is the closing delimiter of the string the scan is in, "" if none
+	var quote string
+	inLineComment, inBlockComment := false, false
+	for i := 0; i < len(prefix); i++ {
+		rest := prefix[i:]
+		switch {
+		case inLineComment:
+			if prefix[i] == '\n' {
+				inLineComment = false
+			}
+		case inBlockComment:
+			if strings.HasPrefix(rest, "*/") {
+				inBlockComment = false
+				i++
+			}
+		case quote != "":
+			switch {
+			case prefix[i] == '\\' && quote != "`":
+				i++
+			case strings.HasPrefix(rest, quote):
+				i += len(quote) - 1
+				quote = ""
+			case prefix[i] == '\n' && len(quote) == 1 && quote != "`":
+				// Unterminated single-line string
+				quote = ""
+			}
+		case syntax.block && strings.HasPrefix(rest, "/*"):
+			inBlockComment = true
+			i++
+		case hasAnyPrefix(rest, syntax.line):
+			inLineComment = true
+		default:
+			if quote = openingQuote(rest, language); quote != "" {
+				i += len(quote) - 1
+			}
+		}
+	}
+
+	switch {
+	case inLineComment || inBlockComment:
+		return IntentComment
+	case quote != "":
+		return IntentString
+	}
+	lastLine := prefix[strings.LastIndexByte(prefix, '\n')+1:]
+	if declarationLine.MatchString(lastLine) {
+		return IntentDeclaration
+	}
+	return IntentExpression
+}
+
+// openingQuote returns the string delimiter rest starts with, or ""
+func openingQuote(rest, language string) string {
+	switch {
+	case language == "Python" && (strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, `'''`)):
+		return rest[:3]
+	case rest[0] == '"':
+		return `"`
+	case rest[0] == '\'' && language != "Rust": // Rust lifetimes are unpaired
+		return "'"
+	case rest[0] == '`' && language != "Shell":
+		return "`"
+	}
+	return ""
+}
+
+// hasAnyPrefix reports whether s starts with any of prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// inText reports whether the cursor is in a comment or string, where code
+// completion instructions would produce code in place of text
+func (i CursorIntent) inText() bool {
+	return i == IntentComment || i == IntentString
+}
+
+// intentInstruction returns the prompt line describing intent, or "" for
+// ordinary code. For comments and strings it replaces the code instructions.
+func intentInstruction(intent CursorIntent) string {
+	switch intent {
+	case IntentDeclaration:
+		return "The cursor follows a declaration keyword; complete the name, signature or body the preceding code suggests.\n"
+	case IntentComment:
+		return "The cursor is inside a comment. Complete the comment naturally, in prose; do not write code.\n"
+	case IntentString:
+		return "The cursor is inside a string literal. Complete the string naturally, ending it where its text ends.\n"
+	default:
+		return ""
+	}
+}
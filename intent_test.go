@@ -0,0 +1,108 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestClassifyCursor(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		language string
+		want     CursorIntent
+	}{
+		{"inside a string", "package main\n\nvar greeting = \"hello, ", "Go", IntentString},
+		{"inside a raw string", "var q = `SELECT *\nFROM ", "Go", IntentString},
+		{"after a closed string", "fmt.Println(\"hi // there\", ", "Go", IntentExpression},
+		{"escaped quote", `s := "say \"hi`, "Go", IntentString},
+		{"inside a line comment", "package main\n\n// Add returns ", "Go", IntentComment},
+		{"inside a block comment", "/* Package main\n * does ", "Go", IntentComment},
+		{"after a block comment", "/* done */ x := ", "Go", IntentExpression},
+		{"python comment", "def f():\n    # compute the ", "Python", IntentComment},
+		{"python docstring", "def f():\n    \"\"\"Return the\n    ", "Python", IntentString},
+		{"after func", "package main\n\nfunc ", "Go", IntentDeclaration},
+		{"partial func name", "func Add", "Go", IntentDeclaration},
+		{"after a method receiver", "func (s *Server) ", "Go", IntentDeclaration},
+		{"after def", "class A:\n    def ", "Python", IntentDeclaration},
+		{"rust lifetime", "fn f<'a>(x: &'a str) -> ", "Rust", IntentExpression},
+		{"expression", "x := compute(", "Go", IntentExpression},
+		{"func keyword inside a comment", "// func ", "Go", IntentComment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyCursor(tt.prefix, tt.language); got != tt.want {
+				t.Errorf("classifyCursor(%q) = %q, want %q", tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCursorIntentInPrompt(t *testing.T) {
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, testConfig(), client)
+
+	pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc \n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, CursorColumn: 5}
+	if _, err := service.Complete(context.Background(), req, pg); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if want := intentInstruction(IntentDeclaration); !strings.Contains(client.lastPrompt(), want) {
+		t.Errorf("prompt does not contain %q:\n%s", want, client.lastPrompt())
+	}
+}
+
+func TestCommentAndStringInstructions(t *testing.T) {
+	content := "package main\n\n// Add returns the \nvar greeting = \"hello, \n\nx := \n"
+	tests := []struct {
+		name   string
+		line   int
+		col    int
+		want   string
+		noCode bool // the code instructions are left out
+	}{
+		{"inside a comment", 2, len("// Add returns the "), "Complete the comment naturally", true},
+		{"inside a string", 3, len("var greeting = \"hello, "), "Complete the string naturally", true},
+		{"in code", 5, len("x := "), "Provide syntactically correct", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+			service := newTestService(t, testConfig(), client)
+
+			pg := newFakeProject(map[string]string{"main.go": content})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: tt.line, CursorColumn: tt.col}
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			prompt := client.lastPrompt()
+			if !strings.Contains(prompt, tt.want) {
+				t.Errorf("prompt does not contain %q:\n%s", tt.want, prompt)
+			}
+			if tt.noCode && strings.Contains(prompt, "Provide syntactically correct") {
+				t.Errorf("prompt still asks for code:\n%s", prompt)
+			}
+		})
+	}
+}
+
+func TestSkipCommentsStrings(t *testing.T) {
+	config := testConfig()
+	config.SkipCommentsStrings = true
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, config, client)
+
+	pg := newFakeProject(map[string]string{"main.go": "package main\n\n// Add returns the \n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, CursorColumn: 19}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if !resp.Skipped || resp.Completion != "" {
+		t.Errorf("response = %+v, want a skipped, empty completion", resp)
+	}
+	if prompt := client.lastPrompt(); prompt != "" {
+		t.Errorf("client was queried for a skipped completion:\n%s", prompt)
+	}
+}
@@ -0,0 +1,124 @@
+package smartcomplete
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the completion
+// latency histogram
+var latencyBuckets = [...]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics counts completions, errors by code, cache hits and completion
+// latency, and writes them in the Prometheus text exposition format. It is
+// safe for concurrent use; counters are updated without locks. The zero
+// value is ready to use.
+type Metrics struct {
+	completions atomic.Int64
+	cacheHits   atomic.Int64
+	errors      sync.Map // error code -> *atomic.Int64
+
+	// latencyCounts[i] counts latencies in (latencyBuckets[i-1],
+	// latencyBuckets[i]]; the last slot counts those above every bound
+	latencyCounts [len(latencyBuckets) + 1]atomic.Int64
+	latencySumUs  atomic.Int64
+}
+
+// NewMetrics creates an empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// observe records the outcome of one Complete call
+func (m *Metrics) observe(resp *CompletionResponse, err error, latency time.Duration) {
+	if err != nil {
+		counter, _ := m.errors.LoadOrStore(errorCode(err), new(atomic.Int64))
+		counter.(*atomic.Int64).Add(1)
+		return
+	}
+
+	m.completions.Add(1)
+	if resp.CachedResult {
+		m.cacheHits.Add(1)
+	}
+	seconds := latency.Seconds()
+	bucket := sort.SearchFloat64s(latencyBuckets[:], seconds)
+	m.latencyCounts[bucket].Add(1)
+	m.latencySumUs.Add(latency.Microseconds())
+}
+
+// errorCode returns the CompletionError code for err, mapping the bare
+// request errors to the code they would carry
+func errorCode(err error) string {
+	var completionErr *CompletionError
+	switch {
+	case errors.As(err, &completionErr):
+		return completionErr.Code
+	case errors.Is(err, ErrInvalidRequest):
+		return CodeValidation
+	case errors.Is(err, ErrFileNotAuthorized), errors.Is(err, ErrFileNotFound):
+		return CodeFileAccess
+	default:
+		return CodeInternal
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	ew := &errWriter{w: w}
+
+	ew.printf("# HELP smartcomplete_completions_total Completions returned, cached ones included.\n")
+	ew.printf("# TYPE smartcomplete_completions_total counter\n")
+	ew.printf("smartcomplete_completions_total %d\n", m.completions.Load())
+
+	ew.printf("# HELP smartcomplete_cache_hits_total Completions served from the cache.\n")
+	ew.printf("# TYPE smartcomplete_cache_hits_total counter\n")
+	ew.printf("smartcomplete_cache_hits_total %d\n", m.cacheHits.Load())
+
+	ew.printf("# HELP smartcomplete_errors_total Failed completions by error code.\n")
+	ew.printf("# TYPE smartcomplete_errors_total counter\n")
+	var codes []string
+	m.errors.Range(func(code, _ any) bool {
+		codes = append(codes, code.(string))
+		return true
+	})
+	sort.Strings(codes)
+	for _, code := range codes {
+		counter, _ := m.errors.Load(code)
+		ew.printf("smartcomplete_errors_total{code=%q} %d\n", code, counter.(*atomic.Int64).Load())
+	}
+
+	ew.printf("# HELP smartcomplete_completion_latency_seconds Latency of successful completions.\n")
+	ew.printf("# TYPE smartcomplete_completion_latency_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range latencyBuckets {
+		cumulative += m.latencyCounts[i].Load()
+		ew.printf("smartcomplete_completion_latency_seconds_bucket{le=%q} %d\n",
+			strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += m.latencyCounts[len(latencyBuckets)].Load()
+	ew.printf("smartcomplete_completion_latency_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	ew.printf("smartcomplete_completion_latency_seconds_sum %g\n", float64(m.latencySumUs.Load())/1e6)
+	ew.printf("smartcomplete_completion_latency_seconds_count %d\n", cumulative)
+
+	return ew.err
+}
+
+// errWriter keeps the first write error and skips writes after it
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...any) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
@@ -0,0 +1,65 @@
+package smartcomplete
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWritePrometheus(t *testing.T) {
+	config := testConfig()
+	config.EnableCache = true
+	service := newTestService(t, config, &EchoGrokkerClient{Completion: "x++"})
+	metrics := NewMetrics()
+	service.SetMetrics(metrics)
+
+	fake := newFakeProject(map[string]string{"main.go": "package main\n"})
+	fake.authorized = []string{"main.go"}
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, CursorColumn: 0}
+	for i := 0; i < 2; i++ {
+		if _, err := service.Complete(context.Background(), req, fake); err != nil {
+			t.Fatalf("Complete %d: %v", i, err)
+		}
+	}
+	if _, err := service.Complete(context.Background(), CompletionRequest{ProjectID: "p", FilePath: "secret.go"}, fake); err == nil {
+		t.Fatal("Complete of an unauthorized file succeeded")
+	}
+	if _, err := service.Complete(context.Background(), CompletionRequest{ProjectID: "p"}, fake); err == nil {
+		t.Fatal("Complete without a file path succeeded")
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE smartcomplete_completions_total counter\n",
+		"smartcomplete_completions_total 2\n",
+		"smartcomplete_cache_hits_total 1\n",
+		`smartcomplete_errors_total{code="FILE_ACCESS"} 1` + "\n",
+		`smartcomplete_errors_total{code="VALIDATION_ERROR"} 1` + "\n",
+		"# TYPE smartcomplete_completion_latency_seconds histogram\n",
+		`smartcomplete_completion_latency_seconds_bucket{le="+Inf"} 2` + "\n",
+		"smartcomplete_completion_latency_seconds_count 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsZeroValue(t *testing.T) {
+	var metrics Metrics
+	metrics.observe(&CompletionResponse{}, nil, 75*time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus: %v", err)
+	}
+	if want := `smartcomplete_completion_latency_seconds_bucket{le="0.1"} 1` + "\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("output is missing %q:\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,82 @@
+package smartcomplete
+
+import (
+	"strings"
+)
+
+// Completion modes control how much code the LLM is asked to produce
+const (
+	ModeLine     = "line"
+	ModeBlock    = "block"
+	ModeFunction = "function"
+)
+
+// modeMaxTokens is the default MaxTokens per mode, capped by Config.MaxTokens
+var modeMaxTokens = map[string]int{
+	ModeLine:     64,
+	ModeBlock:    256,
+	ModeFunction: 512,
+}
+
+// validMode reports whether mode is empty or a known mode
+func validMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	_, ok := modeMaxTokens[mode]
+	return ok
+}
+
+// modeInstruction returns the FIM instruction line for a mode
+func modeInstruction(mode string) string {
+	switch mode {
+	case ModeLine:
+		return "Complete only the rest of the current line.\n"
+	case ModeBlock:
+		return "Complete the current block, stopping where the enclosing block ends.\n"
+	case ModeFunction:
+		return "Complete the entire enclosing function, stopping at its end.\n"
+	default:
+		return "Complete only the code at the cursor position.\n"
+	}
+}
+
+// truncateForMode cuts a completion down to what its mode asked for
+func truncateForMode(completion, mode string) string {
+	switch mode {
+	case ModeLine:
+		if i := strings.IndexByte(completion, '\n'); i >= 0 {
+			return completion[:i]
+		}
+		return completion
+	case ModeBlock:
+		return truncateAtBlockEnd(completion, true)
+	case ModeFunction:
+		return truncateAtBlockEnd(completion, false)
+	default:
+		return completion
+	}
+}
+
+// truncateAtBlockEnd stops before the bracket that closes the block the
+// cursor is in. With stopAtBlankLine, a blank line at depth zero also ends
+// the completion, which covers indentation-based languages.
+func truncateAtBlockEnd(completion string, stopAtBlankLine bool) string {
+	depth := 0
+	for i := 0; i < len(completion); i++ {
+		switch completion[i] {
+		case '{', '(', '[':
+			depth++
+		case '}', ')', ']':
+			depth--
+			if depth < 0 {
+				return strings.TrimRight(completion[:i], " \t")
+			}
+		case '\n':
+			if stopAtBlankLine && depth == 0 && strings.HasPrefix(completion[i+1:], "\n") {
+				return completion[:i]
+			}
+		}
+	}
+	return completion
+}
@@ -0,0 +1,153 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCompletionModes(t *testing.T) {
+	// Completes the current statement, then the block, then starts another
+	// function after the one the cursor is in
+	const completion = "x++\n\tif x > 0 {\n\t\ty()\n\t}\n\n\tz()\n}\n\nfunc next() {}"
+	tests := []struct {
+		mode       string
+		wantPrompt string
+		wantResult string
+	}{
+		{"", "Complete only the code at the cursor position.", completion},
+		{ModeLine, "Complete only the rest of the current line.", "x++"},
+		{ModeBlock, "Complete the current block", "x++\n\tif x > 0 {\n\t\ty()\n\t}"},
+		{ModeFunction, "Complete the entire enclosing function", "x++\n\tif x > 0 {\n\t\ty()\n\t}\n\n\tz()\n"},
+	}
+	for _, tt := range tests {
+		t.Run("mode "+tt.mode, func(t *testing.T) {
+			if got := truncateForMode(completion, tt.mode); got != tt.wantResult {
+				t.Errorf("truncateForMode() = %q, want %q", got, tt.wantResult)
+			}
+
+			pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc f() {\n\t\n}\n"})
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: completion}}
+			service := newTestService(t, testConfig(), client)
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1, Mode: tt.mode}
+
+			if _, err := service.Complete(context.Background(), req, pg); err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if prompt := client.lastPrompt(); !strings.Contains(prompt, tt.wantPrompt) {
+				t.Errorf("prompt does not contain %q:\n%s", tt.wantPrompt, prompt)
+			}
+		})
+	}
+}
+
+func TestUnknownModeRejected(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{})
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", Mode: "paragraph"}
+	if _, err := service.Complete(context.Background(), req, pg); err == nil {
+		t.Error("Complete accepted an unknown mode")
+	}
+}
+
+// stopClient is an EchoGrokkerClient that records the stop sequences it is
+// asked to use
+type stopClient struct {
+	EchoGrokkerClient
+	stops [][]string
+}
+
+func (c *stopClient) QueryWithStop(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64, stop []string) (string, int, error) {
+	c.stops = append(c.stops, stop)
+	return c.EchoGrokkerClient.Query(ctx, llm, systemMsg, userMsg, maxTokens)
+}
+
+// cuttingStopClient is a stopClient that, like a provider, ends its
+// completion at the first match of any stop sequence
+type cuttingStopClient struct {
+	stopClient
+}
+
+func (c *cuttingStopClient) QueryWithStop(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64, stop []string) (string, int, error) {
+	completion, tokens, err := c.stopClient.QueryWithStop(ctx, llm, systemMsg, userMsg, maxTokens, temperature, stop)
+	for _, s := range stop {
+		if i := strings.Index(completion, s); i >= 0 {
+			completion = completion[:i]
+		}
+	}
+	return completion, tokens, err
+}
+
+func TestSuffixStopSequence(t *testing.T) {
+	pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc f() error {\n\t\n\n\treturn err\n}\n"})
+	completion := "err := g()\n\tif err != nil {\n\t\treturn err\n\t}\n\treturn err\n}"
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}
+	tests := []struct {
+		name      string
+		stopAt    bool
+		wantStops string
+	}{
+		{"off by default", false, ""},
+		{"stop_at_suffix", true, "\n\treturn err\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &cuttingStopClient{stopClient{EchoGrokkerClient: EchoGrokkerClient{Completion: completion}}}
+			config := testConfig()
+			config.StopAtSuffix = tt.stopAt
+			service := newTestService(t, config, client)
+
+			resp, err := service.Complete(context.Background(), req, pg)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			var stops []string
+			for _, s := range client.stops {
+				stops = append(stops, strings.Join(s, ","))
+			}
+			if strings.Join(stops, ";") != tt.wantStops {
+				t.Errorf("stop sequences = %q, want %q", client.stops, tt.wantStops)
+			}
+			// The suffix's first line, nested deeper in the completion,
+			// doesn't end it
+			if !strings.Contains(resp.Completion, "\t\treturn err\n\t}") {
+				t.Errorf("Completion = %q, cut at the nested copy of the suffix's first line", resp.Completion)
+			}
+		})
+	}
+}
+
+func TestSingleLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string // the cursor's line; the cursor is at "|"
+		completion string
+		want       string
+	}{
+		{"multiline output", "\tx :=|", " compute()\n\ty := 2\n", " compute()"},
+		{"space before cursor not repeated", "\tx := |", "  compute()  \n", "compute()"},
+		{"trailing space kept before text", "\tx := |b", "a + \n", "a + "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after, _ := strings.Cut(tt.line, "|")
+			pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc f() {\n" + before + after + "\n}\n"})
+			client := &stopClient{EchoGrokkerClient: EchoGrokkerClient{Completion: tt.completion}}
+			config := testConfig()
+			config.SingleLine = true
+			service := newTestService(t, config, client)
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: len(before)}
+
+			resp, err := service.Complete(context.Background(), req, pg)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if resp.Completion != tt.want {
+				t.Errorf("Completion = %q, want %q", resp.Completion, tt.want)
+			}
+			if len(client.stops) != 1 || strings.Join(client.stops[0], ",") != "\n" {
+				t.Errorf("stop sequences = %q, want [\"\\n\"]", client.stops)
+			}
+		})
+	}
+}
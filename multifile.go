@@ -0,0 +1,252 @@
+package smartcomplete
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CompletionTarget is one insertion point in a multi-file completion
+type CompletionTarget struct {
+	FilePath     string `json:"filePath"`
+	CursorLine   int    `json:"cursorLine"`
+	CursorColumn int    `json:"cursorColumn"`
+}
+
+// MultiFileRequest asks for coordinated completions across several files
+type MultiFileRequest struct {
+	ProjectID    string             `json:"projectId"`
+	Targets      []CompletionTarget `json:"targets"`
+	LLM          string             `json:"llm,omitempty"`
+	MaxTokens    int                `json:"maxTokens,omitempty"`
+	ContextFiles []string           `json:"contextFiles,omitempty"`
+	Instruction  string             `json:"instruction,omitempty"`
+}
+
+// MultiFileResponse contains one completion per target file
+type MultiFileResponse struct {
+	Completions map[string]string `json:"completions"` // keyed by target FilePath
+	LatencyMs   int64             `json:"latencyMs"`
+	Model       string            `json:"model"`
+	TokensUsed  int               `json:"tokensUsed"`
+	Timestamp   time.Time         `json:"timestamp"`
+
+	// Warnings lists context files left out of the prompt, for any target
+	Warnings []ContextWarning `json:"warnings,omitempty"`
+}
+
+// Markers delimiting each file's completion in a multi-file LLM response
+const (
+	multiFileStart = "<<<FILE "
+	multiFileEnd   = "<<<END>>>"
+)
+
+// CompleteMultiFile generates coordinated completions for several insertion
+// points in one LLM call. Each target's code is gathered within a share of
+// the context budget; project-wide sections (instructions, discussion,
+// related files, providers) are gathered once, with the first.
+func (s *CompletionService) CompleteMultiFile(
+	ctx context.Context,
+	req MultiFileRequest,
+	projectGetter ProjectGetter,
+) (*MultiFileResponse, error) {
+	startTime := time.Now()
+
+	if len(req.Targets) == 0 {
+		return nil, fmt.Errorf("%w: no targets", ErrInvalidRequest)
+	}
+
+	// Validate every target before spending a rate-limit slot
+	requests := make([]CompletionRequest, len(req.Targets))
+	seen := make(map[string]bool, len(req.Targets))
+	for i, target := range req.Targets {
+		if seen[target.FilePath] {
+			return nil, fmt.Errorf("%w: duplicate target %s", ErrInvalidRequest, target.FilePath)
+		}
+		seen[target.FilePath] = true
+		requests[i] = CompletionRequest{
+			ProjectID:    req.ProjectID,
+			FilePath:     target.FilePath,
+			CursorLine:   target.CursorLine,
+			CursorColumn: target.CursorColumn,
+			LLM:          req.LLM,
+			MaxTokens:    req.MaxTokens,
+			ContextFiles: req.ContextFiles,
+			Instruction:  req.Instruction,
+		}
+		if err := s.validateRequest(requests[i], projectGetter); err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := projectConfig(s.currentConfig(), req.ProjectID, projectGetter)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkRateLimit(req.ProjectID, config); err != nil {
+		return nil, err
+	}
+	ctx, cancel := requestDeadline(ctx, config)
+	defer cancel()
+
+	llm := req.LLM
+	if llm == "" {
+		llm = config.DefaultLLM
+	}
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = config.MaxTokens
+	}
+
+	budget, err := contextBudget(config, llm, maxTokens)
+	if err != nil {
+		return nil, err
+	}
+	// Project-wide sections are gathered once, with the first target. The
+	// others get only their code, each within an equal share of the budget;
+	// the first target's sections get whatever the others leave.
+	baseDir, _ := projectGetter.GetProjectBaseDir(req.ProjectID)
+	gatherCtx, cancelGather := gatherContextDeadline(ctx, config)
+	defer cancelGather()
+	share := budget / len(requests)
+	remaining := budget
+	contexts := make([]*CompletionContext, len(requests))
+	for i := len(requests) - 1; i >= 0; i-- {
+		r := requests[i]
+		gatherer := s.requestGatherer(config, max(remaining, 0))
+		if i > 0 {
+			r.SkipAgentsInstructions, r.SkipDiscussion = true, true
+			r.ExcludeSections = ExcludeSections{AdditionalFiles: true, OpenFiles: true, RecentChanges: true, Providers: true}
+			gatherer.maxTokens = share
+			gatherer.preamble = ""
+		}
+		fileContent, err := loadTarget(r, config, projectGetter, resolveTarget(r, baseDir))
+		if err != nil {
+			return nil, err
+		}
+		contexts[i], err = gatherer.GatherContext(gatherCtx, r, string(fileContent), projectGetter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to gather context for %s: %w", r.FilePath, err)
+		}
+		remaining -= contextTokens(contexts[i])
+	}
+
+	if s.grokker == nil {
+		return nil, fmt.Errorf("grokker client not set")
+	}
+
+	prompt := formatMultiFilePrompt(req.Targets, contexts, config.FileHeaderStyle)
+	if config.MaxPromptTokens > 0 {
+		if promptTokens := estimateTokens(prompt); promptTokens > config.MaxPromptTokens {
+			return nil, WrapContextError(
+				fmt.Sprintf("prompt is ~%d tokens, over max_prompt_tokens %d", promptTokens, config.MaxPromptTokens),
+				ErrContextTooLarge,
+			)
+		}
+	}
+	systemMsg := "You are an expert code completion assistant. Complete the code at each marked cursor position. Output ONLY the completions in the requested format."
+	result, err := s.query(ctx, llm, systemMsg, prompt, maxTokens, temperature(requests[0], config), nil)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	completions, err := parseMultiFileResponse(result.text, req.Targets)
+	if err != nil {
+		return nil, err
+	}
+	for i, target := range req.Targets {
+		completions[target.FilePath] = postProcessCompletion(completions[target.FilePath], contexts[i])
+	}
+
+	var warnings []ContextWarning
+	for _, c := range contexts {
+		warnings = append(warnings, c.Warnings...)
+	}
+
+	return &MultiFileResponse{
+		Completions: completions,
+		LatencyMs:   time.Since(startTime).Milliseconds(),
+		Model:       result.model,
+		TokensUsed:  result.tokens,
+		Timestamp:   time.Now(),
+		Warnings:    warnings,
+	}, nil
+}
+
+// formatMultiFilePrompt describes every insertion point in one prompt,
+// labelling related files according to fileHeaders
+func formatMultiFilePrompt(targets []CompletionTarget, contexts []*CompletionContext, fileHeaders string) string {
+	var prompt strings.Builder
+
+	writeContextSections(&prompt, contexts[0], fileHeaders)
+
+	for i, target := range targets {
+		ctx := contexts[i]
+		prompt.WriteString(fmt.Sprintf("=== INSERTION POINT %d: %s (%s) ===\n", i+1, target.FilePath, ctx.Language))
+		prompt.WriteString("CODE BEFORE CURSOR:\n")
+		prompt.WriteString(ctx.Prefix)
+		prompt.WriteString("\n\n")
+		prompt.WriteString("CODE AFTER CURSOR:\n")
+		prompt.WriteString(ctx.Suffix)
+		prompt.WriteString("\n\n")
+	}
+
+	if contexts[0].Instruction != "" {
+		prompt.WriteString("USER INSTRUCTION:\n")
+		prompt.WriteString(contexts[0].Instruction)
+		prompt.WriteString("\n\n")
+	}
+
+	prompt.WriteString("INSTRUCTIONS:\n")
+	prompt.WriteString("Complete the code at every insertion point so the edits work together.\n")
+	prompt.WriteString("Do not repeat the code before or after any cursor.\n")
+	prompt.WriteString("For each insertion point, output exactly:\n")
+	prompt.WriteString(multiFileStart + "<file path>>>\n<completion>\n" + multiFileEnd + "\n")
+	prompt.WriteString("Output nothing else.\n")
+
+	return prompt.String()
+}
+
+// parseMultiFileResponse splits a multi-file LLM response into per-file
+// completions. Every target must appear exactly once; blocks for paths that
+// aren't targets are dropped.
+func parseMultiFileResponse(raw string, targets []CompletionTarget) (map[string]string, error) {
+	isTarget := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		isTarget[target.FilePath] = true
+	}
+	completions := make(map[string]string, len(targets))
+	rest := raw
+	for {
+		start := strings.Index(rest, multiFileStart)
+		if start < 0 {
+			break
+		}
+		rest = rest[start+len(multiFileStart):]
+
+		headerEnd := strings.Index(rest, ">>>")
+		if headerEnd < 0 {
+			return nil, WrapLLMError("malformed multi-file response header", nil)
+		}
+		path := strings.TrimSpace(rest[:headerEnd])
+		rest = strings.TrimPrefix(rest[headerEnd+len(">>>"):], "\n")
+
+		end := strings.Index(rest, multiFileEnd)
+		if end < 0 {
+			return nil, WrapLLMError(fmt.Sprintf("unterminated completion for %s", path), nil)
+		}
+		if isTarget[path] {
+			completions[path] = strings.TrimSuffix(rest[:end], "\n")
+		}
+		rest = rest[end+len(multiFileEnd):]
+	}
+
+	for _, target := range targets {
+		if _, ok := completions[target.FilePath]; !ok {
+			return nil, WrapLLMError(fmt.Sprintf("no completion returned for %s", target.FilePath), nil)
+		}
+	}
+	return completions, nil
+}
@@ -0,0 +1,217 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestCompleteMultiFile(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"api.go":    "package api\n\nfunc Handler() {\n\t\n}\n",
+		"client.go": "package api\n\nfunc Call() {\n\t\n}\n",
+	})
+	output := "<<<FILE api.go>>>\nserve(newRoute())\n<<<END>>>\n" +
+		"<<<FILE client.go>>>\nrequest(newRoute())\n<<<END>>>\n"
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: output}}
+	service := newTestService(t, testConfig(), client)
+
+	req := MultiFileRequest{
+		ProjectID: "p",
+		Targets: []CompletionTarget{
+			{FilePath: "api.go", CursorLine: 3, CursorColumn: 1},
+			{FilePath: "client.go", CursorLine: 3, CursorColumn: 1},
+		},
+	}
+	resp, err := service.CompleteMultiFile(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("CompleteMultiFile: %v", err)
+	}
+	want := map[string]string{"api.go": "serve(newRoute())", "client.go": "request(newRoute())"}
+	for path, completion := range want {
+		if resp.Completions[path] != completion {
+			t.Errorf("completion for %s = %q, want %q", path, resp.Completions[path], completion)
+		}
+	}
+	if client.Calls() != 1 {
+		t.Errorf("client called %d times, want one combined query", client.Calls())
+	}
+	prompt := client.lastPrompt()
+	for _, header := range []string{"=== INSERTION POINT 1: api.go (Go) ===", "=== INSERTION POINT 2: client.go (Go) ==="} {
+		if !strings.Contains(prompt, header) {
+			t.Errorf("prompt does not contain %q", header)
+		}
+	}
+}
+
+func TestParseMultiFileResponse(t *testing.T) {
+	targets := []CompletionTarget{{FilePath: "a.go"}, {FilePath: "b.go"}}
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "both files",
+			raw:  "<<<FILE a.go>>>\nx()\n<<<END>>>\n<<<FILE b.go>>>\ny()\nz()\n<<<END>>>",
+			want: map[string]string{"a.go": "x()", "b.go": "y()\nz()"},
+		},
+		{
+			name: "chatter around blocks",
+			raw:  "Here you go:\n<<<FILE b.go>>>\ny()\n<<<END>>>\nand\n<<<FILE a.go>>>\nx()\n<<<END>>>\nDone.",
+			want: map[string]string{"a.go": "x()", "b.go": "y()"},
+		},
+		{
+			name: "file that isn't a target",
+			raw:  "<<<FILE a.go>>>\nx()\n<<<END>>>\n<<<FILE ../secret.go>>>\nevil()\n<<<END>>>\n<<<FILE b.go>>>\ny()\n<<<END>>>",
+			want: map[string]string{"a.go": "x()", "b.go": "y()"},
+		},
+		{name: "missing target", raw: "<<<FILE a.go>>>\nx()\n<<<END>>>", wantErr: true},
+		{name: "unterminated", raw: "<<<FILE a.go>>>\nx()\n<<<FILE b.go>>>\ny()", wantErr: true},
+		{name: "malformed header", raw: "<<<FILE a.go\nx()", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMultiFileResponse(tt.raw, targets)
+			if tt.wantErr {
+				var completionErr *CompletionError
+				if err == nil || !errors.As(err, &completionErr) {
+					t.Errorf("err = %v, want an LLM CompletionError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMultiFileResponse: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got completions for %d files, want %d: %q", len(got), len(tt.want), got)
+			}
+			for path, completion := range tt.want {
+				if got[path] != completion {
+					t.Errorf("completion for %s = %q, want %q", path, got[path], completion)
+				}
+			}
+		})
+	}
+}
+
+func TestCompleteMultiFileRejectsDuplicateTargets(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{})
+	pg := newFakeProject(map[string]string{"a.go": "package a\n"})
+	req := MultiFileRequest{ProjectID: "p", Targets: []CompletionTarget{{FilePath: "a.go"}, {FilePath: "a.go"}}}
+	if _, err := service.CompleteMultiFile(context.Background(), req, pg); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("err = %v, want ErrInvalidRequest", err)
+	}
+}
+
+func TestCompleteMultiFileHeaderStyle(t *testing.T) {
+	for _, style := range []string{FileHeaderNone, FileHeaderPath, FileHeaderVerbose} {
+		t.Run(style, func(t *testing.T) {
+			pg := newFakeProject(map[string]string{
+				"api.go":   "package api\n\nfunc Handler() {\n\t\n}\n",
+				"types.go": "package api\n\ntype Route struct{}\n",
+			})
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "<<<FILE api.go>>>\nx\n<<<END>>>\n"}}
+			config := testConfig()
+			config.FileHeaderStyle = style
+			service := newTestService(t, config, client)
+
+			req := MultiFileRequest{
+				ProjectID:    "p",
+				Targets:      []CompletionTarget{{FilePath: "api.go", CursorLine: 3, CursorColumn: 1}},
+				ContextFiles: []string{"types.go"},
+			}
+			if _, err := service.CompleteMultiFile(context.Background(), req, pg); err != nil {
+				t.Fatalf("CompleteMultiFile: %v", err)
+			}
+			header := fileHeader(FileContext{Path: "types.go", Content: "package api\n\ntype Route struct{}\n"}, style)
+			if !strings.Contains(client.lastPrompt(), header) {
+				t.Errorf("prompt does not label types.go with %q:\n%s", header, client.lastPrompt())
+			}
+		})
+	}
+}
+
+func TestCompleteMultiFileBudget(t *testing.T) {
+	files := make(map[string]string)
+	var targets []CompletionTarget
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		files[name] = "package main\n\nfunc f() {\n\t\n" + strings.Repeat("\tprintln(\"padding the file out\")\n", 400) + "}\n"
+		targets = append(targets, CompletionTarget{FilePath: name, CursorLine: 3, CursorColumn: 1})
+	}
+	tests := []struct {
+		name            string
+		maxPromptTokens int
+		wantErr         error
+	}{
+		{"fits", 1200, nil},
+		{"over max_prompt_tokens", 500, ErrContextTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := "<<<FILE a.go>>>\nx\n<<<END>>>\n<<<FILE b.go>>>\nx\n<<<END>>>\n<<<FILE c.go>>>\nx\n<<<END>>>\n"
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: output}}
+			config := testConfig()
+			config.MaxContextTokens = 1000
+			config.MaxPromptTokens = tt.maxPromptTokens
+			service := newTestService(t, config, client)
+
+			_, err := service.CompleteMultiFile(context.Background(), MultiFileRequest{ProjectID: "p", Targets: targets}, newFakeProject(files))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CompleteMultiFile: %v", err)
+			}
+			if tokens := estimateTokens(client.lastPrompt()); tokens > tt.maxPromptTokens {
+				t.Errorf("prompt is ~%d tokens, over %d", tokens, tt.maxPromptTokens)
+			}
+		})
+	}
+}
+
+func TestCompleteMultiFileSharedSections(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"api.go":    "package api\n\nfunc Handler() {\n\t\n}\n",
+		"client.go": "package api\n\nfunc Call() {\n\t\n}\n",
+	})
+	pg.readErrs = map[string]error{"secret.go": fs.ErrPermission}
+	output := "<<<FILE api.go>>>\nx\n<<<END>>>\n<<<FILE client.go>>>\nx\n<<<END>>>\n"
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: output}}
+	service := newTestService(t, testConfig(), client)
+	observer := &recordingObserver{}
+	service.SetObserver(observer)
+	service.AddContextProvider("ticket", &staticProvider{text: "STORM-42"})
+	service.AddContextProvider("index", &staticProvider{err: errors.New("index not built")})
+
+	req := MultiFileRequest{
+		ProjectID: "p",
+		Targets: []CompletionTarget{
+			{FilePath: "api.go", CursorLine: 3, CursorColumn: 1},
+			{FilePath: "client.go", CursorLine: 3, CursorColumn: 1},
+		},
+		ContextFiles: []string{"secret.go"},
+	}
+	resp, err := service.CompleteMultiFile(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("CompleteMultiFile: %v", err)
+	}
+	if n := strings.Count(client.lastPrompt(), "TICKET:\nSTORM-42"); n != 1 {
+		t.Errorf("provider section appears %d times, want once:\n%s", n, client.lastPrompt())
+	}
+	if failed := observer.failedSections(); len(failed) != 2 {
+		t.Errorf("observer got %v, want the failed provider and unreadable file once each", failed)
+	}
+	if len(resp.Warnings) != 1 || resp.Warnings[0].Path != "secret.go" {
+		t.Errorf("Warnings = %+v, want one for secret.go", resp.Warnings)
+	}
+	if n := pg.readCount("secret.go"); n != 1 {
+		t.Errorf("secret.go read %d times, want once", n)
+	}
+}
@@ -0,0 +1,47 @@
+package smartcomplete
+
+import "fmt"
+
+// Observer is notified of events during completions that don't fail the
+// request. Implementations must be safe for concurrent use.
+type Observer interface {
+	// ContextSectionFailed is called when an optional context section
+	// (agents, discussion, changes, tags, blame, a "provider:<name>" or a
+	// context file's "file:<path>") couldn't be gathered and the completion
+	// went ahead without it
+	ContextSectionFailed(projectID, section string, err error)
+}
+
+// Optional context sections reported to Observer.ContextSectionFailed
+const (
+	SectionAgents     = "agents"
+	SectionDiscussion = "discussion"
+	SectionChanges    = "changes"
+	SectionTags       = "tags"
+	SectionBlame      = "blame"
+)
+
+// gatherOptional runs gather for an optional context section. An error or
+// panic drops the section: it is reported to the observer, if any, and ""
+// is returned.
+func (g *ContextGatherer) gatherOptional(projectID, section string, gather func() (string, error)) (content string) {
+	defer func() {
+		if r := recover(); r != nil {
+			g.sectionFailed(projectID, section, WrapInternalError("panic gathering "+section, fmt.Errorf("%v", r)))
+			content = ""
+		}
+	}()
+	content, err := gather()
+	if err != nil {
+		g.sectionFailed(projectID, section, err)
+		return ""
+	}
+	return content
+}
+
+// sectionFailed reports a dropped section to the observer, if any
+func (g *ContextGatherer) sectionFailed(projectID, section string, err error) {
+	if g.observer != nil {
+		g.observer.ContextSectionFailed(projectID, section, err)
+	}
+}
@@ -0,0 +1,97 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingObserver keeps the context section failures it is told about
+type recordingObserver struct {
+	mu       sync.Mutex
+	sections []string
+	errs     []error
+}
+
+func (o *recordingObserver) ContextSectionFailed(projectID, section string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sections = append(o.sections, section)
+	o.errs = append(o.errs, err)
+}
+
+// failedSections returns the reported sections in order
+func (o *recordingObserver) failedSections() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.sections...)
+}
+
+// panickingProject is a fakeProject whose ReadFile panics for one file
+type panickingProject struct {
+	*fakeProject
+	panicOn string // relative path
+}
+
+func (p *panickingProject) ReadFile(absolutePath string) ([]byte, error) {
+	if strings.TrimPrefix(absolutePath, testBaseDir+"/") == p.panicOn {
+		panic("malformed " + p.panicOn)
+	}
+	return p.fakeProject.ReadFile(absolutePath)
+}
+
+func TestCompleteDegradesOnContextSectionFailure(t *testing.T) {
+	files := map[string]string{
+		"main.go":       "package main\n",
+		"AGENTS.md":     "use tabs",
+		"discussion.md": "notes",
+	}
+	tests := []struct {
+		name        string
+		pg          func() ProjectGetter
+		wantSection string
+		wantErr     error
+	}{
+		{"discussion read error", func() ProjectGetter {
+			fake := newFakeProject(files)
+			fake.discussion = "discussion.md"
+			fake.readErrs = map[string]error{"discussion.md": fs.ErrPermission}
+			return fake
+		}, SectionDiscussion, fs.ErrPermission},
+		{"agents panic", func() ProjectGetter {
+			fake := newFakeProject(files)
+			return &panickingProject{fakeProject: fake, panicOn: "AGENTS.md"}
+		}, SectionAgents, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x++"}}
+			service := newTestService(t, testConfig(), client)
+			observer := &recordingObserver{}
+			service.SetObserver(observer)
+
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+			resp, err := service.Complete(context.Background(), req, tt.pg())
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if resp.Completion != "x++" {
+				t.Errorf("Completion = %q, want x++", resp.Completion)
+			}
+			if !strings.Contains(client.lastPrompt(), "package main") {
+				t.Errorf("prompt lost the prefix:\n%s", client.lastPrompt())
+			}
+
+			failed := observer.failedSections()
+			if len(failed) != 1 || failed[0] != tt.wantSection {
+				t.Fatalf("reported failures %v, want [%s]", failed, tt.wantSection)
+			}
+			if tt.wantErr != nil && !errors.Is(observer.errs[0], tt.wantErr) {
+				t.Errorf("reported err = %v, want %v", observer.errs[0], tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package smartcomplete
+
+import "strings"
+
+// CompletionPolicy decides, from the gathered context, whether a completion
+// should be requested at the cursor at all. Complete returns a Skipped
+// response without querying the LLM when ShouldComplete returns false.
+type CompletionPolicy interface {
+	ShouldComplete(ctx *CompletionContext) bool
+}
+
+// CompletionPolicyFunc adapts a function to a CompletionPolicy
+type CompletionPolicyFunc func(ctx *CompletionContext) bool
+
+// ShouldComplete calls f(ctx)
+func (f CompletionPolicyFunc) ShouldComplete(ctx *CompletionContext) bool {
+	return f(ctx)
+}
+
+// Built-in completion policies
+var (
+	// AlwaysComplete completes everywhere; it's the default
+	AlwaysComplete CompletionPolicy = CompletionPolicyFunc(func(*CompletionContext) bool {
+		return true
+	})
+
+	// NotInString skips completions inside string literals
+	NotInString CompletionPolicy = CompletionPolicyFunc(func(ctx *CompletionContext) bool {
+		return ctx.Intent != IntentString
+	})
+
+	// NotAfterTerminator skips completions right after a statement's
+	// terminating semicolon on the cursor line
+	NotAfterTerminator CompletionPolicy = CompletionPolicyFunc(func(ctx *CompletionContext) bool {
+		line := ctx.Prefix[strings.LastIndexByte(ctx.Prefix, '\n')+1:]
+		return !strings.HasSuffix(strings.TrimRight(line, " \t"), ";")
+	})
+)
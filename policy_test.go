@@ -0,0 +1,58 @@
+package smartcomplete
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompletionPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CompletionPolicy
+		ctx    CompletionContext
+		want   bool
+	}{
+		{"always", AlwaysComplete, CompletionContext{Prefix: "x := 1;", Intent: IntentString}, true},
+		{"not in string, in code", NotInString, CompletionContext{Prefix: "x := ", Intent: IntentExpression}, true},
+		{"not in string, in string", NotInString, CompletionContext{Prefix: "x := \"a", Intent: IntentString}, false},
+		{"not in string, in comment", NotInString, CompletionContext{Prefix: "// a", Intent: IntentComment}, true},
+		{"not after terminator, mid statement", NotAfterTerminator, CompletionContext{Prefix: "int x = "}, true},
+		{"not after terminator, after semicolon", NotAfterTerminator, CompletionContext{Prefix: "int x = 1; "}, false},
+		{"not after terminator, semicolon on an earlier line", NotAfterTerminator, CompletionContext{Prefix: "int x = 1;\n\t"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.ShouldComplete(&tt.ctx); got != tt.want {
+				t.Errorf("ShouldComplete = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletionPolicySkipsQuery(t *testing.T) {
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, testConfig(), client)
+	service.SetCompletionPolicy(NotAfterTerminator)
+
+	pg := newFakeProject(map[string]string{"main.c": "int main() {\n\tint x = 1;\n\tint y = \n}\n"})
+	skipped := CompletionRequest{ProjectID: "p", FilePath: "main.c", CursorLine: 1, CursorColumn: 11}
+	resp, err := service.Complete(context.Background(), skipped, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if !resp.Skipped || resp.Completion != "" {
+		t.Errorf("response = %+v, want a skipped, empty completion", resp)
+	}
+	if prompt := client.lastPrompt(); prompt != "" {
+		t.Fatalf("client was queried for a skipped completion:\n%s", prompt)
+	}
+
+	completed := CompletionRequest{ProjectID: "p", FilePath: "main.c", CursorLine: 2, CursorColumn: 9}
+	resp, err = service.Complete(context.Background(), completed, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Skipped || client.lastPrompt() == "" {
+		t.Errorf("response = %+v, want the policy to allow the query", resp)
+	}
+}
@@ -0,0 +1,111 @@
+package smartcomplete
+
+import (
+	"strings"
+)
+
+// postProcessCompletion cleans up raw LLM output before it is returned
+func postProcessCompletion(completion string, ctx *CompletionContext) string {
+	completion = trimPrefixEcho(completion, ctx.Prefix)
+	completion = truncateForMode(completion, ctx.Mode)
+	completion = trimSuffixOverlap(completion, ctx.Suffix)
+	completion = normalizeIndentation(completion, ctx.Prefix, ctx.Suffix)
+	if ctx.SingleLine {
+		completion = fitCursorLine(completion, ctx.Prefix, ctx.Suffix)
+	}
+	return completion
+}
+
+// fitCursorLine adjusts a single-line completion to sit between the
+// cursor's line prefix and suffix: whitespace already before the cursor
+// isn't repeated, and trailing whitespace is dropped unless the line
+// continues right after the cursor with non-blank text.
+func fitCursorLine(completion, prefix, suffix string) string {
+	linePrefix := prefix[strings.LastIndexByte(prefix, '\n')+1:]
+	if strings.HasSuffix(linePrefix, " ") || strings.HasSuffix(linePrefix, "\t") {
+		completion = strings.TrimLeft(completion, " \t")
+	}
+
+	lineSuffix, _, _ := strings.Cut(suffix, "\n")
+	if lineSuffix == "" || strings.HasPrefix(lineSuffix, " ") || strings.HasPrefix(lineSuffix, "\t") {
+		completion = strings.TrimRight(completion, " \t\r")
+	}
+	return completion
+}
+
+// trimPrefixEcho removes a restatement of the cursor's line, from its
+// first non-blank character to the cursor, from the start of completion.
+// Lines shorter than minSuffixOverlapLength are left alone, as repeating
+// them is often intended.
+func trimPrefixEcho(completion, prefix string) string {
+	linePrefix := strings.TrimLeft(prefix[strings.LastIndexByte(prefix, '\n')+1:], " \t")
+	if len(strings.TrimSpace(linePrefix)) < minSuffixOverlapLength {
+		return completion
+	}
+	if rest, ok := strings.CutPrefix(strings.TrimLeft(completion, " \t"), linePrefix); ok {
+		return rest
+	}
+	return completion
+}
+
+// suffixStop returns the stop sequence derived from suffix: its first
+// non-blank line after the cursor's line as a whole line, with its
+// indentation and surrounding newlines, or "" if the line has fewer than
+// minSuffixOverlapLength non-blank characters. Providers stop on any match,
+// so the same code nested at another depth in the completion doesn't stop
+// it. The rest of the cursor's line is skipped: the completion is inserted
+// ahead of it, so it can legitimately appear inside the completion (e.g. a
+// closing parenthesis).
+func suffixStop(suffix string) string {
+	_, rest, _ := strings.Cut(suffix, "\n")
+	lines := strings.Split(rest, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if len(strings.TrimSpace(line)) < minSuffixOverlapLength {
+			return ""
+		}
+		stop := "\n" + line
+		if i < len(lines)-1 {
+			stop += "\n"
+		}
+		return stop
+	}
+	return ""
+}
+
+// minSuffixOverlapLength is the fewest non-blank characters of overlap
+// trimSuffixOverlap removes; shorter overlaps like "}" are usually the
+// completion's own code
+const minSuffixOverlapLength = 6
+
+// trimSuffixOverlap removes the tail of completion that repeats the start of
+// suffix, so accepting the completion doesn't double the following code.
+// The overlap must be whole lines: it starts a line of completion and ends
+// a line of suffix.
+func trimSuffixOverlap(completion, suffix string) string {
+	suffix = strings.TrimLeft(suffix, " \t\r\n")
+	trimmed := strings.TrimRight(completion, " \t\r\n")
+	maxOverlap := min(len(trimmed), len(suffix))
+
+	for k := maxOverlap; k > 0; k-- {
+		overlap := suffix[:k]
+		if k < len(suffix) && suffix[k] != '\n' && suffix[k] != '\r' {
+			continue
+		}
+		if len(strings.TrimSpace(overlap)) < minSuffixOverlapLength {
+			break
+		}
+		if !strings.HasSuffix(trimmed, overlap) {
+			continue
+		}
+		head := trimmed[:len(trimmed)-k]
+		if strings.TrimSpace(head[strings.LastIndexByte(head, '\n')+1:]) != "" {
+			continue
+		}
+		return strings.TrimRight(head, " \t")
+	}
+	return completion
+}
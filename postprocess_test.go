@@ -0,0 +1,134 @@
+package smartcomplete
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTrimPrefixEcho(t *testing.T) {
+	tests := []struct {
+		name       string
+		completion string
+		prefix     string
+		want       string
+	}{
+		{"line restated", "result := compute(a, b)", "func f() {\n\tresult := compute(", "a, b)"},
+		{"restated with indentation", "\tresult := compute(a, b)", "func f() {\n\tresult := compute(", "a, b)"},
+		{"no echo", "a, b)", "func f() {\n\tresult := compute(", "a, b)"},
+		{"short line kept", "x++\nx++", "\tx++", "x++\nx++"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimPrefixEcho(tt.completion, tt.prefix); got != tt.want {
+				t.Errorf("trimPrefixEcho(%q) = %q, want %q", tt.completion, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuffixStop(t *testing.T) {
+	tests := []struct {
+		name   string
+		suffix string
+		want   string
+	}{
+		{"blank lines first", "\n\n   \n\treturn x, nil\n}\n", "\n\treturn x, nil\n"},
+		{"rest of the cursor's line skipped", ")\n\tcleanup(ctx)\n", "\n\tcleanup(ctx)\n"},
+		{"last line of the file", "\n\tcleanup(ctx)", "\n\tcleanup(ctx)"},
+		{"short line", "\n\n}\n\nfunc next() {}\n", ""},
+		{"nothing after the cursor", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := suffixStop(tt.suffix); got != tt.want {
+				t.Errorf("suffixStop(%q) = %q, want %q", tt.suffix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimSuffixOverlap(t *testing.T) {
+	tests := []struct {
+		name       string
+		completion string
+		suffix     string
+		expected   string
+	}{
+		{
+			name:       "duplicated statement",
+			completion: "x := compute()\n\treturn x, nil",
+			suffix:     "\n\treturn x, nil\n}",
+			expected:   "x := compute()\n",
+		},
+		{
+			name:       "duplicated lines",
+			completion: "a()\nprintln(\"done\")\ncleanup()",
+			suffix:     "println(\"done\")\ncleanup()\n",
+			expected:   "a()\n",
+		},
+		{
+			name:       "no overlap",
+			completion: "x := 1",
+			suffix:     "\nreturn y",
+			expected:   "x := 1",
+		},
+		{
+			name:       "closing brace is too short to trim",
+			completion: "if x {\n\ty()\n}",
+			suffix:     "\n}",
+			expected:   "if x {\n\ty()\n}",
+		},
+		{
+			name:       "overlap inside a word",
+			completion: "total",
+			suffix:     "l := 1",
+			expected:   "total",
+		},
+		{
+			name:       "overlap not starting a completion line",
+			completion: "foo(); return x, nil",
+			suffix:     "return x, nil\n",
+			expected:   "foo(); return x, nil",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimSuffixOverlap(tt.completion, tt.suffix); got != tt.expected {
+				t.Errorf("trimSuffixOverlap(%q, %q) = %q, want %q", tt.completion, tt.suffix, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRawCompletion(t *testing.T) {
+	file := "package main\n\nfunc main() {\n\t\n\treturn x, nil\n}\n"
+	raw := "x := compute()\n\treturn x, nil"
+	tests := []struct {
+		name    string
+		include bool
+		wantRaw string
+	}{
+		{"off", false, ""},
+		{"on", true, raw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.IncludeRawCompletion = tt.include
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: raw})
+			pg := newFakeProject(map[string]string{"main.go": file})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}
+
+			resp, err := service.Complete(context.Background(), req, pg)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if want := "x := compute()\n"; resp.Completion != want {
+				t.Errorf("Completion = %q, want the suffix overlap trimmed to %q", resp.Completion, want)
+			}
+			if resp.RawCompletion != tt.wantRaw {
+				t.Errorf("RawCompletion = %q, want %q", resp.RawCompletion, tt.wantRaw)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package smartcomplete
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errStatUnsupported is returned by CachingProjectGetter.Stat when the
+// wrapped getter can't stat files
+var errStatUnsupported = errors.New("stat not supported")
+
+// Limits on the file content a CachingProjectGetter keeps; the least
+// recently read files are dropped first
+const (
+	maxCachedFiles     = 1000
+	maxCachedFileBytes = 64 * 1024 * 1024 // 64MB
+)
+
+// CachingProjectGetter wraps a ProjectGetter and memoizes project lookups
+// for a short TTL. File reads are cached by size and modification time when
+// the wrapped getter implements FileStater, up to maxCachedFiles files and
+// maxCachedFileBytes of content.
+type CachingProjectGetter struct {
+	inner ProjectGetter
+	ttl   time.Duration
+
+	baseDirs        map[string]cachedLookup
+	authorizedFiles map[string]cachedLookup
+	discussionFiles map[string]cachedLookup
+	files           map[string]cachedFile
+	fileBytes       int
+	mu              sync.Mutex
+}
+
+// cachedLookup is a memoized project lookup
+type cachedLookup struct {
+	value     string
+	values    []string
+	expiresAt time.Time
+}
+
+// cachedFile is file content remembered at a given stat
+type cachedFile struct {
+	stat     fileStat
+	content  []byte
+	lastRead time.Time
+}
+
+// NewCachingProjectGetter wraps inner, caching project lookups for ttl
+func NewCachingProjectGetter(inner ProjectGetter, ttl time.Duration) *CachingProjectGetter {
+	return &CachingProjectGetter{
+		inner:           inner,
+		ttl:             ttl,
+		baseDirs:        make(map[string]cachedLookup),
+		authorizedFiles: make(map[string]cachedLookup),
+		discussionFiles: make(map[string]cachedLookup),
+		files:           make(map[string]cachedFile),
+	}
+}
+
+// GetProjectBaseDir returns the cached base dir or looks it up
+func (c *CachingProjectGetter) GetProjectBaseDir(projectID string) (string, error) {
+	if cached, ok := c.lookup(c.baseDirs, projectID); ok {
+		return cached.value, nil
+	}
+	baseDir, err := c.inner.GetProjectBaseDir(projectID)
+	if err != nil {
+		return "", err
+	}
+	c.store(c.baseDirs, projectID, cachedLookup{value: baseDir})
+	return baseDir, nil
+}
+
+// GetProjectAuthorizedFiles returns the cached file list or looks it up
+func (c *CachingProjectGetter) GetProjectAuthorizedFiles(projectID string) ([]string, error) {
+	if cached, ok := c.lookup(c.authorizedFiles, projectID); ok {
+		return cached.values, nil
+	}
+	files, err := c.inner.GetProjectAuthorizedFiles(projectID)
+	if err != nil {
+		return nil, err
+	}
+	c.store(c.authorizedFiles, projectID, cachedLookup{values: files})
+	return files, nil
+}
+
+// GetProjectDiscussionFile returns the cached discussion path or looks it up
+func (c *CachingProjectGetter) GetProjectDiscussionFile(projectID string) (string, error) {
+	if cached, ok := c.lookup(c.discussionFiles, projectID); ok {
+		return cached.value, nil
+	}
+	discussionFile, err := c.inner.GetProjectDiscussionFile(projectID)
+	if err != nil {
+		return "", err
+	}
+	c.store(c.discussionFiles, projectID, cachedLookup{value: discussionFile})
+	return discussionFile, nil
+}
+
+// ReadFile returns cached content if the file's size and modification time
+// are unchanged, otherwise reads it through
+func (c *CachingProjectGetter) ReadFile(absolutePath string) ([]byte, error) {
+	stater, ok := c.inner.(FileStater)
+	if !ok {
+		return c.inner.ReadFile(absolutePath)
+	}
+	size, modTime, err := stater.Stat(absolutePath)
+	if err != nil {
+		return c.inner.ReadFile(absolutePath)
+	}
+	stat := fileStat{size: size, modTime: modTime}
+
+	c.mu.Lock()
+	cached, exists := c.files[absolutePath]
+	if exists && cached.stat.size == stat.size && cached.stat.modTime.Equal(stat.modTime) {
+		cached.lastRead = time.Now()
+		c.files[absolutePath] = cached
+		c.mu.Unlock()
+		return cached.content, nil
+	}
+	c.mu.Unlock()
+
+	content, err := c.inner.ReadFile(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+	c.storeFile(absolutePath, cachedFile{stat: stat, content: content})
+	return content, nil
+}
+
+// storeFile caches a file's content, dropping the least recently read files
+// to stay within the limits. Files larger than the byte limit aren't cached.
+func (c *CachingProjectGetter) storeFile(absolutePath string, entry cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropFile(absolutePath)
+	if len(entry.content) > maxCachedFileBytes {
+		return
+	}
+	entry.lastRead = time.Now()
+	c.files[absolutePath] = entry
+	c.fileBytes += len(entry.content)
+
+	for len(c.files) > maxCachedFiles || c.fileBytes > maxCachedFileBytes {
+		var oldestPath string
+		var oldest time.Time
+		for path, f := range c.files {
+			if oldestPath == "" || f.lastRead.Before(oldest) {
+				oldestPath, oldest = path, f.lastRead
+			}
+		}
+		c.dropFile(oldestPath)
+	}
+}
+
+// dropFile removes a file's cached content. The caller holds c.mu.
+func (c *CachingProjectGetter) dropFile(absolutePath string) {
+	if f, ok := c.files[absolutePath]; ok {
+		c.fileBytes -= len(f.content)
+		delete(c.files, absolutePath)
+	}
+}
+
+// Stat passes through to the wrapped getter if it implements FileStater
+func (c *CachingProjectGetter) Stat(absolutePath string) (int64, time.Time, error) {
+	stater, ok := c.inner.(FileStater)
+	if !ok {
+		return 0, time.Time{}, errStatUnsupported
+	}
+	return stater.Stat(absolutePath)
+}
+
+// GetRecentChanges passes through to the wrapped getter if it implements
+// RecentChangesGetter, and reports no changes otherwise
+func (c *CachingProjectGetter) GetRecentChanges(projectID string) (string, error) {
+	changesGetter, ok := c.inner.(RecentChangesGetter)
+	if !ok {
+		return "", nil
+	}
+	return changesGetter.GetRecentChanges(projectID)
+}
+
+// GetBlame passes through to the wrapped getter if it implements
+// BlameGetter, and reports no blame otherwise
+func (c *CachingProjectGetter) GetBlame(projectID, filePath string, startLine, endLine int) ([]string, error) {
+	blameGetter, ok := c.inner.(BlameGetter)
+	if !ok {
+		return nil, nil
+	}
+	return blameGetter.GetBlame(projectID, filePath, startLine, endLine)
+}
+
+// GetProjectConfigOverrides passes through to the wrapped getter if it
+// implements ProjectConfigGetter, and reports no overrides otherwise
+func (c *CachingProjectGetter) GetProjectConfigOverrides(projectID string) ([]byte, error) {
+	configGetter, ok := c.inner.(ProjectConfigGetter)
+	if !ok {
+		return nil, nil
+	}
+	return configGetter.GetProjectConfigOverrides(projectID)
+}
+
+// Invalidate drops all cached lookups for a project
+func (c *CachingProjectGetter) Invalidate(projectID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.baseDirs, projectID)
+	delete(c.authorizedFiles, projectID)
+	delete(c.discussionFiles, projectID)
+}
+
+// InvalidateFile drops cached content for a file
+func (c *CachingProjectGetter) InvalidateFile(absolutePath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropFile(absolutePath)
+}
+
+// InvalidateAll drops everything cached
+func (c *CachingProjectGetter) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.baseDirs)
+	clear(c.authorizedFiles)
+	clear(c.discussionFiles)
+	clear(c.files)
+	c.fileBytes = 0
+}
+
+// lookup returns an unexpired entry from one of the lookup maps
+func (c *CachingProjectGetter) lookup(m map[string]cachedLookup, projectID string) (cachedLookup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, exists := m[projectID]
+	if !exists || time.Now().After(cached.expiresAt) {
+		return cachedLookup{}, false
+	}
+	return cached, true
+}
+
+// store saves an entry in one of the lookup maps with the getter's TTL
+func (c *CachingProjectGetter) store(m map[string]cachedLookup, projectID string, entry cachedLookup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.expiresAt = time.Now().Add(c.ttl)
+	m[projectID] = entry
+}
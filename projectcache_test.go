@@ -0,0 +1,161 @@
+package smartcomplete
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lookupCountingProject is a statProject that counts project lookups
+type lookupCountingProject struct {
+	*statProject
+
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func newLookupCountingProject(files map[string]string) *lookupCountingProject {
+	return &lookupCountingProject{
+		statProject: &statProject{fakeProject: newFakeProject(files), modTimes: map[string]time.Time{}},
+		lookups:     make(map[string]int),
+	}
+}
+
+func (p *lookupCountingProject) count(name string) {
+	p.mu.Lock()
+	p.lookups[name]++
+	p.mu.Unlock()
+}
+
+func (p *lookupCountingProject) GetProjectBaseDir(projectID string) (string, error) {
+	p.count("baseDir")
+	return p.statProject.GetProjectBaseDir(projectID)
+}
+
+func (p *lookupCountingProject) GetProjectAuthorizedFiles(projectID string) ([]string, error) {
+	p.count("authorized")
+	return p.statProject.GetProjectAuthorizedFiles(projectID)
+}
+
+func (p *lookupCountingProject) GetProjectDiscussionFile(projectID string) (string, error) {
+	p.count("discussion")
+	return p.statProject.GetProjectDiscussionFile(projectID)
+}
+
+func TestCachingProjectGetterLookups(t *testing.T) {
+	tests := []struct {
+		name string
+		wrap bool
+	}{
+		{"uncached", false},
+		{"cached", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newLookupCountingProject(map[string]string{"main.go": "package main\n"})
+			var pg ProjectGetter = inner
+			if tt.wrap {
+				pg = NewCachingProjectGetter(inner, time.Minute)
+			}
+			service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+			for i := 0; i < 5; i++ {
+				req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+				if _, err := service.Complete(context.Background(), req, pg); err != nil {
+					t.Fatalf("Complete: %v", err)
+				}
+			}
+
+			baseDir, discussion := inner.lookups["baseDir"], inner.lookups["discussion"]
+			if tt.wrap {
+				if baseDir != 1 || discussion != 1 {
+					t.Errorf("inner lookups = %v, want each once across 5 completions", inner.lookups)
+				}
+			} else if baseDir < 5 {
+				t.Errorf("uncached base dir lookups = %d, want one or more per completion", baseDir)
+			}
+		})
+	}
+}
+
+func TestCachingProjectGetterInvalidate(t *testing.T) {
+	inner := newLookupCountingProject(map[string]string{"main.go": "package main\n"})
+	cache := NewCachingProjectGetter(inner, time.Minute)
+
+	cache.GetProjectBaseDir("p")
+	cache.GetProjectBaseDir("p")
+	cache.Invalidate("p")
+	cache.GetProjectBaseDir("p")
+	if got := inner.lookups["baseDir"]; got != 2 {
+		t.Errorf("inner base dir lookups = %d, want 2 (one before and one after Invalidate)", got)
+	}
+
+	expiring := NewCachingProjectGetter(inner, time.Nanosecond)
+	expiring.GetProjectAuthorizedFiles("p")
+	time.Sleep(time.Millisecond)
+	expiring.GetProjectAuthorizedFiles("p")
+	if got := inner.lookups["authorized"]; got != 2 {
+		t.Errorf("inner authorized lookups = %d, want 2 after the TTL expired", got)
+	}
+}
+
+func TestCachingProjectGetterReadFile(t *testing.T) {
+	const path = testBaseDir + "/main.go"
+	tests := []struct {
+		name      string
+		change    func(inner *lookupCountingProject, cache *CachingProjectGetter)
+		wantReads int
+	}{
+		{"unchanged", func(*lookupCountingProject, *CachingProjectGetter) {}, 1},
+		{"modified", func(inner *lookupCountingProject, _ *CachingProjectGetter) {
+			inner.modTimes["main.go"] = time.Unix(1700000001, 0)
+		}, 2},
+		{"invalidated", func(_ *lookupCountingProject, cache *CachingProjectGetter) {
+			cache.InvalidateFile(path)
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newLookupCountingProject(map[string]string{"main.go": "package main\n"})
+			inner.modTimes["main.go"] = time.Unix(1700000000, 0)
+			cache := NewCachingProjectGetter(inner, time.Minute)
+
+			if _, err := cache.ReadFile(path); err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			tt.change(inner, cache)
+			content, err := cache.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if string(content) != "package main\n" {
+				t.Errorf("content = %q", content)
+			}
+			if got := inner.readCount("main.go"); got != tt.wantReads {
+				t.Errorf("inner reads = %d, want %d", got, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestCachingProjectGetterForwardsExtensions(t *testing.T) {
+	tests := []struct {
+		name        string
+		inner       ProjectGetter
+		wantChanges string
+	}{
+		{"RecentChangesGetter", &changesProject{newFakeProject(nil), "diff"}, "diff"},
+		{"no RecentChangesGetter", newFakeProject(nil), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewCachingProjectGetter(tt.inner, time.Minute)
+			if changes, err := cache.GetRecentChanges("p"); changes != tt.wantChanges || err != nil {
+				t.Errorf("GetRecentChanges = %q, %v; want %q, nil", changes, err, tt.wantChanges)
+			}
+			if overrides, err := cache.GetProjectConfigOverrides("p"); overrides != nil || err != nil {
+				t.Errorf("GetProjectConfigOverrides = %q, %v; want nil, nil", overrides, err)
+			}
+		})
+	}
+}
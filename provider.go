@@ -0,0 +1,66 @@
+package smartcomplete
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ContextProvider supplies project-specific context that doesn't come from
+// files in the project, e.g. a symbol index or a ticket description.
+// Provide returns files to merge into the related files and text for the
+// provider's own prompt section; either may be empty. It may be called
+// concurrently. A provider that fails is skipped for that request and
+// reported to the Observer as section "provider:<name>".
+type ContextProvider interface {
+	Provide(req CompletionRequest) ([]FileContext, string, error)
+}
+
+// ContextSection is a named block of prompt context from a ContextProvider
+type ContextSection struct {
+	Name    string
+	Content string
+}
+
+// namedProvider is a registered ContextProvider
+type namedProvider struct {
+	name     string
+	provider ContextProvider
+}
+
+// reservedSectionNames head built-in sections that share the providers'
+// place in the prompt, so no provider may use them
+var reservedSectionNames = []string{TagsSectionName, BlameSectionName}
+
+// AddContextProvider registers a provider whose section is headed by name.
+// Providers run in the order they were added. Names are compared ignoring
+// case, and the built-in sections' names are rejected.
+func (s *CompletionService) AddContextProvider(name string, provider ContextProvider) error {
+	for _, reserved := range reservedSectionNames {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("context provider name %q is reserved for a built-in section", name)
+		}
+	}
+	s.providers = append(s.providers, namedProvider{name: name, provider: provider})
+	return nil
+}
+
+// gatherProviders runs the registered providers, dropping any that fail
+func (g *ContextGatherer) gatherProviders(req CompletionRequest) ([]FileContext, []ContextSection) {
+	var files []FileContext
+	var sections []ContextSection
+	for _, p := range g.providers {
+		var provided []FileContext
+		text := g.gatherOptional(req.ProjectID, "provider:"+p.name, func() (string, error) {
+			f, text, err := p.provider.Provide(req)
+			if err == nil {
+				provided = f
+			}
+			return text, err
+		})
+		files = append(files, provided...)
+		if text != "" {
+			sections = append(sections, ContextSection{Name: p.name, Content: text})
+		}
+	}
+	return files, sections
+}
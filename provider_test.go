@@ -0,0 +1,70 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// staticProvider returns fixed files and text, or err
+type staticProvider struct {
+	files []FileContext
+	text  string
+	err   error
+}
+
+func (p *staticProvider) Provide(req CompletionRequest) ([]FileContext, string, error) {
+	return p.files, p.text, p.err
+}
+
+func TestContextProviders(t *testing.T) {
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, testConfig(), client)
+	observer := &recordingObserver{}
+	service.SetObserver(observer)
+	service.AddContextProvider("ticket", &staticProvider{text: "STORM-42: retry uploads on timeout"})
+	service.AddContextProvider("fixtures", &staticProvider{files: []FileContext{{Path: "testdata/upload.json", Content: `{"size": 3}`}}})
+	service.AddContextProvider("index", &staticProvider{text: "unused", err: errors.New("index not built")})
+
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	prompt := client.lastPrompt()
+	for _, want := range []string{
+		"TICKET:\nSTORM-42: retry uploads on timeout\n",
+		"--- testdata/upload.json ---\n{\"size\": 3}\n",
+	} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt does not contain %q:\n%s", want, prompt)
+		}
+	}
+	if strings.Contains(prompt, "INDEX:") {
+		t.Errorf("prompt contains the failed provider's section:\n%s", prompt)
+	}
+	if strings.Join(resp.IncludedFiles, ",") != "testdata/upload.json" {
+		t.Errorf("IncludedFiles = %v, want the provider's file", resp.IncludedFiles)
+	}
+	if failed := observer.failedSections(); len(failed) != 1 || failed[0] != "provider:index" {
+		t.Errorf("reported failures %v, want [provider:index]", failed)
+	}
+}
+
+func TestContextProviderReservedNames(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	for _, name := range []string{TagsSectionName, BlameSectionName, "Symbols"} {
+		if err := service.AddContextProvider(name, &staticProvider{text: "x"}); err == nil {
+			t.Errorf("AddContextProvider(%q) = nil, want an error for a reserved name", name)
+		}
+	}
+	if err := service.AddContextProvider("ticket", &staticProvider{text: "x"}); err != nil {
+		t.Errorf("AddContextProvider(ticket): %v", err)
+	}
+	if len(service.providers) != 1 {
+		t.Errorf("%d providers registered, want only ticket", len(service.providers))
+	}
+}
@@ -0,0 +1,78 @@
+package smartcomplete
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Policies for which context files are dropped first when trimming
+const (
+	FileTrimRequestOrder = "request_order" // the last listed (or least relevant, if ranked)
+	FileTrimMtime        = "mtime"         // the least recently modified
+)
+
+// identifierPattern matches identifier-like tokens worth comparing
+var identifierPattern = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]{2,}`)
+
+// identifiers returns the set of distinct identifiers in s
+func identifiers(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, id := range identifierPattern.FindAllString(s, -1) {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// relevanceScore counts the distinct identifiers shared between the prefix
+// and a context file. It's a cheap heuristic, not a semantic similarity.
+func relevanceScore(prefixIDs map[string]struct{}, content string) int {
+	score := 0
+	for id := range identifiers(content) {
+		if _, ok := prefixIDs[id]; ok {
+			score++
+		}
+	}
+	return score
+}
+
+// rankByRelevance orders files most relevant to the prefix first, keeping
+// the request order among equally relevant files
+func rankByRelevance(prefix string, files []FileContext) {
+	prefixIDs := identifiers(prefix)
+	scores := make(map[string]int, len(files))
+	for _, f := range files {
+		scores[f.Path] = relevanceScore(prefixIDs, f.Content)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return scores[files[i].Path] > scores[files[j].Path]
+	})
+}
+
+// rankByModTime orders files most recently modified first, so trimming
+// drops the stalest. Virtual files, being unsaved edits, count as newest;
+// files that can't be stat'ed count as oldest. It does nothing unless
+// projectGetter is a FileStater.
+func rankByModTime(files []FileContext, baseDir string, projectGetter ProjectGetter, virtual map[string]FileContext) {
+	if _, ok := projectGetter.(FileStater); !ok {
+		return
+	}
+	modTimes := make(map[string]time.Time, len(files))
+	unsaved := make(map[string]bool)
+	for _, f := range files {
+		absPath := filepath.Clean(resolveFilePath(baseDir, f.Path))
+		if _, ok := virtual[absPath]; ok {
+			unsaved[f.Path] = true
+		} else if stat, ok := statFile(projectGetter, absPath); ok {
+			modTimes[f.Path] = stat.modTime
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i].Path, files[j].Path
+		if unsaved[a] != unsaved[b] {
+			return unsaved[a]
+		}
+		return modTimes[a].After(modTimes[b])
+	})
+}
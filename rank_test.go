@@ -0,0 +1,112 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRankByRelevance(t *testing.T) {
+	prefix := "func handleOrder(order *Order, inventory *Inventory) {\n\tinventory."
+	files := []FileContext{
+		{Path: "unrelated.go", Content: "func renderBanner(color string) string { return color }"},
+		{Path: "inventory.go", Content: "type Inventory struct{}\nfunc (inventory *Inventory) Reserve(order *Order) {}"},
+	}
+	rankByRelevance(prefix, files)
+	if files[0].Path != "inventory.go" {
+		t.Errorf("ranked order = [%s %s], want inventory.go first", files[0].Path, files[1].Path)
+	}
+}
+
+func TestRankedFileSurvivesTrimming(t *testing.T) {
+	pg := newFakeProject(map[string]string{
+		"main.go":      "package main\n\nfunc handleOrder(order *Order, inventory *Inventory) {\n\tinventory.",
+		"unrelated.go": strings.Repeat("func renderBanner(color string) string { return color }\n", 20),
+		"inventory.go": strings.Repeat("func (inventory *Inventory) Reserve(order *Order) {}\n", 20),
+	})
+	// Listed last, the related file is the one dropped without ranking
+	req := CompletionRequest{
+		ProjectID:    "p",
+		FilePath:     "main.go",
+		CursorLine:   3,
+		CursorColumn: 11,
+		ContextFiles: []string{"unrelated.go", "inventory.go"},
+	}
+
+	tests := []struct {
+		name      string
+		rankFiles bool
+		wantKept  string
+	}{
+		{"ranked", true, "inventory.go"},
+		{"unranked", false, "unrelated.go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gatherer := newGatherer(testConfig())
+			gatherer.rankFiles = tt.rankFiles
+			gatherer.maxTokens = 400
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			var kept []string
+			for _, f := range ctx.AdditionalFiles {
+				kept = append(kept, f.Path)
+			}
+			if len(kept) != 1 || kept[0] != tt.wantKept {
+				t.Errorf("kept files = %v, want [%s]", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestStaleFileTrimmedFirst(t *testing.T) {
+	now := time.Now()
+	pg := &statProject{
+		fakeProject: newFakeProject(map[string]string{
+			"main.go":  "package main\n\nfunc main() {\n\t\n}\n",
+			"stale.go": strings.Repeat("// stale helper line\n", 40),
+			"fresh.go": strings.Repeat("// fresh helper line\n", 40),
+		}),
+		modTimes: map[string]time.Time{
+			"stale.go": now.Add(-72 * time.Hour),
+			"fresh.go": now.Add(-time.Minute),
+		},
+	}
+	// Listed last, the fresh file is the one dropped in request order
+	req := CompletionRequest{
+		ProjectID:    "p",
+		FilePath:     "main.go",
+		CursorLine:   3,
+		CursorColumn: 1,
+		ContextFiles: []string{"stale.go", "fresh.go"},
+	}
+
+	tests := []struct {
+		policy   string
+		wantKept string
+	}{
+		{FileTrimRequestOrder, "stale.go"},
+		{FileTrimMtime, "fresh.go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			gatherer := newGatherer(testConfig())
+			gatherer.fileTrimPolicy = tt.policy
+			gatherer.maxTokens = 300
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			var kept []string
+			for _, f := range ctx.AdditionalFiles {
+				kept = append(kept, f.Path)
+			}
+			if len(kept) != 1 || kept[0] != tt.wantKept {
+				t.Errorf("kept files = %v, want [%s]", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package smartcomplete
 
 import (
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -9,6 +10,7 @@ import (
 type RateLimiter struct {
 	requestCounts map[string]*RequestCount
 	mu            sync.RWMutex
+	retryJitter   time.Duration
 }
 
 // RequestCount tracks requests within time windows
@@ -26,6 +28,14 @@ func NewRateLimiter() *RateLimiter {
 	}
 }
 
+// SetRetryJitter sets the maximum random delay added to RetryAfter, so
+// clients limited together don't all retry at the same instant
+func (r *RateLimiter) SetRetryJitter(jitter time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retryJitter = jitter
+}
+
 // CheckLimit checks if a request is within rate limits
 func (r *RateLimiter) CheckLimit(projectID string, maxPerMin, maxPerHour int) error {
 	r.mu.Lock()
@@ -53,16 +63,20 @@ func (r *RateLimiter) CheckLimit(projectID string, maxPerMin, maxPerHour int) er
 
 	// Check limits
 	if count.Minute >= maxPerMin {
-		return WrapRateLimitError(
+		err := WrapRateLimitError(
 			"per-minute rate limit exceeded",
 			ErrRateLimitExceeded,
 		)
+		err.RetryAfter = r.retryAfter(count.LastMinuteReset.Add(time.Minute).Sub(now))
+		return err
 	}
 	if count.Hour >= maxPerHour {
-		return WrapRateLimitError(
+		err := WrapRateLimitError(
 			"per-hour rate limit exceeded",
 			ErrRateLimitExceeded,
 		)
+		err.RetryAfter = r.retryAfter(count.LastHourReset.Add(time.Hour).Sub(now))
+		return err
 	}
 
 	// Increment counters
@@ -72,6 +86,15 @@ func (r *RateLimiter) CheckLimit(projectID string, maxPerMin, maxPerHour int) er
 	return nil
 }
 
+// retryAfter adds up to retryJitter of random delay to the time until the
+// window resets. Callers must hold the lock.
+func (r *RateLimiter) retryAfter(untilReset time.Duration) time.Duration {
+	if r.retryJitter <= 0 {
+		return untilReset
+	}
+	return untilReset + time.Duration(rand.Int63n(int64(r.retryJitter)+1))
+}
+
 // Reset resets all rate limit counters for a project
 func (r *RateLimiter) Reset(projectID string) {
 	r.mu.Lock()
@@ -0,0 +1,49 @@
+package smartcomplete
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterJitter(t *testing.T) {
+	tests := []struct {
+		name       string
+		jitter     time.Duration
+		wantSpread bool
+	}{
+		{"no jitter", 0, false},
+		{"jitter", 5 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter()
+			limiter.SetRetryJitter(tt.jitter)
+			start := time.Now()
+			if err := limiter.CheckLimit("p", 1, 100); err != nil {
+				t.Fatalf("first CheckLimit: %v", err)
+			}
+
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 50; i++ {
+				err := limiter.CheckLimit("p", 1, 100)
+				var completionErr *CompletionError
+				if !errors.As(err, &completionErr) || !errors.Is(err, ErrRateLimitExceeded) {
+					t.Fatalf("CheckLimit = %v, want a rate limit CompletionError", err)
+				}
+
+				// The window resets a minute after start; RetryAfter is the
+				// time left plus at most the jitter
+				lower := time.Minute - time.Since(start)
+				upper := time.Minute + tt.jitter
+				if completionErr.RetryAfter < lower || completionErr.RetryAfter > upper {
+					t.Errorf("RetryAfter = %v, want within [%v, %v]", completionErr.RetryAfter, lower, upper)
+				}
+				seen[completionErr.RetryAfter.Round(time.Millisecond)] = true
+			}
+			if spread := len(seen) > 1; tt.wantSpread && !spread {
+				t.Errorf("RetryAfter was the same for every error, want it spread by jitter")
+			}
+		})
+	}
+}
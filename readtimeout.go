@@ -0,0 +1,99 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrReadTimeout is returned by TimeoutProjectGetter.ReadFile when a read
+// outlasts its timeout or the request's context
+var ErrReadTimeout = errors.New("file read timed out")
+
+// TimeoutProjectGetter wraps a ProjectGetter whose ReadFile can block, e.g.
+// on a network filesystem, and gives up on each read after a timeout or
+// once the request's context is done. The abandoned read keeps running in
+// its goroutine until the wrapped getter returns. Create one per request.
+type TimeoutProjectGetter struct {
+	ProjectGetter
+
+	ctx     context.Context
+	timeout time.Duration
+}
+
+// NewTimeoutProjectGetter wraps inner for the request with context ctx,
+// limiting each read to timeout; 0 limits reads only by ctx
+func NewTimeoutProjectGetter(ctx context.Context, inner ProjectGetter, timeout time.Duration) *TimeoutProjectGetter {
+	return &TimeoutProjectGetter{ProjectGetter: inner, ctx: ctx, timeout: timeout}
+}
+
+// ReadFile reads through the wrapped getter, returning an error wrapping
+// ErrReadTimeout if the read doesn't finish in time
+func (g *TimeoutProjectGetter) ReadFile(absolutePath string) ([]byte, error) {
+	ctx := g.ctx
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrReadTimeout, absolutePath, err)
+	}
+
+	type readResult struct {
+		content []byte
+		err     error
+	}
+	done := make(chan readResult, 1)
+	go func() {
+		content, err := g.ProjectGetter.ReadFile(absolutePath)
+		done <- readResult{content, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.content, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %s: %w", ErrReadTimeout, absolutePath, ctx.Err())
+	}
+}
+
+// Stat passes through to the wrapped getter if it implements FileStater
+func (g *TimeoutProjectGetter) Stat(absolutePath string) (int64, time.Time, error) {
+	stater, ok := g.ProjectGetter.(FileStater)
+	if !ok {
+		return 0, time.Time{}, errStatUnsupported
+	}
+	return stater.Stat(absolutePath)
+}
+
+// GetRecentChanges passes through to the wrapped getter if it implements
+// RecentChangesGetter, and reports no changes otherwise
+func (g *TimeoutProjectGetter) GetRecentChanges(projectID string) (string, error) {
+	changesGetter, ok := g.ProjectGetter.(RecentChangesGetter)
+	if !ok {
+		return "", nil
+	}
+	return changesGetter.GetRecentChanges(projectID)
+}
+
+// GetBlame passes through to the wrapped getter if it implements
+// BlameGetter, and reports no blame otherwise
+func (g *TimeoutProjectGetter) GetBlame(projectID, filePath string, startLine, endLine int) ([]string, error) {
+	blameGetter, ok := g.ProjectGetter.(BlameGetter)
+	if !ok {
+		return nil, nil
+	}
+	return blameGetter.GetBlame(projectID, filePath, startLine, endLine)
+}
+
+// GetProjectConfigOverrides passes through to the wrapped getter if it
+// implements ProjectConfigGetter, and reports no overrides otherwise
+func (g *TimeoutProjectGetter) GetProjectConfigOverrides(projectID string) ([]byte, error) {
+	configGetter, ok := g.ProjectGetter.(ProjectConfigGetter)
+	if !ok {
+		return nil, nil
+	}
+	return configGetter.GetProjectConfigOverrides(projectID)
+}
@@ -0,0 +1,53 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingProject is a fakeProject whose reads block until release is closed
+type blockingProject struct {
+	*fakeProject
+	release chan struct{}
+}
+
+func (p *blockingProject) ReadFile(absolutePath string) ([]byte, error) {
+	<-p.release
+	return p.fakeProject.ReadFile(absolutePath)
+}
+
+func TestTimeoutProjectGetter(t *testing.T) {
+	inner := &blockingProject{fakeProject: newFakeProject(map[string]string{"main.go": "package main\n"}), release: make(chan struct{})}
+	defer close(inner.release)
+
+	t.Run("timeout", func(t *testing.T) {
+		getter := NewTimeoutProjectGetter(context.Background(), inner, 10*time.Millisecond)
+		start := time.Now()
+		_, err := getter.ReadFile(testBaseDir + "/main.go")
+		if !errors.Is(err, ErrReadTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want ErrReadTimeout wrapping the deadline", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("read returned after %v, want about the 10ms timeout", elapsed)
+		}
+	})
+
+	t.Run("request cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		getter := NewTimeoutProjectGetter(ctx, inner, 0)
+		time.AfterFunc(10*time.Millisecond, cancel)
+		if _, err := getter.ReadFile(testBaseDir + "/main.go"); !errors.Is(err, ErrReadTimeout) || !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want ErrReadTimeout wrapping the cancellation", err)
+		}
+	})
+}
+
+func TestTimeoutProjectGetterReadsInTime(t *testing.T) {
+	getter := NewTimeoutProjectGetter(context.Background(), newFakeProject(map[string]string{"main.go": "package main\n"}), time.Second)
+	content, err := getter.ReadFile(testBaseDir + "/main.go")
+	if err != nil || string(content) != "package main\n" {
+		t.Errorf("ReadFile = %q, %v; want the file's content", content, err)
+	}
+}
@@ -0,0 +1,80 @@
+package smartcomplete
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// outlinePatterns match top-level declarations per file extension
+var outlinePatterns = map[string]*regexp.Regexp{
+	".go":  regexp.MustCompile(`^(func|type)\s`),
+	".py":  regexp.MustCompile(`^(async\s+def|def|class)\s`),
+	".js":  regexp.MustCompile(`^(export\s+)?(default\s+)?(async\s+)?(function|class)\b`),
+	".ts":  regexp.MustCompile(`^(export\s+)?(default\s+)?(async\s+)?(function|class|interface|type|enum)\b`),
+	".rs":  regexp.MustCompile(`^(pub(\(\w+\))?\s+)?(async\s+)?(fn|struct|enum|trait|impl|type)\b`),
+	".rb":  regexp.MustCompile(`^(def|class|module)\s`),
+	".php": regexp.MustCompile(`^((abstract|final)\s+)?(function|class|interface|trait)\s`),
+}
+
+// extractOutline returns the signature lines of top-level declarations in
+// content, using a heuristic per-language pattern. Unknown languages yield nil.
+func extractOutline(filePath, content string) []string {
+	pattern, ok := outlinePatterns[strings.ToLower(filepath.Ext(filePath))]
+	if !ok {
+		return nil
+	}
+
+	var signatures []string
+	for _, line := range strings.Split(content, "\n") {
+		if !pattern.MatchString(line) {
+			continue
+		}
+		sig := strings.TrimRight(line, " \t\r")
+		sig = strings.TrimSuffix(sig, "{")
+		signatures = append(signatures, strings.TrimRight(sig, " \t"))
+	}
+	return signatures
+}
+
+// repoMapHeader starts each file's outline in a repo map
+const repoMapHeader = "--- "
+
+// buildRepoMap condenses files into an outline of their declarations
+func buildRepoMap(files []FileContext) string {
+	var b strings.Builder
+	for _, f := range files {
+		signatures := extractOutline(f.Path, f.Content)
+		if len(signatures) == 0 {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("%s%s ---\n", repoMapHeader, f.Path))
+		for _, sig := range signatures {
+			b.WriteString(sig)
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// dropLastOutline removes the last file's outline from repoMap, returning
+// the rest and the dropped file's path. Signature lines never start with
+// the header, so the last header line begins the last outline.
+func dropLastOutline(repoMap string) (string, string) {
+	start := strings.LastIndex(repoMap, "\n"+repoMapHeader) + 1
+	header, _, _ := strings.Cut(repoMap[start:], "\n")
+	path := strings.TrimSuffix(strings.TrimPrefix(header, repoMapHeader), " ---")
+	return repoMap[:start], path
+}
+
+// repoMapPaths returns the paths of the files outlined in repoMap
+func repoMapPaths(repoMap string) []string {
+	var paths []string
+	for _, line := range strings.Split(repoMap, "\n") {
+		if strings.HasPrefix(line, repoMapHeader) {
+			paths = append(paths, strings.TrimSuffix(strings.TrimPrefix(line, repoMapHeader), " ---"))
+		}
+	}
+	return paths
+}
@@ -0,0 +1,79 @@
+package smartcomplete
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtractOutline(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		content  string
+		expected []string
+	}{
+		{
+			name: "go",
+			path: "server.go",
+			content: "package server\n\nimport \"net/http\"\n\n" +
+				"type Server struct {\n\taddr string\n}\n\n" +
+				"func New(addr string) *Server {\n\treturn &Server{addr: addr}\n}\n\n" +
+				"func (s *Server) Start() error {\n\tfunc() {}()\n\treturn nil\n}\n",
+			expected: []string{"type Server struct", "func New(addr string) *Server", "func (s *Server) Start() error"},
+		},
+		{
+			name: "python",
+			path: "models.py",
+			content: "import os\n\nclass User:\n    def name(self):\n        return 'x'\n\n" +
+				"def load(path):\n    pass\n\nasync def fetch(url):\n    pass\n",
+			expected: []string{"class User:", "def load(path):", "async def fetch(url):"},
+		},
+		{
+			name:     "unknown language",
+			path:     "notes.txt",
+			content:  "func looks like go\n",
+			expected: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extractOutline(tt.path, tt.content)
+			if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+				t.Errorf("extractOutline() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRepoMapDropLastOutline(t *testing.T) {
+	repoMap := buildRepoMap([]FileContext{
+		{Path: "a.go", Content: "func A() {\n}\n"},
+		{Path: "notes.txt", Content: "no outline\n"},
+		{Path: "b.py", Content: "def b():\n    pass\n"},
+	})
+
+	if paths := repoMapPaths(repoMap); strings.Join(paths, ",") != "a.go,b.py" {
+		t.Errorf("repoMapPaths() = %v, want [a.go b.py]", paths)
+	}
+
+	rest, dropped := dropLastOutline(repoMap)
+	if dropped != "b.py" {
+		t.Errorf("dropped %q, want b.py", dropped)
+	}
+	if want := "--- a.go ---\nfunc A()\n"; rest != want {
+		t.Errorf("remaining map = %q, want %q", rest, want)
+	}
+
+	rest, dropped = dropLastOutline(rest)
+	if dropped != "a.go" || rest != "" {
+		t.Errorf("dropLastOutline of the last outline = %q, %q; want \"\", \"a.go\"", rest, dropped)
+	}
+}
+
+func TestFIMPromptIncludesRepoMap(t *testing.T) {
+	repoMap := buildRepoMap([]FileContext{{Path: "a.go", Content: "func A() {\n}\n"}})
+	prompt := (&FIMFormatter{}).FormatPrompt(&CompletionContext{RepoMap: repoMap, Prefix: "x"})
+	if !strings.Contains(prompt, "REPOSITORY OUTLINE:\n--- a.go ---\nfunc A()\n") {
+		t.Errorf("prompt has no repository outline:\n%s", prompt)
+	}
+}
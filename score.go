@@ -0,0 +1,57 @@
+package smartcomplete
+
+import (
+	"context"
+	"unicode/utf8"
+)
+
+// ScoringClient is an optional extension to GrokkerClient. When implemented,
+// the provider's score for the completion (e.g. mean token logprob) is
+// returned as CompletionResponse.Score instead of a heuristic one. Stop
+// sequences are passed as to a StopSequenceClient; stop may be empty.
+type ScoringClient interface {
+	QueryWithScore(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64, stop []string) (string, int, float64, error)
+}
+
+// heuristicScore rates a completion in (0, 1] when the provider doesn't
+// score it. Longer completions score lower, and completions that close
+// brackets the prefix never opened are penalized.
+func heuristicScore(completion string, ctx *CompletionContext) float64 {
+	score := 1 / (1 + float64(utf8.RuneCountInString(completion))/500)
+	if !bracketsConsistent(ctx.Prefix, completion) {
+		score /= 2
+	}
+	return score
+}
+
+// bracketsConsistent reports whether every closing bracket in completion
+// matches a bracket left open by prefix or by completion itself. The prefix
+// may have been trimmed, so unmatched closers in it are ignored.
+func bracketsConsistent(prefix, completion string) bool {
+	pairs := map[rune]rune{')': '(', ']': '[', '}': '{'}
+
+	var open []rune
+	for _, r := range prefix {
+		switch r {
+		case '(', '[', '{':
+			open = append(open, r)
+		case ')', ']', '}':
+			if len(open) > 0 && open[len(open)-1] == pairs[r] {
+				open = open[:len(open)-1]
+			}
+		}
+	}
+
+	for _, r := range completion {
+		switch r {
+		case '(', '[', '{':
+			open = append(open, r)
+		case ')', ']', '}':
+			if len(open) == 0 || open[len(open)-1] != pairs[r] {
+				return false
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package smartcomplete
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scoringClient returns its completions and scores in turn, one per query
+type scoringClient struct {
+	EchoGrokkerClient
+
+	mu          sync.Mutex
+	completions []string
+	scores      []float64
+	calls       int
+}
+
+func (c *scoringClient) QueryWithScore(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64, stop []string) (string, int, float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.calls % len(c.completions)
+	c.calls++
+	return c.completions[i], 1, c.scores[i], nil
+}
+
+func TestProviderScore(t *testing.T) {
+	client := &scoringClient{completions: []string{"first()"}, scores: []float64{-0.5}}
+	service := newTestService(t, testConfig(), client)
+	fake := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}
+
+	resp, err := service.Complete(context.Background(), req, fake)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Completion != "first()" || resp.Score != -0.5 {
+		t.Errorf("completion = %q (score %v), want first() with the provider's score -0.5", resp.Completion, resp.Score)
+	}
+}
+
+func TestHeuristicScore(t *testing.T) {
+	ctx := &CompletionContext{Prefix: "func main() {\n\tif ok {\n"}
+	tests := []struct {
+		name   string
+		better string
+		worse  string
+	}{
+		{"shorter wins", "x++", "x++\n" + strings.Repeat("y++\n", 100)},
+		{"closing open bracket", "\t}\n}", "\t})\n"},
+		{"balanced over stray closer", "f(x)", "f(x))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			better := heuristicScore(tt.better, ctx)
+			worse := heuristicScore(tt.worse, ctx)
+			if better <= worse {
+				t.Errorf("heuristicScore(%q) = %v, not above heuristicScore(%q) = %v", tt.better, better, tt.worse, worse)
+			}
+			if better <= 0 || better > 1 {
+				t.Errorf("heuristicScore(%q) = %v, want in (0, 1]", tt.better, better)
+			}
+		})
+	}
+}
+
+func TestHeuristicScoreUsedWithoutProviderScore(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x++"})
+	fake := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, CursorColumn: 0}
+
+	resp, err := service.Complete(context.Background(), req, fake)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Score <= 0 || resp.Score > 1 {
+		t.Errorf("Score = %v, want a heuristic score in (0, 1]", resp.Score)
+	}
+}
+
+func TestCandidatesOrderedByScore(t *testing.T) {
+	client := &scoringClient{
+		completions: []string{"low()", "best()", "middle()"},
+		scores:      []float64{-2, -0.1, -1},
+	}
+	service := newTestService(t, testConfig(), client)
+	fake := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1, Candidates: 3}
+
+	resp, err := service.Complete(context.Background(), req, fake)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Completion != "best()" || resp.Score != -0.1 {
+		t.Errorf("completion = %q (score %v), want best() with score -0.1", resp.Completion, resp.Score)
+	}
+	want := []Alternative{{"middle()", -1}, {"low()", -2}}
+	if !reflect.DeepEqual(resp.Alternatives, want) {
+		t.Errorf("Alternatives = %+v, want %+v", resp.Alternatives, want)
+	}
+}
@@ -0,0 +1,72 @@
+package smartcomplete
+
+import (
+	"encoding/json"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"path/filepath"
+	"strings"
+)
+
+// checkSyntax reports whether inserting continueFrom and completion at the
+// cursor leaves the file syntactically valid. Go is parsed, JSON is
+// validated and other known languages get a bracket-balance check. ok is
+// false when the language can't be checked. normalize splits the file and
+// continueFrom the way context gathering did.
+func checkSyntax(filePath, fileContent string, line, col int, continueFrom, completion string, normalize bool) (valid, ok bool) {
+	fileContent, _ = cursorContent(fileContent, normalize)
+	continueFrom, _ = cursorContent(continueFrom, normalize)
+	prefix, suffix := extractPrefixSuffix(fileContent, line, col)
+	completion = continueFrom + completion
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".go":
+		return goSyntaxValid(prefix, completion, suffix), true
+	case ".json":
+		if json.Valid([]byte(prefix + completion + suffix)) {
+			return true, true
+		}
+		if json.Valid([]byte(prefix + suffix)) {
+			return false, true
+		}
+		return bracketsConsistent(prefix, completion), true
+	}
+
+	// Shell case patterns use unpaired ")"
+	if lang := detectLanguage(filePath); lang == "code" || lang == "Shell" {
+		return false, false
+	}
+	return bracketsConsistent(prefix, completion), true
+}
+
+// goSyntaxValid parses the completed Go file. A file that was already broken
+// (e.g. mid-edit) only fails if a parse error lands in the completion or the
+// rest of its last line.
+func goSyntaxValid(prefix, completion, suffix string) bool {
+	_, err := parser.ParseFile(token.NewFileSet(), "", prefix+completion+suffix, 0)
+	if err == nil {
+		return true
+	}
+	if _, origErr := parser.ParseFile(token.NewFileSet(), "", prefix+suffix, 0); origErr == nil {
+		return false
+	}
+
+	errs, isList := err.(scanner.ErrorList)
+	if !isList {
+		return false
+	}
+	start := len(prefix)
+	end := start + len(completion)
+	if i := strings.IndexByte(suffix, '\n'); i >= 0 {
+		end += i
+	} else {
+		end += len(suffix)
+	}
+	for _, e := range errs {
+		if e.Pos.Offset >= start && e.Pos.Offset <= end {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package smartcomplete
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckSyntax(t *testing.T) {
+	goFile := "package main\n\nfunc main() {\n\t\n}\n"
+	tests := []struct {
+		name       string
+		path       string
+		content    string
+		line, col  int
+		completion string
+		wantValid  bool
+		wantOK     bool
+	}{
+		{"go valid", "main.go", goFile, 3, 1, "x := 1\n\t_ = x", true, true},
+		{"go unbalanced brace", "main.go", goFile, 3, 1, "if x {", false, true},
+		{"go extra closer", "main.go", goFile, 3, 1, "}\n}", false, true},
+		{"go broken elsewhere", "main.go", "package main\n\nfunc main() {\n\t\n}\n\nfunc broken( {\n", 3, 1, "x := 1\n\t_ = x", true, true},
+		{"json valid", "a.json", "{\"a\": 1}\n", 0, 7, "2", true, true},
+		{"json invalid", "a.json", "{\"a\": 1}\n", 0, 7, ",}", false, true},
+		{"json already broken", "a.json", "{\"a\": }\n", 0, 6, "[1", true, true},
+		{"python balanced", "a.py", "x = f(\n", 0, 6, "1)", true, true},
+		{"python stray closer", "a.py", "x = f(\n", 0, 6, "1))", false, true},
+		{"shell unchecked", "a.sh", "case x in\n", 1, 0, "a) ;;", false, false},
+		{"unknown language", "a.xyz", "", 0, 0, "}", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, ok := checkSyntax(tt.path, tt.content, tt.line, tt.col, "", tt.completion, true)
+			if valid != tt.wantValid || ok != tt.wantOK {
+				t.Errorf("checkSyntax(%q) = %t, %t, want %t, %t", tt.completion, valid, ok, tt.wantValid, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCheckSyntaxLineEndings(t *testing.T) {
+	// Lone CR endings only split into lines when normalized; otherwise the
+	// cursor line is past the end and the completion lands at end-of-file
+	content := "x = f(\r)\r"
+	tests := []struct {
+		name      string
+		normalize bool
+		want      bool
+	}{
+		{"normalized", true, true},
+		{"not normalized", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, ok := checkSyntax("a.py", content, 1, 0, "1\r", ")", tt.normalize)
+			if !ok || valid != tt.want {
+				t.Errorf("checkSyntax = %t, %t, want %t, true", valid, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteSyntaxValid(t *testing.T) {
+	tests := []struct {
+		name       string
+		completion string
+		want       bool
+	}{
+		{"valid", "println()", true},
+		{"unbalanced", "if x {", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.CheckSyntax = true
+			service := newTestService(t, config, &EchoGrokkerClient{Completion: tt.completion})
+			fake := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"})
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}
+
+			resp, err := service.Complete(context.Background(), req, fake)
+			if err != nil {
+				t.Fatalf("Complete: %v", err)
+			}
+			if resp.SyntaxValid == nil {
+				t.Fatal("SyntaxValid not set for a Go file")
+			}
+			if *resp.SyntaxValid != tt.want {
+				t.Errorf("SyntaxValid = %t, want %t", *resp.SyntaxValid, tt.want)
+			}
+		})
+	}
+}
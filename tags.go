@@ -0,0 +1,71 @@
+package smartcomplete
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TagsSectionName heads the prompt section of symbols from Config.TagsFile.
+// The section is trimmed like a ContextProvider's, as "provider:symbols".
+const TagsSectionName = "symbols"
+
+// maxTagSymbols caps the symbol definitions sent from the tags file
+const maxTagSymbols = 50
+
+// gatherTags reads the configured ctags file and returns the definitions of
+// symbols the prefix mentions
+func (g *ContextGatherer) gatherTags(baseDir, targetFile, prefix string, projectGetter ProjectGetter) (string, error) {
+	content, err := projectGetter.ReadFile(resolveFilePath(baseDir, g.tagsFile))
+	if err != nil {
+		return "", err
+	}
+	return relevantTags(string(content), prefix, targetFile), nil
+}
+
+// relevantTags returns one line per definition in tags (ctags format) whose
+// name appears as an identifier in prefix, in file order. Definitions in
+// the target file are skipped; they are already in the prompt.
+func relevantTags(tags, prefix, targetFile string) string {
+	prefixIDs := identifiers(prefix)
+	seen := make(map[string]bool)
+	var entries []string
+	for _, line := range strings.Split(tags, "\n") {
+		if line == "" || strings.HasPrefix(line, "!_") {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		name, file, address := fields[0], fields[1], fields[2]
+		if _, ok := prefixIDs[name]; !ok || filepath.Clean(file) == filepath.Clean(targetFile) {
+			continue
+		}
+
+		address, _, _ = strings.Cut(address, `;"`)
+		entry := fmt.Sprintf("%s: %s", file, tagDefinition(name, address))
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		entries = append(entries, entry)
+		if len(entries) == maxTagSymbols {
+			break
+		}
+	}
+	return strings.Join(entries, "\n")
+}
+
+// tagDefinition returns the source line a tag's address searches for, or
+// the name and line number for a numeric address
+func tagDefinition(name, address string) string {
+	if n, err := strconv.Atoi(address); err == nil {
+		return fmt.Sprintf("%s (line %d)", name, n)
+	}
+	pattern := strings.TrimSuffix(strings.TrimPrefix(address, "/^"), "$/")
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "?^"), "$?")
+	pattern = strings.ReplaceAll(pattern, `\/`, "/")
+	return strings.TrimSpace(pattern)
+}
@@ -0,0 +1,51 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testTags = "!_TAG_FILE_FORMAT\t2\t/extended format/\n" +
+	"ParseConfig\tconfig.go\t/^func ParseConfig(path string) (*Config, error) {$/;\"\tf\n" +
+	"Server\tserver.go\t/^type Server struct {$/;\"\tt\n" +
+	"Unused\tunused.go\t/^func Unused() {}$/;\"\tf\n" +
+	"maxRetries\tretry.go\t12;\"\tc\n" +
+	"handle\tmain.go\t/^func handle() {$/;\"\tf\n"
+
+func TestRelevantTags(t *testing.T) {
+	prefix := "func handle() {\n\tcfg, err := ParseConfig(\"a\")\n\tfor i := 0; i < maxRetries; i++ {\n\t\ts := &Server{"
+	got := relevantTags(testTags, prefix, "main.go")
+	want := "config.go: func ParseConfig(path string) (*Config, error) {\n" +
+		"server.go: type Server struct {\n" +
+		"retry.go: maxRetries (line 12)"
+	if got != want {
+		t.Errorf("relevantTags =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTagsFileInPrompt(t *testing.T) {
+	config := testConfig()
+	config.TagsFile = "tags"
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, config, client)
+
+	pg := newFakeProject(map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\tcfg, _ := ParseConfig(\"a\")\n\t\n}\n",
+		"tags":    testTags,
+	})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 4, CursorColumn: 1}
+	if _, err := service.Complete(context.Background(), req, pg); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	prompt := client.lastPrompt()
+	if want := "SYMBOLS:\nconfig.go: func ParseConfig(path string) (*Config, error) {\n"; !strings.Contains(prompt, want) {
+		t.Errorf("prompt does not contain %q:\n%s", want, prompt)
+	}
+	for _, unwanted := range []string{"Server", "Unused", "maxRetries"} {
+		if strings.Contains(prompt, unwanted) {
+			t.Errorf("prompt contains unreferenced symbol %q:\n%s", unwanted, prompt)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package smartcomplete
+
+import (
+	"unicode/utf8"
+)
+
+// truncateHead returns at most maxRunes runes from the start of s, never
+// splitting a multibyte rune
+func truncateHead(s string, maxRunes int) string {
+	if maxRunes <= 0 {
+		return ""
+	}
+	count := 0
+	for i := range s {
+		if count == maxRunes {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// truncateTail returns at most maxRunes runes from the end of s, never
+// splitting a multibyte rune
+func truncateTail(s string, maxRunes int) string {
+	if maxRunes <= 0 {
+		return ""
+	}
+	total := utf8.RuneCountInString(s)
+	if total <= maxRunes {
+		return s
+	}
+	skip := total - maxRunes
+	count := 0
+	for i := range s {
+		if count == skip {
+			return s[i:]
+		}
+		count++
+	}
+	return ""
+}
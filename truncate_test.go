@@ -0,0 +1,79 @@
+package smartcomplete
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		maxRunes int
+		wantHead string
+		wantTail string
+	}{
+		{"ascii", "abcdef", 3, "abc", "def"},
+		{"multibyte", "héllo wörld", 4, "héll", "örld"},
+		{"cjk", "日本語のテキスト", 2, "日本", "スト"},
+		{"emoji", "a😀b😀c", 2, "a😀", "😀c"},
+		{"shorter than limit", "日本", 5, "日本", "日本"},
+		{"zero", "日本", 0, "", ""},
+		{"negative", "日本", -1, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, tail := truncateHead(tt.s, tt.maxRunes), truncateTail(tt.s, tt.maxRunes)
+			if head != tt.wantHead {
+				t.Errorf("truncateHead(%q, %d) = %q, want %q", tt.s, tt.maxRunes, head, tt.wantHead)
+			}
+			if tail != tt.wantTail {
+				t.Errorf("truncateTail(%q, %d) = %q, want %q", tt.s, tt.maxRunes, tail, tt.wantTail)
+			}
+		})
+	}
+}
+
+func TestGatheredContextIsValidUTF8(t *testing.T) {
+	discussion := strings.Repeat("日本語の議論です。", 1000)
+	agents := strings.Repeat("Écrivez du code clair — ", 1000)
+	pg := newFakeProject(map[string]string{
+		"main.go":       "package main\n\n// こんにちは\n",
+		"AGENTS.md":     agents,
+		"discussion.md": discussion,
+	})
+	pg.discussion = "discussion.md"
+
+	tests := []struct {
+		name      string
+		maxTokens int
+	}{
+		{"discussion cap", 100000},
+		{"budget trimming", 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gatherer := newGatherer(testConfig())
+			gatherer.maxTokens = tt.maxTokens
+			req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 2, CursorColumn: 6}
+			ctx, err := gatherer.GatherContext(context.Background(), req, pg.files["main.go"], pg)
+			if err != nil {
+				t.Fatalf("GatherContext: %v", err)
+			}
+			if len(ctx.DiscussionContext) >= len(discussion) && len(ctx.AgentsInstructions) >= len(agents) {
+				t.Fatal("nothing was truncated")
+			}
+			for name, s := range map[string]string{
+				"discussion": ctx.DiscussionContext,
+				"agents":     ctx.AgentsInstructions,
+				"prefix":     ctx.Prefix,
+			} {
+				if !utf8.ValidString(s) {
+					t.Errorf("%s is not valid UTF-8", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package smartcomplete
+
+import "context"
+
+// TokenUsage is a provider's report of the tokens a query used
+type TokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// UsageClient is an optional extension to GrokkerClient, preferred over the
+// others when implemented. It gets the temperature and stop sequences (stop
+// may be empty), and the provider's prompt token count is used for
+// EstimatedCost and, with IncludeTokenUsage, reported next to the estimate
+// to calibrate it.
+type UsageClient interface {
+	QueryWithUsage(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64, stop []string) (UsageResult, error)
+}
+
+// UsageResult is a UsageClient's completion with the provider's token
+// usage and, if it scores completions, its score
+type UsageResult struct {
+	Text  string
+	Usage TokenUsage
+	Score *float64 // as a ScoringClient's; nil for none
+}
+
+// TokenUsageReport compares the prompt token estimate with the provider's
+// count; ProviderPromptTokens and Delta are 0 when the client doesn't
+// report usage
+type TokenUsageReport struct {
+	EstimatedPromptTokens int `json:"estimatedPromptTokens"`
+	ProviderPromptTokens  int `json:"providerPromptTokens,omitempty"`
+	Delta                 int `json:"delta,omitempty"` // provider minus estimate
+}
+
+// tokenUsageReport compares estimated with the provider's prompt tokens,
+// if known
+func tokenUsageReport(estimated, providerPrompt int) *TokenUsageReport {
+	report := &TokenUsageReport{EstimatedPromptTokens: estimated}
+	if providerPrompt > 0 {
+		report.ProviderPromptTokens = providerPrompt
+		report.Delta = providerPrompt - estimated
+	}
+	return report
+}
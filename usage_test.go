@@ -0,0 +1,90 @@
+package smartcomplete
+
+import (
+	"context"
+	"testing"
+)
+
+// usageClient reports a fixed token usage and score, and records the stop
+// sequences it is asked to use. Its embedded stopClient makes it a
+// StopSequenceClient too.
+type usageClient struct {
+	stopClient
+	usage TokenUsage
+	score *float64
+}
+
+func (c *usageClient) QueryWithUsage(ctx context.Context, llm string, systemMsg string, userMsg string, maxTokens int, temperature float64, stop []string) (UsageResult, error) {
+	c.stops = append(c.stops, stop)
+	return UsageResult{Text: c.Completion, Usage: c.usage, Score: c.score}, nil
+}
+
+func TestTokenUsageDelta(t *testing.T) {
+	config := testConfig()
+	config.IncludeTokenUsage = true
+	client := &usageClient{stopClient: stopClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}, usage: TokenUsage{PromptTokens: 500, CompletionTokens: 3}}
+	service := newTestService(t, config, client)
+
+	pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	usage := resp.TokenUsage
+	if usage == nil || usage.EstimatedPromptTokens <= 0 {
+		t.Fatalf("TokenUsage = %+v, want an estimate", usage)
+	}
+	if usage.ProviderPromptTokens != 500 || usage.Delta != 500-usage.EstimatedPromptTokens {
+		t.Errorf("TokenUsage = %+v, want provider tokens 500 and their delta from the estimate", usage)
+	}
+	if resp.TokensUsed != 503 {
+		t.Errorf("TokensUsed = %d, want prompt and completion tokens 503", resp.TokensUsed)
+	}
+}
+
+func TestTokenUsageWithoutProviderCount(t *testing.T) {
+	config := testConfig()
+	config.IncludeTokenUsage = true
+	service := newTestService(t, config, &EchoGrokkerClient{Completion: "x"})
+
+	pg := newFakeProject(map[string]string{"main.go": "package main\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if usage := resp.TokenUsage; usage == nil || usage.EstimatedPromptTokens <= 0 || usage.ProviderPromptTokens != 0 || usage.Delta != 0 {
+		t.Errorf("TokenUsage = %+v, want only the estimate", usage)
+	}
+}
+
+func TestTokenUsageWithStopSequences(t *testing.T) {
+	config := testConfig()
+	config.IncludeTokenUsage = true
+	config.SingleLine = true
+	score := -0.25
+	client := &usageClient{
+		stopClient: stopClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}},
+		usage:      TokenUsage{PromptTokens: 500, CompletionTokens: 3},
+		score:      &score,
+	}
+	service := newTestService(t, config, client)
+
+	pg := newFakeProject(map[string]string{"main.go": "package main\n\nfunc main() {\n\t\n}\n"})
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, CursorColumn: 1}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if len(client.stops) != 1 || len(client.stops[0]) != 1 || client.stops[0][0] != "\n" {
+		t.Errorf("stop sequences = %q, want the single-line stop passed with the usage query", client.stops)
+	}
+	if usage := resp.TokenUsage; usage == nil || usage.ProviderPromptTokens != 500 || usage.Delta == 0 {
+		t.Errorf("TokenUsage = %+v, want the provider's 500 prompt tokens and a delta", usage)
+	}
+	if resp.Score != score {
+		t.Errorf("Score = %v, want the provider's %v", resp.Score, score)
+	}
+}
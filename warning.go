@@ -0,0 +1,68 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// ContextWarning reports a context file that was asked for but left out of
+// the prompt. The completion still goes ahead.
+type ContextWarning struct {
+	Path    string `json:"path"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// ContextWarning kinds
+const (
+	WarningUnreadable = "unreadable" // the file couldn't be read
+	WarningSkipped    = "skipped"    // left out before reading, or a near-copy of the target
+	WarningTruncated  = "truncated"  // dropped to fit the token budget
+)
+
+// Messages for WarningSkipped files
+const (
+	deadlineSkipMessage = "context gathering stopped at its deadline"
+	binarySkipMessage   = "binary or non-UTF-8 content"
+)
+
+// unreadableMessage describes why a context file couldn't be read in fixed
+// terms, since the error itself may name absolute paths on the host. The
+// error goes to the Observer instead.
+func unreadableMessage(err error) string {
+	switch {
+	case isNotFound(err):
+		return "not found"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(err, ErrReadTimeout), errors.Is(err, context.DeadlineExceeded), os.IsTimeout(err):
+		return "timed out"
+	default:
+		return "could not be read"
+	}
+}
+
+// trimWarnings returns a WarningTruncated for each file the trim report
+// shows was dropped
+func trimWarnings(report *TrimReport) []ContextWarning {
+	if report == nil {
+		return nil
+	}
+	var warnings []ContextWarning
+	for _, section := range report.Sections {
+		for _, prefix := range []string{"file:", "open_file:"} {
+			if path, ok := strings.CutPrefix(section.Section, prefix); ok {
+				warnings = append(warnings, ContextWarning{
+					Path:    path,
+					Kind:    WarningTruncated,
+					Message: fmt.Sprintf("dropped to fit the %d token budget", report.BudgetTokens),
+				})
+			}
+		}
+	}
+	return warnings
+}
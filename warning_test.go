@@ -0,0 +1,172 @@
+package smartcomplete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// binaryBlob is the start of a PNG file
+const binaryBlob = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x10"
+
+func TestContextWarnings(t *testing.T) {
+	main := "package main\n\nfunc main() {\n\tprintln(\"hi\")\n\tprintln(\"bye\")\n}\n"
+	pg := newFakeProject(map[string]string{
+		"main.go":   main,
+		"util.go":   "package main\n\nfunc helper() {}\n",
+		"secret.go": "package main\n",
+		"copy.go":   main,
+	})
+	pg.readErrs = map[string]error{"secret.go": fs.ErrPermission}
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+
+	req := CompletionRequest{
+		ProjectID:    "p",
+		FilePath:     "main.go",
+		CursorLine:   3,
+		ContextFiles: []string{"util.go", "secret.go", "copy.go"},
+	}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	want := map[string]string{"secret.go": WarningUnreadable, "copy.go": WarningSkipped}
+	if len(resp.Warnings) != len(want) {
+		t.Fatalf("Warnings = %+v, want one each for %v", resp.Warnings, want)
+	}
+	for _, w := range resp.Warnings {
+		if want[w.Path] != w.Kind {
+			t.Errorf("warning %+v, want kind %q", w, want[w.Path])
+		}
+		if w.Message == "" {
+			t.Errorf("warning for %s has no message", w.Path)
+		}
+	}
+}
+
+func TestUnreadableWarningMessages(t *testing.T) {
+	readErrs := map[string]error{
+		"missing.go": &fs.PathError{Op: "open", Path: "/home/dev/project/missing.go", Err: fs.ErrNotExist},
+		"secret.go":  &fs.PathError{Op: "open", Path: "/home/dev/project/secret.go", Err: fs.ErrPermission},
+		"slow.go":    fmt.Errorf("/home/dev/project/slow.go: %w", ErrReadTimeout),
+		"broken.go":  errors.New("read /home/dev/project/broken.go: input/output error"),
+	}
+	want := map[string]string{
+		"missing.go": "not found",
+		"secret.go":  "permission denied",
+		"slow.go":    "timed out",
+		"broken.go":  "could not be read",
+	}
+	files := map[string]string{"main.go": "package main\n"}
+	var contextFiles []string
+	for path := range readErrs {
+		files[path] = "package main\n"
+		contextFiles = append(contextFiles, path)
+	}
+	pg := newFakeProject(files)
+	pg.readErrs = readErrs
+	observer := &recordingObserver{}
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	service.SetObserver(observer)
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 1, ContextFiles: contextFiles}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if len(resp.Warnings) != len(want) {
+		t.Fatalf("Warnings = %+v, want one per unreadable file", resp.Warnings)
+	}
+	for _, w := range resp.Warnings {
+		if w.Message != want[w.Path] {
+			t.Errorf("%s message = %q, want %q", w.Path, w.Message, want[w.Path])
+		}
+	}
+
+	// The full errors go to the observer
+	reported := make(map[string]error)
+	for i, section := range observer.failedSections() {
+		reported[section] = observer.errs[i]
+	}
+	for path, readErr := range readErrs {
+		if got := reported["file:"+path]; got != readErr {
+			t.Errorf("observer got %v for %s, want %v", got, path, readErr)
+		}
+	}
+}
+
+func TestTrimWarnings(t *testing.T) {
+	report := &TrimReport{BudgetTokens: 100, Sections: []SectionTrim{
+		{Section: "discussion", BeforeTokens: 50, AfterTokens: 10},
+		{Section: "file:a.go", BeforeTokens: 40},
+		{Section: "open_file:b.go", BeforeTokens: 30},
+	}}
+	warnings := trimWarnings(report)
+	if len(warnings) != 2 || warnings[0].Path != "a.go" || warnings[1].Path != "b.go" {
+		t.Fatalf("trimWarnings = %+v, want a.go and b.go", warnings)
+	}
+	for _, w := range warnings {
+		if w.Kind != WarningTruncated {
+			t.Errorf("%s kind = %q, want %q", w.Path, w.Kind, WarningTruncated)
+		}
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"go source", "package main\n\nfunc main() {}\n", false},
+		{"utf-8 text", "// héllo, 世界\n", false},
+		{"empty", "", false},
+		{"png", binaryBlob, true},
+		{"latin-1", "caf\xe9 cr\xe8me br\xfbl\xe9e", true},
+		{"stray invalid byte", strings.Repeat("text ", 20) + "\xff", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBinary([]byte(tt.content)); got != tt.want {
+				t.Errorf("isBinary(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBinaryContextFileSkipped(t *testing.T) {
+	client := &recordingClient{EchoGrokkerClient: EchoGrokkerClient{Completion: "x"}}
+	service := newTestService(t, testConfig(), client)
+	pg := newFakeProject(map[string]string{
+		"main.go":  "package main\n\nfunc main() {\n}\n",
+		"logo.png": binaryBlob,
+	})
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "main.go", CursorLine: 3, ContextFiles: []string{"logo.png"}}
+	resp, err := service.Complete(context.Background(), req, pg)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if len(resp.Warnings) != 1 || resp.Warnings[0].Path != "logo.png" || resp.Warnings[0].Kind != WarningSkipped {
+		t.Errorf("Warnings = %+v, want logo.png skipped", resp.Warnings)
+	}
+	if strings.Contains(client.lastPrompt(), "logo.png") {
+		t.Errorf("prompt contains the binary file:\n%s", client.lastPrompt())
+	}
+}
+
+func TestBinaryTargetFileRejected(t *testing.T) {
+	service := newTestService(t, testConfig(), &EchoGrokkerClient{Completion: "x"})
+	pg := newFakeProject(map[string]string{"logo.png": binaryBlob})
+
+	req := CompletionRequest{ProjectID: "p", FilePath: "logo.png", CursorLine: 0}
+	_, err := service.Complete(context.Background(), req, pg)
+	var completionErr *CompletionError
+	if !errors.Is(err, ErrBinaryFile) || !errors.As(err, &completionErr) || completionErr.Code != CodeValidation {
+		t.Fatalf("err = %v, want a validation error wrapping ErrBinaryFile", err)
+	}
+}